@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/metadata"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+// catalogUpdateAttempts bounds how often a catalog update is retried when
+// another writer modifies the catalog concurrently
+const catalogUpdateAttempts = 10
+
+// updateCatalog applies update to the catalog with a read-modify-write cycle.
+// The write is conditional on the catalog being unchanged since it was read,
+// so concurrent backups never overwrite each other's entries; on conflict the
+// cycle is retried. A missing catalog is rebuilt from the manifests first.
+func updateCatalog(ctx context.Context, s3Client *storage.Client, update func(*metadata.Catalog)) error {
+	for attempt := 1; attempt <= catalogUpdateAttempts; attempt++ {
+		catalog := metadata.NewCatalog()
+		etag, err := s3Client.DownloadJSONWithETag(ctx, metadata.CatalogPath, catalog)
+		if errors.Is(err, storage.ErrNotFound) {
+			manifests, err := scanManifests(ctx, s3Client)
+			if err != nil {
+				return err
+			}
+			catalog = metadata.BuildCatalog(manifests)
+		} else if err != nil {
+			return fmt.Errorf("failed to read catalog (run 'cbt-backup catalog rebuild' if it is corrupt): %w", err)
+		}
+
+		update(catalog)
+		catalog.Version = metadata.CatalogVersion
+
+		err = s3Client.UploadJSONIfMatch(ctx, metadata.CatalogPath, catalog, etag)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, storage.ErrPreconditionFailed) {
+			return fmt.Errorf("failed to write catalog: %w", err)
+		}
+
+		// Back off a little longer each time another writer wins
+		time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+	}
+
+	return fmt.Errorf("failed to update catalog after %d attempts: %w", catalogUpdateAttempts, storage.ErrPreconditionFailed)
+}
+
+// loadCatalog reads the global catalog. If it is missing or cannot be read,
+// the catalog is built in memory from the snapshot manifests instead.
+func loadCatalog(ctx context.Context, s3Client *storage.Client) (*metadata.Catalog, error) {
+	catalog := metadata.NewCatalog()
+	err := s3Client.DownloadJSON(ctx, metadata.CatalogPath, catalog)
+	if err == nil {
+		return catalog, nil
+	}
+
+	fmt.Printf("Warning: catalog unavailable, scanning manifests (%v)\n", err)
+	manifests, err := scanManifests(ctx, s3Client)
+	if err != nil {
+		return nil, err
+	}
+	return metadata.BuildCatalog(manifests), nil
+}
+
+// scanManifests downloads every snapshot manifest in the bucket. Manifests
+// that cannot be read are reported and skipped.
+func scanManifests(ctx context.Context, s3Client *storage.Client) ([]metadata.SnapshotManifest, error) {
+	objects, err := s3Client.ListObjects(ctx, "metadata/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	var manifests []metadata.SnapshotManifest
+	for _, obj := range objects {
+		if !strings.HasSuffix(obj, "/manifest.json") {
+			continue
+		}
+		var manifest metadata.SnapshotManifest
+		if err := s3Client.DownloadJSON(ctx, obj, &manifest); err != nil {
+			fmt.Printf("Warning: Failed to load %s: %v\n", obj, err)
+			continue
+		}
+		manifests = append(manifests, manifest)
+	}
+
+	return manifests, nil
+}
+
+// resolveDependencies returns the snapshots an incremental backup on top of
+// base needs for restore, base first. The catalog is consulted first; if it
+// does not know the base, only the base itself is recorded.
+func resolveDependencies(ctx context.Context, s3Client *storage.Client, base string) []string {
+	if base == "" {
+		return []string{}
+	}
+
+	catalog := metadata.NewCatalog()
+	if err := s3Client.DownloadJSON(ctx, metadata.CatalogPath, catalog); err == nil {
+		if chain, err := catalog.ResolveChain(base); err == nil {
+			return chain
+		}
+	}
+	return []string{base}
+}
+
+func newCatalogCmd() *cobra.Command {
+	catalogCmd := &cobra.Command{
+		Use:   "catalog",
+		Short: "Manage the global backup catalog",
+	}
+
+	catalogRebuildCmd := &cobra.Command{
+		Use:   "rebuild",
+		Short: "Regenerate the catalog from snapshot manifests",
+		Long: `Scans every snapshot manifest in the bucket and writes a fresh
+catalog. Use it when the catalog is missing or corrupt.`,
+		RunE: runCatalogRebuild,
+	}
+	addStorageFlags(catalogRebuildCmd)
+	addLockFlags(catalogRebuildCmd)
+	catalogCmd.AddCommand(catalogRebuildCmd)
+
+	return catalogCmd
+}
+
+func runCatalogRebuild(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+
+	fmt.Println("========================================")
+	fmt.Println("Rebuilding Backup Catalog")
+	fmt.Println("========================================")
+
+	s3Client, _, err := newStorageClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open repository: %w", err)
+	}
+
+	repoLock, lockCtx, err := lockRepository(ctx, s3Client, true, "catalog rebuild")
+	if err != nil {
+		return err
+	}
+	defer unlockRepository(repoLock)
+	ctx = lockCtx
+
+	manifests, err := scanManifests(ctx, s3Client)
+	if err != nil {
+		return err
+	}
+
+	catalog := metadata.BuildCatalog(manifests)
+	if err := s3Client.UploadJSON(ctx, metadata.CatalogPath, catalog); err != nil {
+		return fmt.Errorf("failed to write catalog: %w", err)
+	}
+
+	fmt.Printf("✓ Wrote %s: %d snapshot(s) across %d PVC(s)\n", metadata.CatalogPath, len(catalog.Snapshots), len(catalog.Chains))
+	return nil
+}
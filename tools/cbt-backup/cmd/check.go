@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/blocks"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/compression"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/encryption"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/metadata"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+// maxListedOrphans caps how many orphaned objects check prints by name
+const maxListedOrphans = 20
+
+var readData bool
+
+func newCheckCmd() *cobra.Command {
+	checkCmd := &cobra.Command{
+		Use:   "check",
+		Short: "Verify the consistency of the backup repository",
+		Long: `Checks every snapshot in the repository: that its manifest, block list and
+chain agree, that its chain ends at a full backup without cycles, and that
+every block object it lists exists with the expected size. Block objects
+that no snapshot references are reported as orphans.
+
+With --read-data, every block is also downloaded, decoded and compared
+against its recorded checksum.`,
+		RunE: runCheck,
+	}
+
+	checkCmd.Flags().BoolVar(&readData, "read-data", false, "Download every block and verify its checksum")
+	addStorageFlags(checkCmd)
+	addLockFlags(checkCmd)
+
+	return checkCmd
+}
+
+// checkReport collects the problems found by check
+type checkReport struct {
+	errors   int
+	warnings int
+}
+
+func (r *checkReport) errorf(format string, args ...interface{}) {
+	r.errors++
+	fmt.Printf("  ✗ "+format+"\n", args...)
+}
+
+func (r *checkReport) warnf(format string, args ...interface{}) {
+	r.warnings++
+	fmt.Printf("  ! "+format+"\n", args...)
+}
+
+func runCheck(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+
+	fmt.Println("========================================")
+	fmt.Println("Checking Backup Repository")
+	fmt.Println("========================================")
+
+	s3Client, keyring, err := newStorageClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open repository: %w", err)
+	}
+
+	repoLock, lockCtx, err := lockRepository(ctx, s3Client, false, "check")
+	if err != nil {
+		return err
+	}
+	defer unlockRepository(repoLock)
+	ctx = lockCtx
+
+	steps := 4
+	if readData {
+		steps = 5
+	}
+	report := &checkReport{}
+
+	fmt.Printf("\n[1/%d] Checking snapshot metadata...\n", steps)
+	repo, err := loadRepository(ctx, s3Client)
+	if err != nil {
+		return err
+	}
+	for _, name := range repo.Names {
+		checkSnapshotMetadata(repo.Snapshots[name], report)
+	}
+	fmt.Printf("✓ Checked %d snapshots\n", len(repo.Names))
+
+	fmt.Printf("\n[2/%d] Checking snapshot chains...\n", steps)
+	for _, name := range repo.Names {
+		checkChain(repo, repo.Snapshots[name], report)
+	}
+
+	fmt.Printf("\n[3/%d] Checking block objects...\n", steps)
+	objects, err := checkBlockObjects(ctx, s3Client, repo, report)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✓ Checked %d block objects\n", objects)
+
+	fmt.Printf("\n[4/%d] Looking for orphaned block objects...\n", steps)
+	if err := checkOrphans(ctx, s3Client, repo, report); err != nil {
+		return err
+	}
+
+	if readData {
+		fmt.Printf("\n[5/%d] Reading block data...\n", steps)
+		if err := checkBlockData(ctx, s3Client, keyring, repo, report); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println("\n========================================")
+	fmt.Printf("Check finished: %d error(s), %d warning(s)\n", report.errors, report.warnings)
+	fmt.Println("========================================")
+
+	if report.errors > 0 {
+		return fmt.Errorf("repository check found %d error(s)", report.errors)
+	}
+	return nil
+}
+
+// checkSnapshotMetadata checks that a committed snapshot's manifest, block
+// list and chain describe the same backup
+func checkSnapshotMetadata(snap *repoSnapshot, report *checkReport) {
+	for _, u := range snap.Unreadable {
+		report.errorf("%s: unreadable %s", snap.Name, u)
+	}
+
+	m := snap.Manifest
+	if m == nil {
+		if snap.Checkpoint != nil {
+			report.warnf("%s: backup has not started writing its manifest yet", snap.Name)
+		} else {
+			report.errorf("%s: missing manifest.json", snap.Name)
+		}
+		return
+	}
+	if !m.Committed() {
+		report.warnf("%s: backup is %s", snap.Name, m.State)
+		return
+	}
+	if m.Name != snap.Name {
+		report.errorf("%s: manifest names snapshot %s", snap.Name, m.Name)
+	}
+
+	if snap.Blocks == nil {
+		report.errorf("%s: missing blocks.json", snap.Name)
+	} else {
+		var total int64
+		for _, e := range snap.Blocks.Blocks {
+			total += e.Size
+		}
+		if len(snap.Blocks.Blocks) != m.TotalBlocks {
+			report.errorf("%s: manifest lists %d blocks but blocks.json has %d", snap.Name, m.TotalBlocks, len(snap.Blocks.Blocks))
+		}
+		if total != m.TotalSize {
+			report.errorf("%s: manifest lists %d bytes but blocks.json covers %d", snap.Name, m.TotalSize, total)
+		}
+
+		sorted := append([]blocks.BlockMetadata(nil), snap.Blocks.Blocks...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].Offset < sorted[j].Offset })
+		for i, e := range sorted {
+			if e.Offset < 0 || e.Size <= 0 {
+				report.errorf("%s: invalid block at offset %d with size %d", snap.Name, e.Offset, e.Size)
+				continue
+			}
+			if m.VolumeSize > 0 && e.Offset+e.Size > m.VolumeSize {
+				report.errorf("%s: block at offset %d ends past the volume size %d", snap.Name, e.Offset, m.VolumeSize)
+			}
+			if i > 0 && sorted[i-1].Offset+sorted[i-1].Size > e.Offset {
+				report.errorf("%s: blocks at offsets %d and %d overlap", snap.Name, sorted[i-1].Offset, e.Offset)
+			}
+		}
+	}
+
+	if snap.Chain == nil {
+		report.errorf("%s: missing chain.json", snap.Name)
+		return
+	}
+	c := snap.Chain
+	if c.SnapshotName != m.Name {
+		report.errorf("%s: chain.json names snapshot %s", snap.Name, c.SnapshotName)
+	}
+	if c.IsIncremental != m.IsIncremental || c.BaseSnapshotName != m.BaseSnapshotName {
+		report.errorf("%s: chain.json base %q does not match manifest base %q", snap.Name, c.BaseSnapshotName, m.BaseSnapshotName)
+	}
+}
+
+// checkChain follows a committed snapshot's bases and checks that they end
+// at a restorable full backup
+func checkChain(repo *repository, snap *repoSnapshot, report *checkReport) {
+	if snap.Manifest == nil || !snap.Manifest.Committed() {
+		return
+	}
+
+	chain := []string{snap.Name}
+	visited := map[string]bool{snap.Name: true}
+	current := snap.Manifest
+	for current.IsIncremental {
+		base := current.BaseSnapshotName
+		if base == "" {
+			report.errorf("%s: incremental %s has no base", snap.Name, current.Name)
+			return
+		}
+		if visited[base] {
+			report.errorf("%s: chain has a cycle: %s -> %s", snap.Name, strings.Join(chain, " -> "), base)
+			return
+		}
+		visited[base] = true
+		chain = append(chain, base)
+
+		next := repo.Snapshots[base]
+		if next == nil || next.Manifest == nil {
+			report.errorf("%s: base snapshot %s is missing", snap.Name, base)
+			return
+		}
+		if !next.Manifest.Restorable() {
+			report.errorf("%s: base snapshot %s is not restorable (%s)", snap.Name, base, next.Manifest.State)
+			return
+		}
+		current = next.Manifest
+	}
+
+	// chain.json lists the dependencies oldest first, without the snapshot
+	if snap.Chain != nil && snap.Manifest.Restorable() {
+		var deps []string
+		for i := len(chain) - 1; i > 0; i-- {
+			deps = append(deps, chain[i])
+		}
+		if strings.Join(deps, ",") != strings.Join(snap.Chain.Dependencies, ",") {
+			report.warnf("%s: chain.json dependencies [%s] differ from the resolved chain [%s]",
+				snap.Name, strings.Join(snap.Chain.Dependencies, ", "), strings.Join(deps, ", "))
+		}
+	}
+}
+
+// objectCheck is what the block lists expect of one block object
+type objectCheck struct {
+	snapshot string
+	exact    int64 // expected size; 0 when only a minimum is known
+	minimum  int64 // smallest size that holds every range read from the object
+}
+
+// checkBlockObjects checks that every block object listed by a restorable
+// snapshot exists and has the expected size. It returns the number of
+// distinct objects checked.
+func checkBlockObjects(ctx context.Context, s3Client *storage.Client, repo *repository, report *checkReport) (int, error) {
+	expected := make(map[string]*objectCheck)
+	var order []string
+
+	for _, name := range repo.Names {
+		snap := repo.Snapshots[name]
+		if snap.Manifest == nil || !snap.Manifest.Restorable() || snap.Blocks == nil {
+			continue
+		}
+		for _, e := range snap.Blocks.Blocks {
+			obj := metadata.BlockObjectPath(snap.Manifest, e)
+			c, ok := expected[obj]
+			if !ok {
+				c = &objectCheck{snapshot: name}
+				expected[obj] = c
+				order = append(order, obj)
+			}
+
+			switch {
+			case e.ObjectOffset > 0 || strings.Contains(path.Base(obj), "pack-"):
+				// A range within a pack, or within a pack copied by
+				// consolidate; the pack may hold blocks no longer listed
+				if end := e.ObjectOffset + e.StoredSize; end > c.minimum {
+					c.minimum = end
+				}
+			case e.StoredSize > 0:
+				c.exact = e.StoredSize
+			case e.Compression == "" && snap.Manifest.KeyID == "":
+				c.exact = e.Size
+			}
+		}
+	}
+
+	for i, obj := range order {
+		c := expected[obj]
+		size, err := s3Client.GetObjectSize(ctx, obj)
+		if err != nil {
+			exists, existsErr := s3Client.ObjectExists(ctx, obj)
+			if existsErr != nil {
+				return i, fmt.Errorf("failed to check block object %s: %w", obj, existsErr)
+			}
+			if !exists {
+				report.errorf("%s: block object %s is missing", c.snapshot, obj)
+				continue
+			}
+			return i, err
+		}
+
+		switch {
+		case c.exact > 0 && size != c.exact:
+			report.errorf("%s: block object %s is %d bytes, expected %d", c.snapshot, obj, size, c.exact)
+		case size < c.minimum:
+			report.errorf("%s: block object %s is %d bytes, expected at least %d", c.snapshot, obj, size, c.minimum)
+		}
+
+		if (i+1)%1000 == 0 {
+			fmt.Printf("  Progress: %d/%d objects checked\n", i+1, len(order))
+		}
+	}
+
+	return len(order), nil
+}
+
+// checkOrphans reports block objects that no snapshot references. Objects
+// under the prefix of an unfinished backup are left out, as a resumed
+// backup may still reference them.
+func checkOrphans(ctx context.Context, s3Client *storage.Client, repo *repository, report *checkReport) error {
+	objects, err := s3Client.ListObjects(ctx, "blocks/")
+	if err != nil {
+		return fmt.Errorf("failed to list block objects: %w", err)
+	}
+
+	referenced, claimed := repo.referencedObjects()
+
+	var orphans []string
+	held := 0
+	for _, obj := range objects {
+		if referenced[obj] {
+			continue
+		}
+		if claimedBy(obj, claimed) {
+			held++
+			continue
+		}
+		orphans = append(orphans, obj)
+	}
+
+	if held > 0 {
+		fmt.Printf("  %d unreferenced objects belong to unfinished backups\n", held)
+	}
+	if len(orphans) == 0 {
+		fmt.Println("✓ No orphaned block objects")
+		return nil
+	}
+	for i, obj := range orphans {
+		if i == maxListedOrphans {
+			fmt.Printf("    ... and %d more\n", len(orphans)-maxListedOrphans)
+			break
+		}
+		fmt.Printf("    %s\n", obj)
+	}
+	report.warnf("%d orphaned block objects", len(orphans))
+	return nil
+}
+
+// claimedBy reports whether obj lies under one of the prefixes
+func claimedBy(obj string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(obj, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkBlockData downloads and decodes every block of the restorable
+// snapshots and compares it against its checksum. Blocks stored once and
+// listed by several snapshots are read once.
+func checkBlockData(ctx context.Context, s3Client *storage.Client, keyring *encryption.Keyring, repo *repository, report *checkReport) error {
+	type location struct {
+		object string
+		offset int64
+	}
+	read := make(map[location]bool)
+	verified, unverifiable := 0, 0
+
+	for _, name := range repo.Names {
+		snap := repo.Snapshots[name]
+		m := snap.Manifest
+		if m == nil || !m.Restorable() || snap.Blocks == nil {
+			continue
+		}
+		if m.KeyID != "" && keyring == nil {
+			report.warnf("%s: encrypted; skipped without an encryption key", name)
+			continue
+		}
+
+		for _, e := range snap.Blocks.Blocks {
+			obj := metadata.BlockObjectPath(m, e)
+			loc := location{obj, e.ObjectOffset}
+			if read[loc] {
+				continue
+			}
+			read[loc] = true
+
+			if e.Checksum == "" {
+				unverifiable++
+				continue
+			}
+			if err := verifyBlock(ctx, s3Client, keyring, m, e); err != nil {
+				report.errorf("%s: %v", name, err)
+				continue
+			}
+			verified++
+			if verified%1000 == 0 {
+				fmt.Printf("  Progress: %d blocks verified\n", verified)
+			}
+		}
+	}
+
+	fmt.Printf("✓ Verified %d blocks\n", verified)
+	if unverifiable > 0 {
+		fmt.Printf("  %d blocks have no checksum and could not be verified\n", unverifiable)
+	}
+	return nil
+}
+
+// verifyBlock downloads and decodes one block and compares its checksum
+func verifyBlock(ctx context.Context, s3Client *storage.Client, keyring *encryption.Keyring, m *metadata.SnapshotManifest, e blocks.BlockMetadata) error {
+	objectPath := metadata.BlockObjectPath(m, e)
+
+	var data []byte
+	var err error
+	if e.StoredSize > 0 && e.Object != "" {
+		data, err = s3Client.DownloadRange(ctx, objectPath, e.ObjectOffset, e.StoredSize)
+	} else {
+		data, err = s3Client.DownloadObject(ctx, objectPath)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download block at offset %d: %w", e.Offset, err)
+	}
+
+	if m.KeyID != "" {
+		data, err = keyring.Decrypt(m.KeyID, data, metadata.BlockAssociatedData(m, e))
+		if err != nil {
+			return fmt.Errorf("failed to decrypt block at offset %d: %w", e.Offset, err)
+		}
+	}
+	data, err = compression.Decompress(e.Compression, data)
+	if err != nil {
+		return fmt.Errorf("failed to decompress block at offset %d: %w", e.Offset, err)
+	}
+
+	if int64(len(data)) != e.Size {
+		return fmt.Errorf("block at offset %d holds %d bytes, expected %d", e.Offset, len(data), e.Size)
+	}
+	if actual := fmt.Sprintf("%x", sha256.Sum256(data)); actual != e.Checksum {
+		return fmt.Errorf("block at offset %d has checksum %s, expected %s", e.Offset, actual, e.Checksum)
+	}
+	return nil
+}
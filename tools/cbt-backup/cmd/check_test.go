@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/storage"
+)
+
+// TestCheck damages a repository holding a full and an incremental backup in
+// one way at a time and checks that the step responsible for it reports the
+// damage, and that check fails on errors but not on warnings
+func TestCheck(t *testing.T) {
+	const (
+		baseBlock        = "blocks/snap-1/block-0-4096"
+		incrementalBlock = "blocks/snap-2/block-8192-4096"
+	)
+
+	tests := []struct {
+		name         string
+		damage       func(t *testing.T, h *harness)
+		step         func(ctx context.Context, client *storage.Client, repo *repository, report *checkReport) error
+		wantErrors   int
+		wantWarnings int
+	}{
+		{
+			name: "missing object",
+			damage: func(t *testing.T, h *harness) {
+				deleteObject(t, h, baseBlock)
+			},
+			step:       checkObjectsStep,
+			wantErrors: 1,
+		},
+		{
+			name: "wrong object size",
+			damage: func(t *testing.T, h *harness) {
+				putObject(t, h, incrementalBlock, make([]byte, 100))
+			},
+			step:       checkObjectsStep,
+			wantErrors: 1,
+		},
+		{
+			name: "orphan",
+			damage: func(t *testing.T, h *harness) {
+				putObject(t, h, "blocks/gone/block-0-4096", make([]byte, 4096))
+			},
+			step:         checkOrphans,
+			wantWarnings: 1,
+		},
+		{
+			name: "broken chain",
+			damage: func(t *testing.T, h *harness) {
+				deleteObject(t, h, "metadata/snap-1/manifest.json")
+			},
+			step: func(ctx context.Context, client *storage.Client, repo *repository, report *checkReport) error {
+				for _, name := range repo.Names {
+					checkChain(repo, repo.Snapshots[name], report)
+				}
+				return nil
+			},
+			wantErrors: 1,
+		},
+		{
+			name: "checksum mismatch",
+			damage: func(t *testing.T, h *harness) {
+				// Same size, so only reading the data finds it
+				putObject(t, h, baseBlock, []byte(strings.Repeat("x", 4096)))
+			},
+			step: func(ctx context.Context, client *storage.Client, repo *repository, report *checkReport) error {
+				return checkBlockData(ctx, client, nil, repo, report)
+			},
+			wantErrors: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			h := newHarness(t, 1<<20)
+			h.cbt.setAllocated("snap-1", h.write(t, 0, 4096))
+			h.backup(t, "--snapshot=snap-1")
+			h.cbt.setDelta("snap-1", "snap-2", h.write(t, 8192, 4096))
+			h.backup(t, "--snapshot=snap-2", "--base-snapshot=snap-1")
+
+			if err := h.run(t, "check", "--read-data"); err != nil {
+				t.Fatalf("check of an intact repository failed: %v", err)
+			}
+
+			tt.damage(t, h)
+
+			client := storage.NewClient(h.repo)
+			repo, err := loadRepository(ctx, client)
+			if err != nil {
+				t.Fatalf("loadRepository: %v", err)
+			}
+			report := &checkReport{}
+			if err := tt.step(ctx, client, repo, report); err != nil {
+				t.Fatalf("check step failed: %v", err)
+			}
+			if report.errors != tt.wantErrors || report.warnings != tt.wantWarnings {
+				t.Errorf("got %d error(s) and %d warning(s), want %d and %d",
+					report.errors, report.warnings, tt.wantErrors, tt.wantWarnings)
+			}
+
+			err = h.run(t, "check", "--read-data")
+			if tt.wantErrors > 0 && err == nil {
+				t.Error("check succeeded on a damaged repository")
+			}
+			if tt.wantErrors == 0 && err != nil {
+				t.Errorf("check failed on warnings only: %v", err)
+			}
+		})
+	}
+}
+
+// checkObjectsStep runs checkBlockObjects as a check step
+func checkObjectsStep(ctx context.Context, client *storage.Client, repo *repository, report *checkReport) error {
+	_, err := checkBlockObjects(ctx, client, repo, report)
+	return err
+}
+
+func putObject(t *testing.T, h *harness, key string, data []byte) {
+	t.Helper()
+	if err := h.repo.Put(context.Background(), key, data); err != nil {
+		t.Fatalf("failed to write %s: %v", key, err)
+	}
+}
+
+func deleteObject(t *testing.T, h *harness, key string) {
+	t.Helper()
+	if err := h.repo.Delete(context.Background(), key); err != nil {
+		t.Fatalf("failed to delete %s: %v", key, err)
+	}
+}
+
+// TestSwappedBlockFailsDecryption backs up the same data twice with
+// encryption and checks that a block of one snapshot stored in place of the
+// other's does not decrypt, although its plaintext is identical. Blocks
+// copied by consolidate still decrypt under the new backup.
+func TestSwappedBlockFailsDecryption(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "master.key")
+	if err := os.WriteFile(keyFile, bytes.Repeat([]byte{0x42}, 32), 0o600); err != nil {
+		t.Fatalf("failed to write key file: %v", err)
+	}
+	keyArg := "--encryption-key-file=" + keyFile
+
+	h := newHarness(t, 1<<20)
+	extent := h.write(t, 0, 4096)
+	h.cbt.setAllocated("snap-1", extent)
+	h.backup(t, "--snapshot=snap-1", keyArg)
+	h.cbt.setAllocated("snap-2", extent)
+	h.backup(t, "--snapshot=snap-2", keyArg)
+	h.cbt.setDelta("snap-2", "snap-3", h.write(t, 8192, 4096))
+	h.backup(t, "--snapshot=snap-3", "--base-snapshot=snap-2", keyArg)
+
+	if err := h.run(t, "consolidate", "--snapshot=snap-3", "--name=snap-3-full", keyArg); err != nil {
+		t.Fatalf("consolidate failed: %v", err)
+	}
+	if err := h.run(t, "check", "--read-data", keyArg); err != nil {
+		t.Fatalf("check of an intact repository failed: %v", err)
+	}
+
+	sealed, err := h.repo.Get(context.Background(), "blocks/snap-1/block-0-4096")
+	if err != nil {
+		t.Fatalf("failed to read block: %v", err)
+	}
+	putObject(t, h, "blocks/snap-2/block-0-4096", sealed)
+
+	ctx := context.Background()
+	client := storage.NewClient(h.repo)
+	keyring, err := loadKeyring(ctx, client, bytes.Repeat([]byte{0x42}, 32), false)
+	if err != nil {
+		t.Fatalf("loadKeyring: %v", err)
+	}
+	client.SetKeyring(keyring)
+	repo, err := loadRepository(ctx, client)
+	if err != nil {
+		t.Fatalf("loadRepository: %v", err)
+	}
+	snap := repo.Snapshots["snap-2"]
+	err = verifyBlock(ctx, client, keyring, snap.Manifest, snap.Blocks.Blocks[0])
+	if err == nil || !strings.Contains(err.Error(), "failed to decrypt") {
+		t.Errorf("verifyBlock of a block swapped in from another snapshot = %v, want a decryption failure", err)
+	}
+}
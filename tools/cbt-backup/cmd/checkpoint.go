@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/blocks"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/encryption"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/metadata"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/storage"
+)
+
+// defaultCheckpointInterval is how often the upload records its progress
+const defaultCheckpointInterval = 30 * time.Second
+
+// checkpointPath returns the object key of a snapshot's checkpoint. It only
+// exists while the backup of the snapshot is unfinished.
+func checkpointPath(snapshotName string) string {
+	return fmt.Sprintf("metadata/%s/checkpoint.json", snapshotName)
+}
+
+// checkpointer periodically records which extents have been stored, so an
+// interrupted backup can be resumed with --resume. Only one checkpoint is
+// saved at a time.
+type checkpointer struct {
+	client   *storage.Client
+	store    *blockStore
+	cbt      *metadata.CBTClient // listing extents; nil once listing is complete
+	state    metadata.BackupCheckpoint
+	interval time.Duration
+	saved    time.Time
+}
+
+// checkpointProgress is the progress of the upload a checkpoint records,
+// copied under the upload progress lock so it can be stored without it
+type checkpointProgress struct {
+	segment           json.RawMessage        // entries added to the block list since the last segment
+	entries           int                    // number of entries in segment
+	segments          int                    // segments written before segment
+	extents           []blocks.BlockMetadata // listed after the block list
+	uploaded          []blocks.BlockMetadata // entries of extents that are stored
+	listedThrough     int64
+	listingIncomplete bool
+}
+
+// newCheckpointer prepares checkpoints for the backup described by manifest.
+// What cbtClient has reported about the volume so far is recorded in the
+// checkpoint's manifest.
+func newCheckpointer(client *storage.Client, store *blockStore, manifest metadata.SnapshotManifest, cbtClient *metadata.CBTClient, cbtEnabled bool, interval time.Duration) *checkpointer {
+	return &checkpointer{
+		client: client,
+		store:  store,
+		cbt:    cbtClient,
+		state: metadata.BackupCheckpoint{
+			Manifest:   manifest,
+			CBTEnabled: cbtEnabled,
+		},
+		interval: interval,
+	}
+}
+
+// due reports whether the interval has passed since the last checkpoint
+func (c *checkpointer) due() bool {
+	return c.interval > 0 && time.Since(c.saved) >= c.interval
+}
+
+// save records progress. The partial pack is flushed and the entries added
+// to the block list since the last checkpoint are written as a new segment
+// before the checkpoint, so everything the checkpoint lists is readable
+// once it is written. Once save succeeds, the entries of the segment can be
+// dropped from the block list.
+func (c *checkpointer) save(ctx context.Context, progress checkpointProgress) error {
+	nextPack, err := c.store.sync(ctx)
+	if err != nil {
+		return err
+	}
+
+	segments := progress.segments
+	if progress.entries > 0 {
+		segmentPath := blockListSegmentPath(c.state.Manifest.Name, c.state.SegmentRun, segments)
+		if err := c.client.UploadJSON(ctx, segmentPath, progress.segment); err != nil {
+			return fmt.Errorf("failed to upload block list segment: %w", err)
+		}
+		segments++
+	}
+
+	recordListing(&c.state.Manifest, c.cbt)
+	c.state.Segments = segments
+	c.state.Extents = progress.extents
+	c.state.Uploaded = progress.uploaded
+	c.state.ListedThrough = progress.listedThrough
+	c.state.ListingIncomplete = progress.listingIncomplete
+	c.state.NextPack = nextPack
+	c.state.Updated = time.Now()
+	if err := c.client.UploadJSON(ctx, checkpointPath(c.state.Manifest.Name), c.state); err != nil {
+		return fmt.Errorf("failed to upload checkpoint: %w", err)
+	}
+	c.saved = time.Now()
+	return nil
+}
+
+// blockListPath returns the object key of a snapshot's block list. It is
+// written when the backup commits.
+func blockListPath(snapshotName string) string {
+	return fmt.Sprintf("metadata/%s/blocks.json", snapshotName)
+}
+
+// blockListSegmentPrefix holds the block list segments of an unfinished
+// backup of a snapshot
+func blockListSegmentPrefix(snapshotName string) string {
+	return fmt.Sprintf("metadata/%s/segments/", snapshotName)
+}
+
+// blockListSegmentPath returns the object key of a block list segment
+// written by the given run of a backup. Each resumed run writes its own
+// segments, so a run that fails before its first checkpoint leaves the
+// segments its checkpoint refers to intact.
+func blockListSegmentPath(snapshotName string, run, segment int) string {
+	return fmt.Sprintf("%s%d-%06d.json", blockListSegmentPrefix(snapshotName), run, segment)
+}
+
+// joinBlockList returns the complete block list of a backup from the
+// segments the given run wrote and the entries of list not in a segment
+func joinBlockList(ctx context.Context, s3Client *storage.Client, snapshotName string, run int, list *metadata.BlockListWriter) (json.RawMessage, error) {
+	return list.Join(func(segment int) (json.RawMessage, error) {
+		var data json.RawMessage
+		if err := s3Client.DownloadJSON(ctx, blockListSegmentPath(snapshotName, run, segment), &data); err != nil {
+			return nil, fmt.Errorf("failed to download block list segment: %w", err)
+		}
+		return data, nil
+	})
+}
+
+// deleteBlockListSegments removes the segments of every run of a backup once
+// it has committed its block list
+func deleteBlockListSegments(ctx context.Context, s3Client *storage.Client, snapshotName string) error {
+	objects, err := s3Client.ListObjects(ctx, blockListSegmentPrefix(snapshotName))
+	if err != nil {
+		return fmt.Errorf("failed to list block list segments: %w", err)
+	}
+	for _, obj := range objects {
+		if err := s3Client.DeleteObject(ctx, obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadCheckpoint reads the checkpoint of an unfinished backup and checks that
+// it can be resumed with the current key
+func loadCheckpoint(ctx context.Context, s3Client *storage.Client, keyring *encryption.Keyring, snapshotName string) (*metadata.BackupCheckpoint, error) {
+	manifestPath := fmt.Sprintf("metadata/%s/manifest.json", snapshotName)
+	exists, err := s3Client.ObjectExists(ctx, manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check manifest of %s: %w", snapshotName, err)
+	}
+	if exists {
+		var manifest metadata.SnapshotManifest
+		if err := s3Client.DownloadJSON(ctx, manifestPath, &manifest); err != nil {
+			return nil, fmt.Errorf("failed to download manifest of %s: %w", snapshotName, err)
+		}
+		if manifest.Committed() {
+			return nil, fmt.Errorf("backup %s has already completed", snapshotName)
+		}
+	}
+
+	exists, err = s3Client.ObjectExists(ctx, checkpointPath(snapshotName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to check checkpoint of %s: %w", snapshotName, err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("no checkpoint found for %s", snapshotName)
+	}
+
+	var ckpt metadata.BackupCheckpoint
+	if err := s3Client.DownloadJSON(ctx, checkpointPath(snapshotName), &ckpt); err != nil {
+		return nil, fmt.Errorf("failed to download checkpoint for %s: %w", snapshotName, err)
+	}
+
+	// Every block of a snapshot must be encrypted with the same key
+	switch {
+	case ckpt.Manifest.KeyID == "" && keyring != nil:
+		return nil, fmt.Errorf("backup %s was started without encryption", snapshotName)
+	case ckpt.Manifest.KeyID != "" && keyring == nil:
+		return nil, fmt.Errorf("backup %s is encrypted; an encryption key is required to resume it", snapshotName)
+	case keyring != nil && ckpt.Manifest.KeyID != keyring.ActiveKeyID():
+		return nil, fmt.Errorf("backup %s was started with key %s but the active key is %s", snapshotName, ckpt.Manifest.KeyID, keyring.ActiveKeyID())
+	}
+
+	return &ckpt, nil
+}
+
+// checkpointExtents returns the extents an interrupted backup listed, in
+// order, and the ones it stored: the entries of the block list segments the
+// checkpoint refers to followed by the checkpoint's own. Checkpoints of
+// older releases refer to a partial blocks.json instead, which may have
+// been written without the checkpoint that should have followed it, so
+// checkpoint extents it already covers are dropped.
+func checkpointExtents(ctx context.Context, s3Client *storage.Client, ckpt *metadata.BackupCheckpoint) ([]blocks.BlockMetadata, []blocks.BlockMetadata, error) {
+	var partial metadata.BlockList
+	for i := 0; i < ckpt.Segments; i++ {
+		var segment metadata.BlockList
+		if err := s3Client.DownloadJSON(ctx, blockListSegmentPath(ckpt.Manifest.Name, ckpt.SegmentRun, i), &segment); err != nil {
+			return nil, nil, fmt.Errorf("failed to download block list segment of %s: %w", ckpt.Manifest.Name, err)
+		}
+		partial.Blocks = append(partial.Blocks, segment.Blocks...)
+	}
+	if ckpt.Segments == 0 {
+		exists, err := s3Client.ObjectExists(ctx, blockListPath(ckpt.Manifest.Name))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to check block list of %s: %w", ckpt.Manifest.Name, err)
+		}
+		if exists {
+			if err := s3Client.DownloadJSON(ctx, blockListPath(ckpt.Manifest.Name), &partial); err != nil {
+				return nil, nil, fmt.Errorf("failed to download partial block list of %s: %w", ckpt.Manifest.Name, err)
+			}
+		}
+	}
+
+	var covered int64
+	if n := len(partial.Blocks); n > 0 {
+		covered = partial.Blocks[n-1].Offset + partial.Blocks[n-1].Size
+	}
+
+	extents := make([]blocks.BlockMetadata, 0, len(partial.Blocks)+len(ckpt.Extents))
+	for _, e := range partial.Blocks {
+		extents = append(extents, blocks.BlockMetadata{Offset: e.Offset, Size: e.Size})
+	}
+	for _, e := range ckpt.Extents {
+		if e.Offset >= covered {
+			extents = append(extents, e)
+		}
+	}
+
+	uploaded := append(partial.Blocks, ckpt.Uploaded...)
+	return extents, uploaded, nil
+}
+
+// resumeUploads fills in the storage fields of the entries found in stored,
+// as returned by checkpointExtents, and credits them to the store. Entries whose object is no
+// longer in the bucket are uploaded again. It returns which entries are done.
+func resumeUploads(ctx context.Context, s3Client *storage.Client, store *blockStore, ckpt *metadata.BackupCheckpoint, entries, stored []blocks.BlockMetadata) ([]bool, error) {
+	manifest := &ckpt.Manifest
+
+	prefix := fmt.Sprintf("blocks/%s/", manifest.Name)
+	objects, err := s3Client.ListObjects(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", prefix, err)
+	}
+	present := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		present[obj] = true
+	}
+
+	uploaded := make(map[int64]blocks.BlockMetadata, len(stored))
+	for _, e := range stored {
+		uploaded[e.Offset] = e
+	}
+
+	done := make([]bool, len(entries))
+	missing := 0
+	for i, e := range entries {
+		u, ok := uploaded[e.Offset]
+		if !ok || u.Size != e.Size {
+			continue
+		}
+		obj := metadata.BlockObjectPath(manifest, u)
+		if strings.HasPrefix(obj, metadata.ContentAddressedPrefix) {
+			ok = store.stored[path.Base(obj)]
+		} else {
+			ok = present[obj]
+		}
+		if !ok {
+			missing++
+			continue
+		}
+		entries[i] = u
+		done[i] = true
+		store.resume(u)
+	}
+
+	if missing > 0 {
+		fmt.Printf("  Warning: %d checkpointed blocks are missing from the bucket and will be uploaded again\n", missing)
+	}
+	return done, nil
+}
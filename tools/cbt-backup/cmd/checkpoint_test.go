@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/metadata"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/storage"
+	api "github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
+)
+
+// failingBackend fails every write of one object
+type failingBackend struct {
+	*memoryBackend
+	fail string
+}
+
+func (f *failingBackend) Put(ctx context.Context, key string, data []byte) error {
+	if key == f.fail {
+		return errors.New("injected failure")
+	}
+	return f.memoryBackend.Put(ctx, key, data)
+}
+
+// TestResumeJoinsBlockListSegments fails a backup after some of its entries
+// were written out as block list segments and checks that the resumed run
+// commits the complete block list and removes the segments
+func TestResumeJoinsBlockListSegments(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t, 1<<20)
+	client := storage.NewClient(h.repo)
+
+	var extents []*api.BlockMetadata
+	for i := int64(0); i < 6; i++ {
+		extents = append(extents, h.write(t, i*64<<10, 4096))
+	}
+	h.cbt.setAllocated("snap-1", extents...)
+
+	// One worker stores the extents in order; checkpointing after every
+	// block writes each final entry out before the fourth block fails
+	failing := &failingBackend{memoryBackend: h.repo, fail: "blocks/snap-1/block-196608-4096"}
+	newBackend = func() (storage.Backend, error) { return failing, nil }
+	err := h.run(t, "create",
+		"--namespace="+testNamespace,
+		"--pvc="+testPVC,
+		"--device="+h.device,
+		"--snapshot=snap-1",
+		"--concurrency=1",
+		"--checkpoint-interval=1ns",
+	)
+	if err == nil {
+		t.Fatal("backup succeeded although a block upload failed")
+	}
+
+	var ckpt metadata.BackupCheckpoint
+	if err := client.DownloadJSON(ctx, checkpointPath("snap-1"), &ckpt); err != nil {
+		t.Fatalf("failed to read checkpoint: %v", err)
+	}
+	if ckpt.Segments == 0 || ckpt.SegmentRun != 0 {
+		t.Fatalf("checkpoint refers to %d segments of run %d, want some of run 0", ckpt.Segments, ckpt.SegmentRun)
+	}
+	if exists, _ := client.ObjectExists(ctx, blockListPath("snap-1")); exists {
+		t.Error("unfinished backup wrote blocks.json")
+	}
+
+	newBackend = func() (storage.Backend, error) { return h.repo, nil }
+	h.backup(t, "--resume=snap-1", "--checkpoint-interval=1ns")
+
+	var blockList metadata.BlockList
+	if err := client.DownloadJSON(ctx, blockListPath("snap-1"), &blockList); err != nil {
+		t.Fatalf("failed to read block list: %v", err)
+	}
+	if len(blockList.Blocks) != len(extents) {
+		t.Fatalf("block list has %d entries, want %d", len(blockList.Blocks), len(extents))
+	}
+	for i, e := range blockList.Blocks {
+		if e.Offset != extents[i].ByteOffset || e.Checksum == "" {
+			t.Errorf("entry %d = %+v, want a stored block at offset %d", i, e, extents[i].ByteOffset)
+		}
+	}
+
+	segments, err := client.ListObjects(ctx, blockListSegmentPrefix("snap-1"))
+	if err != nil {
+		t.Fatalf("failed to list block list segments: %v", err)
+	}
+	if len(segments) != 0 {
+		t.Errorf("committed backup left block list segments %v", segments)
+	}
+	if err := h.run(t, "check", "--read-data"); err != nil {
+		t.Errorf("check after resume failed: %v", err)
+	}
+}
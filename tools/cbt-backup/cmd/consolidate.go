@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/blocks"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/compression"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/encryption"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/metadata"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+var consolidatedName string
+
+func newConsolidateCmd() *cobra.Command {
+	consolidateCmd := &cobra.Command{
+		Use:   "consolidate",
+		Short: "Build a synthetic full backup from an incremental chain",
+		Long: `Merges the block lists of a snapshot's chain into a new full backup
+inside the repository, without access to the cluster or the device.
+
+Block objects still needed are referenced (content-addressed blocks) or
+copied server-side (per-snapshot blocks and packs), so the new backup does
+not depend on the old chain. Blocks that later snapshots only partially
+overwrote are re-encoded. Incrementals taken after the target are re-based
+on the new backup, after which the old chain can be pruned.`,
+		RunE: runConsolidate,
+	}
+
+	consolidateCmd.Flags().StringVarP(&snapshotName, "snapshot", "s", "", "Snapshot whose chain to consolidate (required)")
+	consolidateCmd.Flags().StringVar(&consolidatedName, "name", "", "Name of the new full backup (default: <snapshot>-full)")
+	addStorageFlags(consolidateCmd)
+	addLockFlags(consolidateCmd)
+	consolidateCmd.MarkFlagRequired("snapshot")
+
+	return consolidateCmd
+}
+
+func runConsolidate(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+
+	if consolidatedName == "" {
+		consolidatedName = snapshotName + "-full"
+	}
+
+	fmt.Println("========================================")
+	fmt.Println("Consolidating Snapshot Chain")
+	fmt.Println("========================================")
+	fmt.Printf("Target Snapshot: %s\n", snapshotName)
+	fmt.Printf("New Backup:      %s\n", consolidatedName)
+	fmt.Println("========================================")
+
+	s3Client, keyring, err := newStorageClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open repository: %w", err)
+	}
+
+	repoLock, lockCtx, err := lockRepository(ctx, s3Client, true, "consolidate")
+	if err != nil {
+		return err
+	}
+	defer unlockRepository(repoLock)
+	ctx = lockCtx
+
+	fmt.Println("\n[1/5] Resolving snapshot chain...")
+	catalog, err := loadCatalog(ctx, s3Client)
+	if err != nil {
+		return err
+	}
+	chain, err := catalog.ResolveChain(snapshotName)
+	if err != nil {
+		return fmt.Errorf("failed to resolve chain of %s: %w", snapshotName, err)
+	}
+	if len(chain) == 1 {
+		return fmt.Errorf("snapshot %s is already a full backup", snapshotName)
+	}
+	if _, exists := catalog.Find(consolidatedName); exists {
+		return fmt.Errorf("snapshot %s already exists", consolidatedName)
+	}
+	fmt.Printf("✓ Chain: %s\n", strings.Join(chain, " -> "))
+
+	manifests := make([]*metadata.SnapshotManifest, len(chain))
+	layers := make([][]blocks.BlockMetadata, len(chain))
+	for i, snap := range chain {
+		var manifest metadata.SnapshotManifest
+		if err := s3Client.DownloadJSON(ctx, fmt.Sprintf("metadata/%s/manifest.json", snap), &manifest); err != nil {
+			return fmt.Errorf("failed to download manifest for %s: %w", snap, err)
+		}
+		if !manifest.Restorable() {
+			return fmt.Errorf("backup %s cannot be consolidated (state %s)", snap, manifest.State)
+		}
+		var blockList metadata.BlockList
+		if err := s3Client.DownloadJSON(ctx, fmt.Sprintf("metadata/%s/blocks.json", snap), &blockList); err != nil {
+			return fmt.Errorf("failed to download block list for %s: %w", snap, err)
+		}
+		if i > 0 && manifest.KeyID != manifests[0].KeyID {
+			return fmt.Errorf("snapshot %s uses encryption key %q, but %s uses %q", snap, manifest.KeyID, chain[0], manifests[0].KeyID)
+		}
+		manifests[i] = &manifest
+		layers[i] = blockList.Blocks
+	}
+
+	target := manifests[len(manifests)-1]
+	if target.KeyID != "" && keyring == nil {
+		return fmt.Errorf("snapshot %s is encrypted: %w", target.Name, encryption.ErrEncrypted)
+	}
+
+	fmt.Println("\n[2/5] Merging block lists...")
+	pieces := blocks.MergeBlockLists(layers)
+	fmt.Printf("✓ %d extents remain current\n", len(pieces))
+
+	manifest := *target
+	manifest.Name = consolidatedName
+	manifest.IsIncremental = false
+	manifest.BaseSnapshotName = ""
+	manifest.BlockLayout = metadata.LayoutPerSnapshot
+	manifest.ConsolidatedFrom = chain
+	manifest.State = metadata.StateCompleted
+	manifest.TotalBlocks = len(pieces)
+	manifest.TotalSize = 0
+	manifest.CompressedSize = 0
+
+	fmt.Println("\n[3/5] Copying block data...")
+	store, err := newBlockStore(ctx, s3Client, &manifest, keyring)
+	if err != nil {
+		return err
+	}
+
+	var referenced, copied, reencoded int
+	copies := make(map[string]string)
+	blockList := metadata.BlockList{Blocks: make([]blocks.BlockMetadata, 0, len(pieces))}
+
+	for _, piece := range pieces {
+		src := manifests[piece.Layer]
+		var entry blocks.BlockMetadata
+
+		switch {
+		case !piece.Whole():
+			// Part of the extent was overwritten later; store the rest anew
+			entry, err = reencodePiece(ctx, s3Client, keyring, store, src, piece)
+			if err != nil {
+				return err
+			}
+			reencoded++
+		case strings.HasPrefix(metadata.BlockObjectPath(src, piece.Block), metadata.ContentAddressedPrefix):
+			// Shared content-addressed objects are referenced in place
+			entry = piece.Block
+			entry.Object = metadata.BlockObjectPath(src, piece.Block)
+			referenced++
+		default:
+			// Objects under blocks/<snapshot>/ go away when that snapshot is
+			// pruned, so copy them under the new backup once each
+			srcObject := metadata.BlockObjectPath(src, piece.Block)
+			dstObject, ok := copies[srcObject]
+			if !ok {
+				dstObject = fmt.Sprintf("blocks/%s/%s-%s", consolidatedName, src.Name, path.Base(srcObject))
+				if err := s3Client.CopyObject(ctx, srcObject, dstObject); err != nil {
+					return err
+				}
+				copies[srcObject] = dstObject
+				copied++
+			}
+			entry = piece.Block
+			entry.Object = dstObject
+			if src.KeyID != "" && entry.SealedBy == "" {
+				// The copy keeps the ciphertext sealed for the source
+				entry.SealedBy = src.Name
+			}
+		}
+
+		blockList.Blocks = append(blockList.Blocks, entry)
+		manifest.TotalSize += entry.Size
+		manifest.CompressedSize += entry.StoredSize
+	}
+
+	if err := store.flush(ctx); err != nil {
+		return err
+	}
+	if manifest.Compression == compression.None {
+		manifest.CompressedSize = 0
+	}
+	fmt.Printf("✓ Referenced %d blocks, copied %d objects, re-encoded %d partial blocks\n", referenced, copied, reencoded)
+
+	fmt.Println("\n[4/5] Uploading backup metadata to the repository...")
+	if err := s3Client.UploadJSON(ctx, fmt.Sprintf("metadata/%s/blocks.json", consolidatedName), blockList); err != nil {
+		return fmt.Errorf("failed to upload block list: %w", err)
+	}
+	newChain := metadata.SnapshotChain{
+		SnapshotName: consolidatedName,
+		Dependencies: []string{},
+	}
+	if err := s3Client.UploadJSON(ctx, fmt.Sprintf("metadata/%s/chain.json", consolidatedName), newChain); err != nil {
+		return fmt.Errorf("failed to upload chain: %w", err)
+	}
+	if err := s3Client.UploadJSON(ctx, fmt.Sprintf("metadata/%s/manifest.json", consolidatedName), manifest); err != nil {
+		return fmt.Errorf("failed to upload manifest: %w", err)
+	}
+	fmt.Printf("✓ Uploaded metadata for %s\n", consolidatedName)
+
+	fmt.Println("\n[5/5] Re-basing later incrementals...")
+	rebased, err := rebaseDescendants(ctx, s3Client, catalog, snapshotName, consolidatedName)
+	if err != nil {
+		return err
+	}
+
+	err = updateCatalog(ctx, s3Client, func(c *metadata.Catalog) {
+		c.Upsert(&manifest)
+		for _, m := range rebased {
+			c.Upsert(m)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update catalog: %w", err)
+	}
+
+	fmt.Println("\n========================================")
+	fmt.Println("Consolidation Summary")
+	fmt.Println("========================================")
+	fmt.Printf("New Full Backup:   %s\n", consolidatedName)
+	fmt.Printf("Snapshots Merged:  %d\n", len(chain))
+	fmt.Printf("Total Blocks:      %d\n", manifest.TotalBlocks)
+	fmt.Printf("Total Size:        %d bytes (%.2f MB)\n", manifest.TotalSize, float64(manifest.TotalSize)/(1024*1024))
+	fmt.Println("========================================")
+	fmt.Printf("The old chain is no longer needed by %s and can be pruned.\n", consolidatedName)
+	return nil
+}
+
+// reencodePiece reads the source block of a partially overwritten extent,
+// cuts out the part that is still current and stores it for the new backup
+func reencodePiece(ctx context.Context, s3Client *storage.Client, keyring *encryption.Keyring, store *blockStore, src *metadata.SnapshotManifest, piece blocks.Piece) (blocks.BlockMetadata, error) {
+	objectPath := metadata.BlockObjectPath(src, piece.Block)
+
+	var data []byte
+	var err error
+	if piece.Block.StoredSize > 0 && piece.Block.Object != "" {
+		data, err = s3Client.DownloadRange(ctx, objectPath, piece.Block.ObjectOffset, piece.Block.StoredSize)
+	} else {
+		data, err = s3Client.DownloadObject(ctx, objectPath)
+	}
+	if err != nil {
+		return blocks.BlockMetadata{}, fmt.Errorf("failed to download block at offset %d from %s: %w", piece.Block.Offset, src.Name, err)
+	}
+
+	if src.KeyID != "" {
+		data, err = keyring.Decrypt(src.KeyID, data, metadata.BlockAssociatedData(src, piece.Block))
+		if err != nil {
+			return blocks.BlockMetadata{}, fmt.Errorf("failed to decrypt block at offset %d from %s: %w", piece.Block.Offset, src.Name, err)
+		}
+	}
+	data, err = compression.Decompress(piece.Block.Compression, data)
+	if err != nil {
+		return blocks.BlockMetadata{}, fmt.Errorf("failed to decompress block at offset %d from %s: %w", piece.Block.Offset, src.Name, err)
+	}
+
+	start := piece.Offset - piece.Block.Offset
+	if start < 0 || start+piece.Size > int64(len(data)) {
+		return blocks.BlockMetadata{}, fmt.Errorf("block at offset %d from %s holds %d bytes, expected %d", piece.Block.Offset, src.Name, len(data), piece.Block.Size)
+	}
+	data = data[start : start+piece.Size]
+
+	entry := blocks.BlockMetadata{Offset: piece.Offset, Size: piece.Size}
+	block := &blocks.BlockData{
+		Offset:   piece.Offset,
+		Size:     piece.Size,
+		Checksum: fmt.Sprintf("%x", sha256.Sum256(data)),
+		Data:     data,
+	}
+	if err := store.put(ctx, &entry, block); err != nil {
+		return blocks.BlockMetadata{}, err
+	}
+	return entry, nil
+}
+
+// rebaseDescendants points the incrementals taken on top of target at the
+// consolidated backup instead. Every descendant's chain is rewritten to
+// depend on the consolidated backup rather than the old chain; direct
+// children also get the new base in their manifest, and those manifests are
+// returned for the catalog.
+func rebaseDescendants(ctx context.Context, s3Client *storage.Client, catalog *metadata.Catalog, target, consolidated string) ([]*metadata.SnapshotManifest, error) {
+	var rebased []*metadata.SnapshotManifest
+
+	// Snapshots are ordered by time, so an incremental always comes after
+	// its base and the base's new dependencies are known by then
+	deps := map[string][]string{target: {consolidated}}
+	for _, entry := range catalog.Snapshots {
+		baseDeps, ok := deps[entry.BaseSnapshot]
+		if !entry.IsIncremental || !ok {
+			continue
+		}
+
+		chain := metadata.SnapshotChain{
+			SnapshotName:     entry.Name,
+			BaseSnapshotName: entry.BaseSnapshot,
+			IsIncremental:    true,
+			Dependencies:     append(append([]string{}, baseDeps...), entry.BaseSnapshot),
+		}
+
+		if entry.BaseSnapshot == target {
+			manifestPath := fmt.Sprintf("metadata/%s/manifest.json", entry.Name)
+			var manifest metadata.SnapshotManifest
+			if err := s3Client.DownloadJSON(ctx, manifestPath, &manifest); err != nil {
+				return nil, fmt.Errorf("failed to download manifest for %s: %w", entry.Name, err)
+			}
+			manifest.BaseSnapshotName = consolidated
+			if err := s3Client.UploadJSON(ctx, manifestPath, manifest); err != nil {
+				return nil, fmt.Errorf("failed to update manifest for %s: %w", entry.Name, err)
+			}
+			rebased = append(rebased, &manifest)
+
+			chain.BaseSnapshotName = consolidated
+			chain.Dependencies = []string{consolidated}
+		}
+		deps[entry.Name] = chain.Dependencies
+
+		chainPath := fmt.Sprintf("metadata/%s/chain.json", entry.Name)
+		if err := s3Client.UploadJSON(ctx, chainPath, chain); err != nil {
+			return nil, fmt.Errorf("failed to update chain for %s: %w", entry.Name, err)
+		}
+		fmt.Printf("✓ Re-based %s (depends on %s)\n", entry.Name, strings.Join(chain.Dependencies, ", "))
+	}
+
+	if len(deps) == 1 {
+		fmt.Println("No incrementals to re-base")
+	}
+	return rebased, nil
+}
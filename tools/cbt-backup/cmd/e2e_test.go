@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/blocks"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/metadata"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/storage"
+	api "github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// TestBackupIncrementalRestore takes a full and an incremental backup of a
+// volume through the fakes in harness_test.go, restores both with the
+// cbt-restore binary and compares the result with the volume byte for byte.
+func TestBackupIncrementalRestore(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds cbt-restore")
+	}
+	restoreBin := buildRestore(t)
+
+	keyFile := filepath.Join(t.TempDir(), "master.key")
+	if err := os.WriteFile(keyFile, bytes.Repeat([]byte{0x42}, 32), 0o600); err != nil {
+		t.Fatalf("failed to write key file: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		backupArgs []string
+		repoArgs   []string // needed to read the repository
+	}{
+		{name: "per-snapshot"},
+		{name: "dedup", backupArgs: []string{"--dedup"}},
+		{name: "pack", backupArgs: []string{"--pack", "--pack-size=262144"}},
+		{name: "chunked", backupArgs: []string{"--block-size=65536", "--coalesce-extents"}},
+		{
+			name:       "compressed-encrypted",
+			backupArgs: []string{"--compression=zstd", "--encryption-key-file=" + keyFile},
+			repoArgs:   []string{"--encryption-key-file=" + keyFile},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHarness(t, 4<<20)
+
+			// Full backup of three allocated extents, one of them not
+			// block-aligned
+			h.cbt.setAllocated("snap-1",
+				h.write(t, 0, 96<<10),
+				h.write(t, 1<<20, 300<<10),
+				h.write(t, 3<<20+512, 8192),
+			)
+			h.backup(t, append([]string{"--snapshot=snap-1"}, tt.backupArgs...)...)
+			full := h.contents(t)
+
+			// Incremental backup overwriting parts of two extents and
+			// allocating a new one
+			h.cbt.setDelta("snap-1", "snap-2",
+				h.write(t, 64<<10, 64<<10),
+				h.write(t, 2<<20, 4096),
+				h.write(t, 1<<20+100<<10, 16<<10),
+			)
+			h.backup(t, append([]string{"--snapshot=snap-2", "--base-snapshot=snap-1"}, tt.backupArgs...)...)
+			incremental := h.contents(t)
+
+			if !h.cbt.called("delta " + snapshotHandle("snap-1") + "..snap-2") {
+				t.Fatalf("incremental backup did not ask for the delta; calls: %v", h.cbt.calls)
+			}
+			if err := h.run(t, append([]string{"check", "--read-data"}, tt.repoArgs...)...); err != nil {
+				t.Fatalf("check failed: %v", err)
+			}
+
+			repo := h.export(t)
+			for snap, want := range map[string][]byte{"snap-1": full, "snap-2": incremental} {
+				got := runRestore(t, restoreBin, repo, snap, int64(len(want)), tt.repoArgs...)
+				if i := firstDifference(got, want); i >= 0 {
+					t.Errorf("restore of %s differs from the volume at byte %d", snap, i)
+				}
+			}
+		})
+	}
+}
+
+// buildRestore builds the cbt-restore binary from the sibling module
+func buildRestore(t *testing.T) string {
+	t.Helper()
+
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go toolchain not found")
+	}
+
+	bin := filepath.Join(t.TempDir(), "cbt-restore")
+	build := exec.Command(goBin, "build", "-o", bin, "./cmd")
+	build.Dir = filepath.Join("..", "..", "cbt-restore")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("failed to build cbt-restore: %v\n%s", err, out)
+	}
+	return bin
+}
+
+// runRestore restores snap from the local repository to a new zeroed volume
+// of size bytes and returns the volume's contents
+func runRestore(t *testing.T, bin, repo, snap string, size int64, extraArgs ...string) []byte {
+	t.Helper()
+
+	device := filepath.Join(t.TempDir(), "restored-"+snap)
+	if err := os.WriteFile(device, nil, 0o644); err != nil {
+		t.Fatalf("failed to create volume: %v", err)
+	}
+	if err := os.Truncate(device, size); err != nil {
+		t.Fatalf("failed to size volume: %v", err)
+	}
+
+	args := append([]string{"restore",
+		"--snapshot=" + snap,
+		"--device=" + device,
+		"--local-path=" + repo,
+	}, extraArgs...)
+	restore := exec.Command(bin, args...)
+	if out, err := restore.CombinedOutput(); err != nil {
+		t.Fatalf("restore of %s failed: %v\n%s", snap, err, out)
+	}
+
+	data, err := os.ReadFile(device)
+	if err != nil {
+		t.Fatalf("failed to read restored volume: %v", err)
+	}
+	return data
+}
+
+// firstDifference returns the offset of the first byte where a and b
+// differ, or -1 if they are equal
+func firstDifference(a, b []byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	if len(a) != len(b) {
+		return min(len(a), len(b))
+	}
+	return -1
+}
+
+// TestBackupResumesBrokenCBTStream breaks the allocated-blocks stream
+// midway and checks that the backup resumes it from the last extent
+// received, within the --cbt-retries budget
+func TestBackupResumesBrokenCBTStream(t *testing.T) {
+	tests := []struct {
+		name    string
+		retries string
+		wantErr bool
+	}{
+		{name: "within budget", retries: "--cbt-retries=2"},
+		{name: "budget exhausted", retries: "--cbt-retries=1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHarness(t, 1<<20)
+
+			var extents []*api.BlockMetadata
+			for i := int64(0); i < 5; i++ {
+				extents = append(extents, h.write(t, i*128<<10, 4096))
+			}
+			h.cbt.setAllocated("snap-1", extents...)
+			h.cbt.breakStreams = 2
+			h.cbt.breakAfter = 2
+
+			err := h.run(t, "create",
+				"--namespace="+testNamespace,
+				"--pvc="+testPVC,
+				"--device="+h.device,
+				"--snapshot=snap-1",
+				"--cbt-max-results=1",
+				"--cbt-retry-backoff=1ms",
+				tt.retries,
+			)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("backup succeeded although the stream broke more often than allowed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("backup failed: %v", err)
+			}
+
+			wantCalls := []string{
+				"allocated snap-1 from 0 max 1",
+				fmt.Sprintf("allocated snap-1 from %d max 1", 128<<10+4096),
+				fmt.Sprintf("allocated snap-1 from %d max 1", 3*128<<10+4096),
+			}
+			if !reflect.DeepEqual(h.cbt.calls, wantCalls) {
+				t.Errorf("CBT calls = %q, want %q", h.cbt.calls, wantCalls)
+			}
+
+			var blockList metadata.BlockList
+			if err := storage.NewClient(h.repo).DownloadJSON(context.Background(), "metadata/snap-1/blocks.json", &blockList); err != nil {
+				t.Fatalf("failed to read block list: %v", err)
+			}
+			if len(blockList.Blocks) != len(extents) {
+				t.Fatalf("block list has %d extents, want %d", len(blockList.Blocks), len(extents))
+			}
+			for i, block := range blockList.Blocks {
+				if block.Offset != extents[i].ByteOffset || block.Size != extents[i].SizeBytes {
+					t.Errorf("extent %d = %d+%d, want %d+%d", i, block.Offset, block.Size, extents[i].ByteOffset, extents[i].SizeBytes)
+				}
+			}
+		})
+	}
+}
+
+// TestBackupResumesInterruptedListing fails a backup while CBT is still
+// listing extents and checks that --resume keeps the entries already written
+// to its block list and continues the listing where it stopped
+func TestBackupResumesInterruptedListing(t *testing.T) {
+	h := newHarness(t, 1<<20)
+
+	var extents []*api.BlockMetadata
+	for i := int64(0); i < 5; i++ {
+		extents = append(extents, h.write(t, i*128<<10, 4096))
+	}
+	h.cbt.setAllocated("snap-1", extents...)
+	h.cbt.breakStreams = 1
+	h.cbt.breakAfter = 2
+
+	err := h.run(t, "create",
+		"--namespace="+testNamespace,
+		"--pvc="+testPVC,
+		"--device="+h.device,
+		"--snapshot=snap-1",
+		"--cbt-max-results=1",
+		"--cbt-retries=0",
+	)
+	if err == nil {
+		t.Fatal("backup succeeded although the CBT stream broke")
+	}
+
+	client := storage.NewClient(h.repo)
+	var ckpt metadata.BackupCheckpoint
+	if err := client.DownloadJSON(context.Background(), checkpointPath("snap-1"), &ckpt); err != nil {
+		t.Fatalf("failed to read checkpoint: %v", err)
+	}
+	if !ckpt.ListingIncomplete || ckpt.ListedThrough != 128<<10+4096 {
+		t.Fatalf("checkpoint listing = incomplete %v through %d, want incomplete through %d", ckpt.ListingIncomplete, ckpt.ListedThrough, 128<<10+4096)
+	}
+
+	h.backup(t, "--resume=snap-1", "--cbt-max-results=1")
+
+	if !h.cbt.called(fmt.Sprintf("allocated snap-1 from %d", 128<<10+4096)) {
+		t.Errorf("resumed backup did not continue the listing; calls: %v", h.cbt.calls)
+	}
+	if err := h.run(t, "check", "--read-data"); err != nil {
+		t.Fatalf("check failed: %v", err)
+	}
+
+	var blockList metadata.BlockList
+	if err := client.DownloadJSON(context.Background(), blockListPath("snap-1"), &blockList); err != nil {
+		t.Fatalf("failed to read block list: %v", err)
+	}
+	if len(blockList.Blocks) != len(extents) {
+		t.Fatalf("block list has %d extents, want %d", len(blockList.Blocks), len(extents))
+	}
+	for i, block := range blockList.Blocks {
+		if block.Offset != extents[i].ByteOffset || block.Size != extents[i].SizeBytes {
+			t.Errorf("extent %d = %d+%d, want %d+%d", i, block.Offset, block.Size, extents[i].ByteOffset, extents[i].SizeBytes)
+		}
+	}
+
+	segments, err := client.ListObjects(context.Background(), blockListSegmentPrefix("snap-1"))
+	if err != nil {
+		t.Fatalf("failed to list block list segments: %v", err)
+	}
+	if len(segments) != 0 {
+		t.Errorf("committed backup left block list segments %v", segments)
+	}
+}
+
+// TestBackupHonorsCBTListingInfo checks that FIXED_LENGTH blocks are
+// coalesced into contiguous ranges, that the metadata type and capacity
+// reported by CBT end up in the manifest, and that a capacity differing from
+// the snapshot's restore size fails the backup
+func TestBackupHonorsCBTListingInfo(t *testing.T) {
+	const size = 1 << 20
+
+	tests := []struct {
+		name         string
+		metadataType api.BlockMetadataType
+		capacity     int64
+		want         []blocks.BlockMetadata
+		wantErr      bool
+	}{
+		{
+			name:         "fixed length",
+			metadataType: api.BlockMetadataType_FIXED_LENGTH,
+			capacity:     size,
+			want:         []blocks.BlockMetadata{{Offset: 0, Size: 3 * 4096}, {Offset: 64 << 10, Size: 2 * 4096}},
+		},
+		{
+			name:         "variable length",
+			metadataType: api.BlockMetadataType_VARIABLE_LENGTH,
+			capacity:     size,
+			want: []blocks.BlockMetadata{
+				{Offset: 0, Size: 4096}, {Offset: 4096, Size: 4096}, {Offset: 8192, Size: 4096},
+				{Offset: 64 << 10, Size: 4096}, {Offset: 64<<10 + 4096, Size: 4096},
+			},
+		},
+		{
+			name:         "capacity mismatch",
+			metadataType: api.BlockMetadataType_FIXED_LENGTH,
+			capacity:     2 * size,
+			wantErr:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHarness(t, size)
+			h.cbt.metadataType = tt.metadataType
+			h.cbt.capacity = tt.capacity
+			h.cbt.setAllocated("snap-1",
+				h.write(t, 0, 4096),
+				h.write(t, 4096, 4096),
+				h.write(t, 8192, 4096),
+				h.write(t, 64<<10, 4096),
+				h.write(t, 64<<10+4096, 4096),
+			)
+
+			err := h.run(t, "create",
+				"--namespace="+testNamespace,
+				"--pvc="+testPVC,
+				"--device="+h.device,
+				"--snapshot=snap-1",
+				"--cbt-max-results=1",
+			)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("backup succeeded although CBT reported a different volume capacity")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("backup failed: %v", err)
+			}
+
+			client := storage.NewClient(h.repo)
+			var manifest metadata.SnapshotManifest
+			if err := client.DownloadJSON(context.Background(), "metadata/snap-1/manifest.json", &manifest); err != nil {
+				t.Fatalf("failed to read manifest: %v", err)
+			}
+			if manifest.BlockMetadataType != tt.metadataType.String() || manifest.VolumeCapacity != tt.capacity {
+				t.Errorf("manifest records %s with capacity %d, want %s with capacity %d",
+					manifest.BlockMetadataType, manifest.VolumeCapacity, tt.metadataType, tt.capacity)
+			}
+
+			var blockList metadata.BlockList
+			if err := client.DownloadJSON(context.Background(), blockListPath("snap-1"), &blockList); err != nil {
+				t.Fatalf("failed to read block list: %v", err)
+			}
+			var got []blocks.BlockMetadata
+			for _, block := range blockList.Blocks {
+				got = append(got, blocks.BlockMetadata{Offset: block.Offset, Size: block.Size})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("block list = %v, want %v", got, tt.want)
+			}
+			if err := h.run(t, "check", "--read-data"); err != nil {
+				t.Fatalf("check failed: %v", err)
+			}
+		})
+	}
+}
+
+// TestBackupRecordsCSIDriver checks that the manifest records the CSI driver
+// of the PVC's volume rather than a fixed one
+func TestBackupRecordsCSIDriver(t *testing.T) {
+	h := newHarness(t, 1<<20)
+	h.cbt.setAllocated("snap-1", h.write(t, 0, 4096))
+	h.backup(t, "--snapshot=snap-1")
+
+	var manifest metadata.SnapshotManifest
+	if err := storage.NewClient(h.repo).DownloadJSON(context.Background(), "metadata/snap-1/manifest.json", &manifest); err != nil {
+		t.Fatalf("failed to read manifest: %v", err)
+	}
+	if manifest.CSIDriver != testDriver {
+		t.Errorf("manifest records CSI driver %q, want %q", manifest.CSIDriver, testDriver)
+	}
+}
+
+// TestBackupWithoutCSIDriver checks that a volume whose CSI driver cannot be
+// resolved is still backed up, with no driver recorded
+func TestBackupWithoutCSIDriver(t *testing.T) {
+	h := newHarness(t, 1<<20)
+	if err := h.kube.CoreV1().PersistentVolumes().Delete(context.Background(), testPV, metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("failed to delete PV: %v", err)
+	}
+	h.cbt.setAllocated("snap-1", h.write(t, 0, 4096))
+	h.backup(t, "--snapshot=snap-1")
+
+	var manifest metadata.SnapshotManifest
+	if err := storage.NewClient(h.repo).DownloadJSON(context.Background(), "metadata/snap-1/manifest.json", &manifest); err != nil {
+		t.Fatalf("failed to read manifest: %v", err)
+	}
+	if manifest.CSIDriver != "" {
+		t.Errorf("manifest records CSI driver %q, want none", manifest.CSIDriver)
+	}
+	if manifest.TotalBlocks != 1 {
+		t.Errorf("manifest records %d blocks, want 1", manifest.TotalBlocks)
+	}
+}
+
+// TestSnapshotSourceValidatesFlags checks that a --source=snapshot backup
+// rejects bad flags before it starts a mover pod
+func TestSnapshotSourceValidatesFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{
+			name:    "encryption key file",
+			args:    []string{"--encryption-key-file=/tmp/master.key"},
+			wantErr: "--encryption-key-file",
+		},
+		{
+			name:    "local repository",
+			args:    []string{"--local-path=/var/backups/cbt"},
+			wantErr: "--local-path",
+		},
+		{
+			name:    "plaintext S3 credentials",
+			args:    []string{"--s3-secret-key=hunter2"},
+			wantErr: "--s3-credentials-secret",
+		},
+		{
+			name:    "no workers",
+			args:    []string{"--concurrency=0"},
+			wantErr: "--concurrency",
+		},
+		{
+			name:    "dedup and pack",
+			args:    []string{"--dedup", "--pack"},
+			wantErr: "--dedup and --pack",
+		},
+		{
+			name:    "unknown codec",
+			args:    []string{"--compression=rot13"},
+			wantErr: "rot13",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHarness(t, 1<<20)
+			args := append([]string{"create",
+				"--namespace=" + testNamespace,
+				"--pvc=" + testPVC,
+				"--snapshot=snap-1",
+				"--source=snapshot",
+			}, tt.args...)
+
+			err := h.run(t, args...)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("backup %v error = %v, want one mentioning %q", tt.args, err, tt.wantErr)
+			}
+			for _, action := range h.kube.Actions() {
+				if action.GetVerb() == "create" {
+					t.Errorf("backup created a %s before rejecting its flags", action.GetResource().Resource)
+				}
+			}
+		})
+	}
+}
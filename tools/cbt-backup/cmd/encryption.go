@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/encryption"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/snapshot"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/storage"
+)
+
+// defaultSecretKey is the Secret data key holding the master key when
+// --encryption-key-secret does not name one
+const defaultSecretKey = "key"
+
+// readMasterKey returns the master key from --encryption-key-file or
+// --encryption-key-secret (<name> or <name>/<key>), or nil when encryption
+// is not configured
+func readMasterKey(ctx context.Context, snapMgr *snapshot.Manager) ([]byte, error) {
+	var data []byte
+	var err error
+
+	switch {
+	case encryptionKeyFile != "" && encryptionKeySecret != "":
+		return nil, fmt.Errorf("--encryption-key-file and --encryption-key-secret cannot be combined")
+	case encryptionKeyFile != "":
+		data, err = os.ReadFile(encryptionKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read master key: %w", err)
+		}
+	case encryptionKeySecret != "":
+		if snapMgr == nil {
+			return nil, fmt.Errorf("--encryption-key-secret requires Kubernetes access")
+		}
+		name, key, found := strings.Cut(encryptionKeySecret, "/")
+		if !found {
+			key = defaultSecretKey
+		}
+		data, err = snapMgr.GetSecretValue(ctx, name, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read master key: %w", err)
+		}
+	default:
+		return nil, nil
+	}
+
+	return encryption.ParseMasterKey(data)
+}
+
+// loadKeyring unwraps the repository keys protected by the master key. When
+// create is set and the master key protects no key yet, a new repository key
+// is generated and stored wrapped under keys/.
+func loadKeyring(ctx context.Context, s3Client *storage.Client, masterKey []byte, create bool) (*encryption.Keyring, error) {
+	keyring, err := encryption.NewKeyring(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	objects, err := s3Client.ListObjects(ctx, encryption.KeysPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list keys: %w", err)
+	}
+
+	for _, obj := range objects {
+		var wrapped encryption.WrappedKey
+		if err := s3Client.DownloadPlainJSON(ctx, obj, &wrapped); err != nil {
+			return nil, fmt.Errorf("failed to load key %s: %w", obj, err)
+		}
+		if _, err := keyring.AddWrapped(wrapped); err != nil {
+			return nil, err
+		}
+	}
+
+	if keyring.Len() == 0 {
+		if !create {
+			return nil, fmt.Errorf("no repository key is wrapped by master key %s", keyring.MasterKeyID())
+		}
+
+		wrapped, err := keyring.GenerateKey()
+		if err != nil {
+			return nil, err
+		}
+		keyPath := fmt.Sprintf("%s%s.json", encryption.KeysPrefix, wrapped.ID)
+		if err := s3Client.UploadPlainJSON(ctx, keyPath, wrapped); err != nil {
+			return nil, fmt.Errorf("failed to store repository key: %w", err)
+		}
+		fmt.Printf("✓ Created repository key %s (master key %s)\n", wrapped.ID, wrapped.MasterKeyID)
+	}
+
+	return keyring, nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"iter"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/blocks"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/metadata"
+)
+
+// extentSource lists the extents of a backup in offset order. Listing stops
+// when ctx is cancelled or the consumer stops ranging over it.
+type extentSource func(ctx context.Context) iter.Seq2[blocks.BlockMetadata, error]
+
+// listExtents returns the extents to back up from offset from on: the blocks
+// changed since the VolumeSnapshot cbtBaseSnapshot or, for a full backup,
+// every allocated block. CBT extents are streamed to the consumer as the
+// service sends them. Without CBT it falls back to scanning the device for
+// non-zero blocks, unless requireCBT is set. The SnapshotMetadataService is
+// the one of the manifest's CSI driver, and the capacity it reports must
+// match the manifest's volume size. The CBT client is returned, connected,
+// when CBT is used and nil otherwise; the caller closes it.
+func listExtents(ctx context.Context, manifest *metadata.SnapshotManifest, cbtBaseSnapshot string, from int64, requireCBT bool) (extentSource, *metadata.CBTClient, error) {
+	snapName := manifest.Name
+
+	// Initialize CBT client
+	cbtClient, err := newCBTClient(namespace, kubeconfig, serviceAccountName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create CBT client: %w", err)
+	}
+
+	if cbtEndpoint != "" {
+		cbtClient.SetEndpoint(cbtEndpoint)
+	}
+	cbtClient.SetMaxResults(cbtMaxResults)
+	cbtClient.SetRetries(cbtRetries, cbtRetryBackoff)
+	cbtClient.SetDriver(manifest.CSIDriver)
+	cbtClient.SetVolumeCapacity(manifest.VolumeSize)
+
+	// Try to connect to CSI driver
+	fmt.Println("Connecting to CSI driver...")
+	if connectErr := cbtClient.Connect(ctx); connectErr != nil {
+		cbtClient.Close()
+		if requireCBT {
+			return nil, nil, fmt.Errorf("failed to connect to CSI driver: %w", connectErr)
+		}
+
+		// CBT not available - fall back to full device scan
+		fmt.Printf("⚠ CBT not available: %v\n", connectErr)
+		if devicePath == "" {
+			fmt.Println("  No device path specified - metadata-only backup")
+			return sliceExtents(nil), nil, nil
+		}
+		fmt.Println("  Falling back to full device scan for non-zero blocks...")
+		source, err := scanExtents(from)
+		if err != nil {
+			return nil, nil, err
+		}
+		return source, nil, nil
+	}
+
+	if cbtBaseSnapshot != "" {
+		// Incremental backup - stream changed blocks
+		fmt.Printf("Streaming changed blocks between %s and %s...\n", cbtBaseSnapshot, snapName)
+		return chunkExtents(func(ctx context.Context) iter.Seq2[blocks.BlockMetadata, error] {
+			return cbtClient.DeltaBlocks(ctx, cbtBaseSnapshot, snapName, from)
+		}, blockSize, coalesceExtents), cbtClient, nil
+	}
+
+	// Full backup - stream all allocated blocks
+	fmt.Printf("Streaming allocated blocks for %s...\n", snapName)
+	return chunkExtents(func(ctx context.Context) iter.Seq2[blocks.BlockMetadata, error] {
+		return cbtClient.AllocatedBlocks(ctx, snapName, from)
+	}, blockSize, coalesceExtents), cbtClient, nil
+}
+
+// chunkExtents splits the extents of source at multiples of chunkSize, so
+// no extent read into memory or stored as an object is larger than
+// chunkSize, however large the extents CBT reports. With coalesce,
+// contiguous extents within the same chunk are merged into one.
+func chunkExtents(source extentSource, chunkSize int64, coalesce bool) extentSource {
+	return func(ctx context.Context) iter.Seq2[blocks.BlockMetadata, error] {
+		return func(yield func(blocks.BlockMetadata, error) bool) {
+			// run is the piece held back, when coalescing, in case the next
+			// one continues it
+			var run blocks.BlockMetadata
+			for e, err := range source(ctx) {
+				if err != nil {
+					if run.Size > 0 && !yield(run, nil) {
+						return
+					}
+					yield(blocks.BlockMetadata{}, err)
+					return
+				}
+				for offset, end := e.Offset, e.Offset+e.Size; offset < end; {
+					pieceEnd := min(end, (offset/chunkSize+1)*chunkSize)
+					piece := blocks.BlockMetadata{Offset: offset, Size: pieceEnd - offset}
+					offset = pieceEnd
+
+					if !coalesce {
+						if !yield(piece, nil) {
+							return
+						}
+						continue
+					}
+					if run.Size > 0 && run.Offset+run.Size == piece.Offset && run.Offset/chunkSize == piece.Offset/chunkSize {
+						run.Size += piece.Size
+						continue
+					}
+					if run.Size > 0 && !yield(run, nil) {
+						return
+					}
+					run = piece
+				}
+			}
+			if run.Size > 0 {
+				yield(run, nil)
+			}
+		}
+	}
+}
+
+// scanExtents scans the device for non-zero blocks from offset from on
+// (fallback when CBT is unavailable)
+func scanExtents(from int64) (extentSource, error) {
+	allocatedBlocks, err := blocks.ScanNonZeroBlocks(devicePath, blockSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan device: %w", err)
+	}
+
+	extents := allocatedBlocks[:0]
+	for _, e := range allocatedBlocks {
+		if e.Offset >= from {
+			extents = append(extents, e)
+		}
+	}
+	fmt.Printf("✓ Found %d non-zero blocks via device scan\n", len(extents))
+	return sliceExtents(extents), nil
+}
+
+// sliceExtents returns a source that lists extents already known
+func sliceExtents(extents []blocks.BlockMetadata) extentSource {
+	return func(ctx context.Context) iter.Seq2[blocks.BlockMetadata, error] {
+		return func(yield func(blocks.BlockMetadata, error) bool) {
+			for _, e := range extents {
+				if !yield(e, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// concatExtents returns a source that lists the extents of first and then
+// those of second
+func concatExtents(first, second extentSource) extentSource {
+	return func(ctx context.Context) iter.Seq2[blocks.BlockMetadata, error] {
+		return func(yield func(blocks.BlockMetadata, error) bool) {
+			for _, source := range []extentSource{first, second} {
+				for e, err := range source(ctx) {
+					if !yield(e, err) || err != nil {
+						return
+					}
+				}
+			}
+		}
+	}
+}
+
+// printListingSummary reports how much of the volume CBT listed
+func printListingSummary(list *metadata.BlockListWriter, volumeSize int64) {
+	allocatedSize := list.TotalSize()
+	fmt.Printf("✓ CBT listed %d blocks\n", list.Len())
+	fmt.Printf("Total allocated size: %d bytes (%.2f MB)\n", allocatedSize, float64(allocatedSize)/(1024*1024))
+	fmt.Printf("Volume size: %d bytes (%.2f MB)\n", volumeSize, float64(volumeSize)/(1024*1024))
+	if volumeSize > 0 {
+		savingsPercent := 100.0 * (1.0 - float64(allocatedSize)/float64(volumeSize))
+		fmt.Printf("Data transfer savings: %.2f%%\n", savingsPercent)
+	}
+}
+
+// recordListing copies the block metadata type and volume capacity reported
+// by CBT into the manifest. Nothing is recorded before CBT has sent a
+// message, so a resumed backup keeps what its checkpoint recorded.
+func recordListing(manifest *metadata.SnapshotManifest, cbtClient *metadata.CBTClient) {
+	if cbtClient == nil {
+		return
+	}
+	info := cbtClient.ListingInfo()
+	if info.BlockMetadataType != "" {
+		manifest.BlockMetadataType = info.BlockMetadataType
+	}
+	if info.VolumeCapacityBytes > 0 {
+		manifest.VolumeCapacity = info.VolumeCapacityBytes
+	}
+}
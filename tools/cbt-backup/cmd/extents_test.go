@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"reflect"
+	"testing"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/blocks"
+)
+
+func TestChunkExtents(t *testing.T) {
+	const chunk = 64 << 10
+
+	tests := []struct {
+		name     string
+		extents  []blocks.BlockMetadata
+		coalesce bool
+		want     []blocks.BlockMetadata
+	}{
+		{
+			name:    "small extent unchanged",
+			extents: []blocks.BlockMetadata{{Offset: 4096, Size: 8192}},
+			want:    []blocks.BlockMetadata{{Offset: 4096, Size: 8192}},
+		},
+		{
+			name:    "oversized extent split at chunk boundaries",
+			extents: []blocks.BlockMetadata{{Offset: 60 << 10, Size: 140 << 10}},
+			want: []blocks.BlockMetadata{
+				{Offset: 60 << 10, Size: 4 << 10},
+				{Offset: 64 << 10, Size: 64 << 10},
+				{Offset: 128 << 10, Size: 64 << 10},
+				{Offset: 192 << 10, Size: 8 << 10},
+			},
+		},
+		{
+			name: "adjacent extents kept apart without coalescing",
+			extents: []blocks.BlockMetadata{
+				{Offset: 0, Size: 4096},
+				{Offset: 4096, Size: 4096},
+			},
+			want: []blocks.BlockMetadata{
+				{Offset: 0, Size: 4096},
+				{Offset: 4096, Size: 4096},
+			},
+		},
+		{
+			name: "adjacent extents coalesced within a chunk",
+			extents: []blocks.BlockMetadata{
+				{Offset: 0, Size: 4096},
+				{Offset: 4096, Size: 4096},
+				{Offset: 16 << 10, Size: 4096},
+				{Offset: 20 << 10, Size: 48 << 10},
+				{Offset: 68 << 10, Size: 4096},
+			},
+			coalesce: true,
+			want: []blocks.BlockMetadata{
+				{Offset: 0, Size: 8192},
+				{Offset: 16 << 10, Size: 48 << 10},
+				{Offset: 64 << 10, Size: 8 << 10},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []blocks.BlockMetadata
+			for e, err := range chunkExtents(sliceExtents(tt.extents), chunk, tt.coalesce)(context.Background()) {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				got = append(got, e)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("chunkExtents() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestChunkExtentsFlushesBeforeError checks that a piece held back for
+// coalescing is still delivered when listing fails, so a resumed backup
+// does not list it again
+func TestChunkExtentsFlushesBeforeError(t *testing.T) {
+	listErr := errors.New("stream broke")
+	failing := concatExtents(
+		sliceExtents([]blocks.BlockMetadata{{Offset: 0, Size: 4096}}),
+		func(ctx context.Context) iter.Seq2[blocks.BlockMetadata, error] {
+			return func(yield func(blocks.BlockMetadata, error) bool) {
+				yield(blocks.BlockMetadata{}, listErr)
+			}
+		},
+	)
+
+	var got []blocks.BlockMetadata
+	var gotErr error
+	for e, err := range chunkExtents(failing, 64<<10, true)(context.Background()) {
+		if err != nil {
+			gotErr = err
+			break
+		}
+		got = append(got, e)
+	}
+	if want := []blocks.BlockMetadata{{Offset: 0, Size: 4096}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("extents before the error = %v, want %v", got, want)
+	}
+	if !errors.Is(gotErr, listErr) {
+		t.Errorf("error = %v, want %v", gotErr, listErr)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+// defaultGCGracePeriod is how old an unreferenced block object must be
+// before gc deletes it
+const defaultGCGracePeriod = 24 * time.Hour
+
+var gcGracePeriod time.Duration
+
+func newGCCmd() *cobra.Command {
+	gcCmd := &cobra.Command{
+		Use:   "gc",
+		Short: "Delete block objects that no backup references",
+		Long: `Collects the block objects referenced by the block lists of all committed
+snapshots and by the checkpoints of unfinished backups, and deletes every
+other object under blocks/ that is older than the grace period.
+
+The grace period protects objects written by backups that are still running
+but have not recorded them yet. Objects under the blocks/<snapshot>/ prefix
+of an unfinished backup are always kept, so it can still be resumed.`,
+		RunE: runGC,
+	}
+
+	gcCmd.Flags().DurationVar(&gcGracePeriod, "grace-period", defaultGCGracePeriod, "Only delete unreferenced objects older than this")
+	gcCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Print what would be deleted without deleting anything")
+	addStorageFlags(gcCmd)
+	addLockFlags(gcCmd)
+
+	return gcCmd
+}
+
+func runGC(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+
+	if gcGracePeriod < 0 {
+		return fmt.Errorf("--grace-period must not be negative")
+	}
+
+	fmt.Println("========================================")
+	fmt.Println("Collecting Garbage")
+	fmt.Println("========================================")
+	fmt.Printf("Grace Period: %s\n", gcGracePeriod)
+	if dryRun {
+		fmt.Println("Dry run: nothing will be deleted")
+	}
+	fmt.Println("========================================")
+
+	s3Client, _, err := newStorageClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open repository: %w", err)
+	}
+
+	repoLock, lockCtx, err := lockRepository(ctx, s3Client, !dryRun, "gc")
+	if err != nil {
+		return err
+	}
+	defer unlockRepository(repoLock)
+	ctx = lockCtx
+
+	fmt.Println("\n[1/3] Collecting referenced block objects...")
+	repo, err := loadRepository(ctx, s3Client)
+	if err != nil {
+		return err
+	}
+	for _, name := range repo.Names {
+		if snap := repo.Snapshots[name]; len(snap.Unreadable) > 0 {
+			// A block list that cannot be read may reference anything
+			return fmt.Errorf("metadata of %s cannot be read (%s); fix or delete it before running gc", name, snap.Unreadable[0])
+		}
+	}
+	referenced, claimed := repo.referencedObjects()
+	fmt.Printf("✓ %d snapshots reference %d block objects\n", len(repo.Names), len(referenced))
+
+	fmt.Println("\n[2/3] Finding unreferenced block objects...")
+	objects, err := s3Client.ListObjectInfo(ctx, "blocks/")
+	if err != nil {
+		return fmt.Errorf("failed to list block objects: %w", err)
+	}
+
+	cutoff := time.Now().Add(-gcGracePeriod)
+	var (
+		garbage                []storage.ObjectInfo
+		garbageBytes           int64
+		held, recent           int
+		heldBytes, recentBytes int64
+		referencedBytes        int64
+	)
+	for _, obj := range objects {
+		switch {
+		case referenced[obj.Key]:
+			referencedBytes += obj.Size
+		case claimedBy(obj.Key, claimed):
+			held++
+			heldBytes += obj.Size
+		case obj.LastModified.After(cutoff):
+			recent++
+			recentBytes += obj.Size
+		default:
+			garbage = append(garbage, obj)
+			garbageBytes += obj.Size
+		}
+	}
+
+	fmt.Printf("✓ Scanned %d block objects (%.2f MB referenced)\n", len(objects), float64(referencedBytes)/(1024*1024))
+	if held > 0 {
+		fmt.Printf("  Keeping %d objects (%.2f MB) of unfinished backups\n", held, float64(heldBytes)/(1024*1024))
+	}
+	if recent > 0 {
+		fmt.Printf("  Keeping %d unreferenced objects (%.2f MB) within the grace period\n", recent, float64(recentBytes)/(1024*1024))
+	}
+
+	fmt.Println("\n[3/3] Deleting unreferenced block objects...")
+	deleted := 0
+	var deletedBytes int64
+	for _, obj := range garbage {
+		if dryRun {
+			fmt.Printf("  delete %s  %s (%d bytes)\n", obj.LastModified.Format("2006-01-02 15:04:05"), obj.Key, obj.Size)
+			continue
+		}
+		if err := s3Client.DeleteObject(ctx, obj.Key); err != nil {
+			return err
+		}
+		deleted++
+		deletedBytes += obj.Size
+	}
+
+	fmt.Println("\n========================================")
+	if dryRun {
+		fmt.Printf("Would delete %d objects (%.2f MB)\n", len(garbage), float64(garbageBytes)/(1024*1024))
+	} else {
+		fmt.Printf("Objects Deleted: %d\n", deleted)
+		fmt.Printf("Space Freed:     %d bytes (%.2f MB)\n", deletedBytes, float64(deletedBytes)/(1024*1024))
+	}
+	fmt.Println("========================================")
+	return nil
+}
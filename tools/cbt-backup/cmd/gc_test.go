@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/blocks"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/metadata"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/storage"
+)
+
+const testDigest = "ab12cd34ef56ab12cd34ef56ab12cd34ef56ab12cd34ef56ab12cd34ef56ab12"
+
+func TestReferencedObjects(t *testing.T) {
+	snaps := []*repoSnapshot{
+		{
+			// Committed backups reference their block list
+			Name:     "committed",
+			Manifest: &metadata.SnapshotManifest{Name: "committed", State: metadata.StateCompleted},
+			Blocks: &metadata.BlockList{Blocks: []blocks.BlockMetadata{
+				{Offset: 0, Size: 4096},
+			}},
+		},
+		{
+			// An interrupted backup references the objects of its checkpoint,
+			// block list segments and partial block list, and claims its prefix
+			Name: "interrupted",
+			Manifest: &metadata.SnapshotManifest{
+				Name:        "interrupted",
+				State:       metadata.StateFailed,
+				BlockLayout: metadata.LayoutContentAddressed,
+			},
+			Blocks: &metadata.BlockList{Blocks: []blocks.BlockMetadata{
+				{Offset: 0, Size: 4096, Object: "blocks/interrupted/pack-000000"},
+			}},
+			Segments: []blocks.BlockMetadata{
+				{Offset: 8192, Size: 4096, Object: "blocks/interrupted/pack-000001"},
+			},
+			Checkpoint: &metadata.BackupCheckpoint{
+				Manifest: metadata.SnapshotManifest{Name: "interrupted", BlockLayout: metadata.LayoutContentAddressed},
+				Uploaded: []blocks.BlockMetadata{
+					{Offset: 4096, Size: 4096, Checksum: testDigest, Compression: "zstd"},
+				},
+			},
+		},
+		{
+			// A running backup claims its prefix before its first checkpoint
+			Name:     "running",
+			Manifest: &metadata.SnapshotManifest{Name: "running", State: metadata.StateInProgress},
+		},
+		{
+			// A failed backup without a checkpoint cannot be resumed
+			Name:     "failed",
+			Manifest: &metadata.SnapshotManifest{Name: "failed", State: metadata.StateFailed},
+			Blocks: &metadata.BlockList{Blocks: []blocks.BlockMetadata{
+				{Offset: 0, Size: 4096},
+			}},
+		},
+		{
+			// A checkpoint without a manifest is still resumable
+			Name: "orphaned-checkpoint",
+			Checkpoint: &metadata.BackupCheckpoint{
+				Manifest: metadata.SnapshotManifest{Name: "orphaned-checkpoint"},
+				Uploaded: []blocks.BlockMetadata{{Offset: 8192, Size: 4096}},
+			},
+		},
+	}
+	repo := &repository{Snapshots: make(map[string]*repoSnapshot)}
+	for _, snap := range snaps {
+		repo.Snapshots[snap.Name] = snap
+		repo.Names = append(repo.Names, snap.Name)
+	}
+	sort.Strings(repo.Names)
+
+	referenced, claimed := repo.referencedObjects()
+
+	wantReferenced := map[string]bool{
+		"blocks/committed/block-0-4096":                   true,
+		"blocks/interrupted/pack-000000":                  true,
+		"blocks/interrupted/pack-000001":                  true,
+		metadata.ContentAddressedPath(testDigest, "zstd"): true,
+		"blocks/orphaned-checkpoint/block-8192-4096":      true,
+	}
+	if !reflect.DeepEqual(referenced, wantReferenced) {
+		t.Errorf("referenced = %v, want %v", referenced, wantReferenced)
+	}
+
+	wantClaimed := []string{"blocks/interrupted/", "blocks/orphaned-checkpoint/", "blocks/running/"}
+	if !reflect.DeepEqual(claimed, wantClaimed) {
+		t.Errorf("claimed = %v, want %v", claimed, wantClaimed)
+	}
+}
+
+// TestGC runs gc over a repository holding referenced, claimed, recent and
+// stale objects and checks that only the stale unreferenced ones go
+func TestGC(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t, 1<<20)
+	client := storage.NewClient(h.repo)
+
+	h.cbt.setAllocated("snap-1", h.write(t, 0, 4096))
+	h.backup(t, "--snapshot=snap-1")
+
+	// An interrupted content-addressed backup whose checkpoint is the only
+	// reference to a shared object
+	shared := metadata.ContentAddressedPath(testDigest, "")
+	checkpoint := metadata.BackupCheckpoint{
+		Manifest: metadata.SnapshotManifest{
+			Name:        "snap-2",
+			State:       metadata.StateInProgress,
+			BlockLayout: metadata.LayoutContentAddressed,
+		},
+		Uploaded: []blocks.BlockMetadata{{Offset: 0, Size: 4096, Checksum: testDigest}},
+	}
+	if err := client.UploadJSON(ctx, checkpointPath("snap-2"), checkpoint); err != nil {
+		t.Fatalf("failed to write checkpoint: %v", err)
+	}
+
+	put := func(key string, age time.Duration) {
+		t.Helper()
+		if err := h.repo.Put(ctx, key, make([]byte, 4096)); err != nil {
+			t.Fatalf("failed to write %s: %v", key, err)
+		}
+		h.repo.backdate(key, age)
+	}
+	put(shared, 48*time.Hour)
+	put("blocks/snap-2/pack-000000", 48*time.Hour)
+	put("blocks/gone/block-0-4096", 48*time.Hour)
+	put("blocks/gone/block-4096-4096", 10*time.Minute)
+	put(metadata.ContentAddressedPath(strings.Repeat("0", 64), ""), 48*time.Hour)
+
+	objects, err := client.ListObjects(ctx, "blocks/snap-1/")
+	if err != nil || len(objects) == 0 {
+		t.Fatalf("snap-1 has no block objects: %v", err)
+	}
+	for _, obj := range objects {
+		h.repo.backdate(obj, 48*time.Hour)
+	}
+
+	if err := h.run(t, "gc", "--grace-period=1h"); err != nil {
+		t.Fatalf("gc failed: %v", err)
+	}
+
+	want := map[string]bool{
+		objects[0]:                    true, // referenced by a committed block list
+		shared:                        true, // referenced by a checkpoint only
+		"blocks/snap-2/pack-000000":   true, // claimed by an unfinished backup
+		"blocks/gone/block-4096-4096": true, // within the grace period
+		"blocks/gone/block-0-4096":    false,
+		metadata.ContentAddressedPath(strings.Repeat("0", 64), ""): false,
+	}
+	for key, kept := range want {
+		exists, err := client.ObjectExists(ctx, key)
+		if err != nil {
+			t.Fatalf("failed to check %s: %v", key, err)
+		}
+		if exists != kept {
+			t.Errorf("%s exists = %v after gc, want %v", key, exists, kept)
+		}
+	}
+}
+
+// TestGCRefusesUnreadableMetadata checks that gc deletes nothing while a
+// block list it cannot read might reference any object
+func TestGCRefusesUnreadableMetadata(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t, 1<<20)
+
+	garbage := "blocks/gone/block-0-4096"
+	if err := h.repo.Put(ctx, garbage, make([]byte, 4096)); err != nil {
+		t.Fatalf("failed to write %s: %v", garbage, err)
+	}
+	h.repo.backdate(garbage, 48*time.Hour)
+	if err := h.repo.Put(ctx, blockListPath("snap-1"), []byte("{not json")); err != nil {
+		t.Fatalf("failed to write block list: %v", err)
+	}
+
+	err := h.run(t, "gc")
+	if err == nil || !strings.Contains(err.Error(), "metadata of snap-1 cannot be read") {
+		t.Fatalf("gc error = %v, want a refusal naming snap-1", err)
+	}
+	exists, err := storage.NewClient(h.repo).ObjectExists(ctx, garbage)
+	if err != nil {
+		t.Fatalf("failed to check %s: %v", garbage, err)
+	}
+	if !exists {
+		t.Error("gc deleted objects despite unreadable metadata")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/lock"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+var (
+	lockWait  time.Duration
+	unlockAll bool
+	unlockIDs []string
+)
+
+// addLockFlags registers the flags of commands that lock the repository
+func addLockFlags(cmd *cobra.Command) {
+	cmd.Flags().DurationVar(&lockWait, "lock-wait", 0, "How long to wait for a conflicting repository lock to be released")
+}
+
+// lockRepository takes a shared or exclusive lock on the repository for
+// operation. The returned context is canceled if the lock is lost, so work
+// done under it stops before it can conflict with another process.
+func lockRepository(ctx context.Context, s3Client *storage.Client, exclusive bool, operation string) (*lock.Lock, context.Context, error) {
+	lk, lockCtx, err := lock.Acquire(ctx, s3Client, lock.Options{
+		Exclusive: exclusive,
+		Operation: operation,
+		Wait:      lockWait,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to lock repository: %w", err)
+	}
+	if exclusive {
+		fmt.Println("✓ Acquired exclusive repository lock")
+	} else {
+		fmt.Println("✓ Acquired shared repository lock")
+	}
+	return lk, lockCtx, nil
+}
+
+// unlockRepository releases a lock taken by lockRepository. A lock that
+// cannot be removed turns stale and is ignored once its heartbeat expires.
+func unlockRepository(lk *lock.Lock) {
+	if err := lk.Release(); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+}
+
+func newUnlockCmd() *cobra.Command {
+	unlockCmd := &cobra.Command{
+		Use:   "unlock",
+		Short: "Remove stale repository locks",
+		Long: `Lists the locks held on the repository and removes the stale ones, whose
+holder stopped refreshing them, e.g. because its pod was killed. Stale locks
+are already ignored by other commands; removing them only tidies up.
+
+Use --id to remove a specific lock, or --all to remove every lock. Removing
+a live lock makes its holder stop at its next heartbeat.`,
+		RunE: runUnlock,
+	}
+
+	unlockCmd.Flags().BoolVar(&unlockAll, "all", false, "Remove every lock, including live ones")
+	unlockCmd.Flags().StringSliceVar(&unlockIDs, "id", nil, "Remove the lock with this ID, including a live one")
+	addStorageFlags(unlockCmd)
+
+	return unlockCmd
+}
+
+func runUnlock(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+
+	s3Client, _, err := newStorageClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open repository: %w", err)
+	}
+
+	locks, err := lock.List(ctx, s3Client)
+	if err != nil {
+		return err
+	}
+	if len(locks) == 0 {
+		fmt.Println("Repository is not locked")
+		return nil
+	}
+
+	requested := make(map[string]bool, len(unlockIDs))
+	for _, id := range unlockIDs {
+		requested[id] = true
+	}
+
+	now := time.Now()
+	removed := 0
+	for i := range locks {
+		info := &locks[i]
+		stale := info.Stale(now)
+
+		state := "live "
+		if stale {
+			state = "stale"
+		}
+		if !unlockAll && !requested[info.ID] && !(stale && len(unlockIDs) == 0) {
+			fmt.Printf("  keep   %s %s\n", state, info)
+			continue
+		}
+
+		if err := lock.Remove(ctx, s3Client, info.ID); err != nil {
+			return err
+		}
+		fmt.Printf("  remove %s %s\n", state, info)
+		delete(requested, info.ID)
+		removed++
+	}
+
+	for id := range requested {
+		fmt.Printf("Warning: no lock with ID %s\n", id)
+	}
+	fmt.Printf("\nRemoved %d of %d lock(s)\n", removed, len(locks))
+	return nil
+}
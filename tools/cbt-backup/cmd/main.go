@@ -4,34 +4,76 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"sort"
 	"time"
 
 	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/blocks"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/compression"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/encryption"
 	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/metadata"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/pack"
 	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/s3"
 	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/snapshot"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/storage"
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
 	"github.com/spf13/cobra"
 )
 
 var (
-	namespace         string
-	pvcName           string
-	snapshotName      string
-	baseSnapshotName  string
-	s3Endpoint        string
-	s3AccessKey       string
-	s3SecretKey       string
-	s3Bucket          string
-	s3UseSSL          bool
-	devicePath        string
-	blockSize         int64
-	kubeconfig        string
-	snapshotClass      string
-	cbtEndpoint        string
-	serviceAccountName string
+	namespace           string
+	pvcName             string
+	snapshotName        string
+	baseSnapshotName    string
+	s3Endpoint          string
+	s3AccessKey         string
+	s3SecretKey         string
+	s3CredentialsSecret string
+	s3Bucket            string
+	s3UseSSL            bool
+	devicePath          string
+	blockSize           int64
+	kubeconfig          string
+	snapshotClass       string
+	cbtEndpoint         string
+	cbtMaxResults       int32
+	cbtRetries          int
+	cbtRetryBackoff     time.Duration
+	coalesceExtents     bool
+	serviceAccountName  string
+	sourceMode          string
+	moverImage          string
+	moverTimeout        time.Duration
+	reuseSnapshot       bool
+	moverMode           bool
+	dedup               bool
+	packBlocks          bool
+	packSize            int64
+	compressionCodec    string
+	encryptionKeyFile   string
+	encryptionKeySecret string
+	uploadConcurrency   int
+	uploadMemory        int64
+	resumeSnapshot      string
+	checkpointInterval  time.Duration
+	localPath           string
+)
+
+// Constructors of the clients a backup talks to; the end-to-end tests replace
+// them with in-process fakes
+var (
+	newSnapshotManager = snapshot.NewManager
+	newCBTClient       = metadata.NewCBTClient
+	newBackend         = openBackend
 )
 
 func main() {
+	if err := newRootCmd().Execute(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func newRootCmd() *cobra.Command {
 	rootCmd := &cobra.Command{
 		Use:   "cbt-backup",
 		Short: "Backup tool using Kubernetes Changed Block Tracking",
@@ -41,6 +83,11 @@ to perform incremental backups of block volumes to S3-compatible storage.
 Supports full and incremental backups with block data upload to S3.`,
 	}
 
+	rootCmd.AddCommand(newBackupCmd(), newListCmd(), newCatalogCmd(), newPruneCmd(), newConsolidateCmd(), newCheckCmd(), newGCCmd(), newUnlockCmd())
+	return rootCmd
+}
+
+func newBackupCmd() *cobra.Command {
 	backupCmd := &cobra.Command{
 		Use:   "create",
 		Short: "Create a snapshot and backup blocks to S3",
@@ -54,45 +101,178 @@ Supports full and incremental backups with block data upload to S3.`,
 	backupCmd.Flags().StringVarP(&s3Endpoint, "s3-endpoint", "e", "minio.cbt-demo.svc.cluster.local:9000", "S3 endpoint")
 	backupCmd.Flags().StringVarP(&s3AccessKey, "s3-access-key", "a", "minioadmin", "S3 access key")
 	backupCmd.Flags().StringVarP(&s3SecretKey, "s3-secret-key", "k", "minioadmin123", "S3 secret key")
+	backupCmd.Flags().StringVar(&s3CredentialsSecret, "s3-credentials-secret", "", "Secret holding the S3 credentials under access-key and secret-key, passed to the mover pod with --source=snapshot")
 	backupCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "B", "snapshots", "S3 bucket name")
 	backupCmd.Flags().BoolVar(&s3UseSSL, "s3-use-ssl", false, "Use SSL for S3")
+	backupCmd.Flags().StringVar(&localPath, "local-path", "", "Store the repository in this directory instead of S3")
 	backupCmd.Flags().StringVarP(&devicePath, "device", "d", "", "Block device path (auto-detected if not provided)")
-	backupCmd.Flags().Int64Var(&blockSize, "block-size", blocks.DefaultBlockSize, "Block size in bytes")
+	backupCmd.Flags().Int64Var(&blockSize, "block-size", blocks.DefaultBlockSize, "Block size in bytes; CBT extents are split into aligned chunks of at most this size")
 	backupCmd.Flags().StringVar(&kubeconfig, "kubeconfig", "", "Path to kubeconfig (uses in-cluster config if not provided)")
 	backupCmd.Flags().StringVar(&snapshotClass, "snapshot-class", "csi-hostpath-snapclass", "VolumeSnapshotClass name")
 	backupCmd.Flags().StringVar(&cbtEndpoint, "cbt-endpoint", "", "CBT gRPC endpoint (overrides service discovery)")
+	backupCmd.Flags().Int32Var(&cbtMaxResults, "cbt-max-results", 0, "Extents the CBT service sends per stream message (0 lets the service choose)")
+	backupCmd.Flags().IntVar(&cbtRetries, "cbt-retries", metadata.DefaultStreamRetries, "How often a broken CBT metadata stream is resumed before the backup fails")
+	backupCmd.Flags().DurationVar(&cbtRetryBackoff, "cbt-retry-backoff", metadata.DefaultRetryBackoff, "Wait before resuming a broken CBT metadata stream, doubled for each further retry")
+	backupCmd.Flags().BoolVar(&coalesceExtents, "coalesce-extents", false, "Merge adjacent CBT extents that fall within the same --block-size chunk")
 	backupCmd.Flags().StringVar(&serviceAccountName, "service-account", "cbt-backup-sa", "Service account name for CBT token auth")
+	backupCmd.Flags().StringVar(&sourceMode, "source", sourceDevice, "Where block data is read from: device (live --device) or snapshot (temporary PVC provisioned from the VolumeSnapshot)")
+	backupCmd.Flags().StringVar(&moverImage, "mover-image", "cbt-backup:latest", "Image for the mover pod used with --source=snapshot")
+	backupCmd.Flags().DurationVar(&moverTimeout, "mover-timeout", time.Hour, "Maximum time to wait for the mover pod to finish")
+	backupCmd.Flags().BoolVar(&reuseSnapshot, "reuse-snapshot", false, "Back up the existing VolumeSnapshot named by --snapshot instead of creating one")
+	backupCmd.Flags().BoolVar(&moverMode, "mover", false, "Running inside a mover pod (set by --source=snapshot)")
+	backupCmd.Flags().MarkHidden("mover")
+	backupCmd.Flags().BoolVar(&dedup, "dedup", false, "Store blocks content-addressed by SHA-256 and skip blocks already in the repository")
+	backupCmd.Flags().BoolVar(&packBlocks, "pack", false, "Aggregate blocks into large pack objects instead of one object per extent")
+	backupCmd.Flags().Int64Var(&packSize, "pack-size", pack.DefaultPackSize, "Target size of a pack object in bytes")
+	backupCmd.Flags().StringVar(&compressionCodec, "compression", compression.None, "Block compression: none, zstd or lz4")
+	backupCmd.Flags().StringVar(&encryptionKeyFile, "encryption-key-file", "", "File holding the master key; enables client-side encryption")
+	backupCmd.Flags().StringVar(&encryptionKeySecret, "encryption-key-secret", "", "Secret holding the master key as <name> or <name>/<key>; enables client-side encryption")
+	backupCmd.Flags().IntVar(&uploadConcurrency, "concurrency", defaultUploadConcurrency, "Number of blocks read and uploaded in parallel")
+	backupCmd.Flags().Int64Var(&uploadMemory, "max-upload-memory", defaultUploadMemory, "Approximate limit in bytes on block data held in memory while uploading")
+	backupCmd.Flags().StringVar(&resumeSnapshot, "resume", "", "Resume the interrupted backup of this snapshot from its checkpoint")
+	backupCmd.Flags().DurationVar(&checkpointInterval, "checkpoint-interval", defaultCheckpointInterval, "How often upload progress is checkpointed so the backup can be resumed (0 disables)")
+	addLockFlags(backupCmd)
 	backupCmd.MarkFlagRequired("pvc")
 
+	return backupCmd
+}
+
+func newListCmd() *cobra.Command {
 	listCmd := &cobra.Command{
 		Use:   "list",
 		Short: "List available backups from S3",
 		RunE:  runList,
 	}
 
-	listCmd.Flags().StringVarP(&s3Endpoint, "s3-endpoint", "e", "minio.cbt-demo.svc.cluster.local:9000", "S3 endpoint")
-	listCmd.Flags().StringVarP(&s3AccessKey, "s3-access-key", "a", "minioadmin", "S3 access key")
-	listCmd.Flags().StringVarP(&s3SecretKey, "s3-secret-key", "k", "minioadmin123", "S3 secret key")
-	listCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "B", "snapshots", "S3 bucket name")
-	listCmd.Flags().BoolVar(&s3UseSSL, "s3-use-ssl", false, "Use SSL for S3")
+	addStorageFlags(listCmd)
 
-	rootCmd.AddCommand(backupCmd, listCmd)
+	return listCmd
+}
 
-	if err := rootCmd.Execute(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+// addStorageFlags registers the repository storage flags shared by the
+// commands that only talk to the repository
+func addStorageFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&localPath, "local-path", "", "Store the repository in this directory instead of S3")
+	cmd.Flags().StringVarP(&s3Endpoint, "s3-endpoint", "e", "minio.cbt-demo.svc.cluster.local:9000", "S3 endpoint")
+	cmd.Flags().StringVarP(&s3AccessKey, "s3-access-key", "a", "minioadmin", "S3 access key")
+	cmd.Flags().StringVarP(&s3SecretKey, "s3-secret-key", "k", "minioadmin123", "S3 secret key")
+	cmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "B", "snapshots", "S3 bucket name")
+	cmd.Flags().BoolVar(&s3UseSSL, "s3-use-ssl", false, "Use SSL for S3")
+	cmd.Flags().StringVar(&encryptionKeyFile, "encryption-key-file", "", "File holding the master key for encrypted backups")
+}
+
+// openBackend opens the repository storage: the directory given by
+// --local-path, or else the S3 bucket
+func openBackend() (storage.Backend, error) {
+	if localPath != "" {
+		return storage.NewLocal(localPath)
 	}
+	return s3.NewClient(s3.Config{
+		Endpoint:  s3Endpoint,
+		AccessKey: s3AccessKey,
+		SecretKey: s3SecretKey,
+		Bucket:    s3Bucket,
+		UseSSL:    s3UseSSL,
+	})
+}
+
+// repositoryLocation describes where the repository is stored
+func repositoryLocation() string {
+	if localPath != "" {
+		return "directory " + localPath
+	}
+	return "bucket " + s3Bucket
+}
+
+// newStorageClient opens the repository and, when --encryption-key-file is
+// set, loads the repository keys so encrypted metadata can be read
+func newStorageClient(ctx context.Context) (*storage.Client, *encryption.Keyring, error) {
+	backend, err := newBackend()
+	if err != nil {
+		return nil, nil, err
+	}
+	s3Client := storage.NewClient(backend)
+
+	masterKey, err := readMasterKey(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if masterKey == nil {
+		return s3Client, nil, nil
+	}
+
+	keyring, err := loadKeyring(ctx, s3Client, masterKey, false)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load encryption keys: %w", err)
+	}
+	s3Client.SetKeyring(keyring)
+	return s3Client, keyring, nil
 }
 
 func runBackup(cmd *cobra.Command, args []string) error {
 	ctx := context.Background()
 	startTime := time.Now()
 
+	// Flags are checked before a --source=snapshot backup is handed to its
+	// mover pod, so mistakes are reported here rather than in the pod
+	if uploadConcurrency < 1 {
+		return fmt.Errorf("--concurrency must be at least 1")
+	}
+	if blockSize < 1 {
+		return fmt.Errorf("--block-size must be positive")
+	}
+	if cbtMaxResults < 0 || cbtRetries < 0 {
+		return fmt.Errorf("--cbt-max-results and --cbt-retries cannot be negative")
+	}
+	if dedup && packBlocks {
+		return fmt.Errorf("--dedup and --pack cannot be combined")
+	}
+	if err := compression.Validate(compressionCodec); err != nil {
+		return err
+	}
+	if sourceMode == sourceSnapshot && !moverMode && encryptionKeyFile != "" {
+		return fmt.Errorf("the mover pod cannot read --encryption-key-file; use --encryption-key-secret with --source=snapshot")
+	}
+	if sourceMode == sourceSnapshot && !moverMode && s3CredentialsSecret == "" &&
+		(cmd.Flags().Changed("s3-access-key") || cmd.Flags().Changed("s3-secret-key")) {
+		return fmt.Errorf("the mover pod spec would hold the S3 credentials in plaintext; use --s3-credentials-secret with --source=snapshot")
+	}
+	if sourceMode == sourceSnapshot && !moverMode && localPath != "" {
+		return fmt.Errorf("the mover pod cannot reach --local-path; use an S3 repository with --source=snapshot")
+	}
+
+	switch sourceMode {
+	case sourceDevice:
+	case sourceSnapshot:
+		if !moverMode {
+			return runSnapshotSourceBackup(ctx, cmd)
+		}
+	default:
+		return fmt.Errorf("invalid --source %q (must be %s or %s)", sourceMode, sourceDevice, sourceSnapshot)
+	}
+	if moverMode {
+		readMoverCredentials()
+	}
+
+	if resumeSnapshot != "" {
+		// A resumed backup continues against the VolumeSnapshot it started with
+		if snapshotName != "" && snapshotName != resumeSnapshot {
+			return fmt.Errorf("--snapshot %s does not match --resume %s", snapshotName, resumeSnapshot)
+		}
+		snapshotName = resumeSnapshot
+		reuseSnapshot = true
+	}
+	if reuseSnapshot && snapshotName == "" {
+		return fmt.Errorf("--reuse-snapshot requires --snapshot")
+	}
+
 	fmt.Println("========================================")
 	fmt.Println("Kubernetes CBT Backup Tool")
 	fmt.Println("========================================")
 	fmt.Printf("PVC: %s/%s\n", namespace, pvcName)
-	if baseSnapshotName != "" {
+	if resumeSnapshot != "" {
+		fmt.Printf("Mode: Resume (snapshot: %s)\n", resumeSnapshot)
+	} else if baseSnapshotName != "" {
 		fmt.Printf("Mode: Incremental (base: %s)\n", baseSnapshotName)
 	} else {
 		fmt.Println("Mode: Full Backup")
@@ -101,34 +281,92 @@ func runBackup(cmd *cobra.Command, args []string) error {
 
 	// Initialize snapshot manager
 	fmt.Println("\n[1/8] Initializing Kubernetes client...")
-	snapMgr, err := snapshot.NewManager(namespace, kubeconfig)
+	snapMgr, err := newSnapshotManager(namespace, kubeconfig)
 	if err != nil {
 		return fmt.Errorf("failed to create snapshot manager: %w", err)
 	}
 
-	// Initialize S3 client
-	fmt.Println("[2/8] Connecting to S3 storage...")
-	s3Client, err := s3.NewClient(s3.Config{
-		Endpoint:  s3Endpoint,
-		AccessKey: s3AccessKey,
-		SecretKey: s3SecretKey,
-		Bucket:    s3Bucket,
-		UseSSL:    s3UseSSL,
-	})
+	// Initialize repository storage
+	fmt.Println("[2/8] Connecting to repository storage...")
+	backend, err := newBackend()
+	if err != nil {
+		return fmt.Errorf("failed to open repository: %w", err)
+	}
+	s3Client := storage.NewClient(backend)
+
+	if err := s3Client.Init(ctx); err != nil {
+		return fmt.Errorf("failed to initialize repository: %w", err)
+	}
+	fmt.Printf("✓ Connected to repository (%s)\n", repositoryLocation())
+
+	masterKey, err := readMasterKey(ctx, snapMgr)
+	if err != nil {
+		return err
+	}
+	var keyring *encryption.Keyring
+	if masterKey != nil {
+		keyring, err = loadKeyring(ctx, s3Client, masterKey, true)
+		if err != nil {
+			return fmt.Errorf("failed to load encryption keys: %w", err)
+		}
+		s3Client.SetKeyring(keyring)
+		fmt.Printf("✓ Client-side encryption enabled (key: %s)\n", keyring.ActiveKeyID())
+	}
+
+	repoLock, lockCtx, err := lockRepository(ctx, s3Client, false, "backup")
 	if err != nil {
-		return fmt.Errorf("failed to create S3 client: %w", err)
+		return err
+	}
+	defer unlockRepository(repoLock)
+	ctx = lockCtx
+
+	var ckpt *metadata.BackupCheckpoint
+	if resumeSnapshot != "" {
+		ckpt, err = loadCheckpoint(ctx, s3Client, keyring, resumeSnapshot)
+		if err != nil {
+			return err
+		}
+		if baseSnapshotName != "" && baseSnapshotName != ckpt.Manifest.BaseSnapshotName {
+			return fmt.Errorf("--base-snapshot %s does not match the base %q the backup started with", baseSnapshotName, ckpt.Manifest.BaseSnapshotName)
+		}
+		baseSnapshotName = ckpt.Manifest.BaseSnapshotName
+		blockSize = ckpt.Manifest.BlockSize
+		fmt.Printf("✓ Loaded checkpoint: %s\n", checkpointPath(resumeSnapshot))
 	}
 
-	if err := s3Client.EnsureBucket(ctx); err != nil {
-		return fmt.Errorf("failed to ensure bucket: %w", err)
+	// An incremental is only restorable if its base is; refuse a base that
+	// was never committed or holds no block data
+	cbtBaseSnapshot := baseSnapshotName
+	if baseSnapshotName != "" {
+		var baseManifest metadata.SnapshotManifest
+		if err := s3Client.DownloadJSON(ctx, fmt.Sprintf("metadata/%s/manifest.json", baseSnapshotName), &baseManifest); err != nil {
+			return fmt.Errorf("failed to load base snapshot %s: %w", baseSnapshotName, err)
+		}
+		if !baseManifest.Restorable() {
+			return fmt.Errorf("base snapshot %s is not a completed backup (state %s)", baseSnapshotName, baseManifest.State)
+		}
+
+		// A consolidated base is a repository-only backup; CBT compares
+		// against the VolumeSnapshot it was built from
+		if baseManifest.SnapshotName != "" {
+			cbtBaseSnapshot = baseManifest.SnapshotName
+		}
 	}
-	fmt.Printf("✓ Connected to S3 (bucket: %s)\n", s3Bucket)
 
 	// Create VolumeSnapshot
 	fmt.Println("\n[3/8] Creating VolumeSnapshot...")
-	snap, err := snapMgr.CreateSnapshot(ctx, pvcName, snapshotName, snapshotClass)
-	if err != nil {
-		return fmt.Errorf("failed to create snapshot: %w", err)
+	var snap *snapshotv1.VolumeSnapshot
+	if reuseSnapshot {
+		snap, err = snapMgr.GetSnapshot(ctx, snapshotName)
+		if err != nil {
+			return fmt.Errorf("failed to get snapshot %s: %w", snapshotName, err)
+		}
+		fmt.Printf("Using existing VolumeSnapshot: %s\n", snap.Name)
+	} else {
+		snap, err = snapMgr.CreateSnapshot(ctx, pvcName, snapshotName, snapshotClass)
+		if err != nil {
+			return fmt.Errorf("failed to create snapshot: %w", err)
+		}
 	}
 
 	// Wait for snapshot to be ready
@@ -138,6 +376,15 @@ func runBackup(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("failed to wait for snapshot: %w", err)
 	}
 
+	// The CSI driver selects the SnapshotMetadataService to query. Without
+	// it, discovery falls back to the only service in the cluster, and
+	// --cbt-endpoint needs no service at all.
+	csiDriver, err := snapMgr.GetCSIDriver(ctx, pvcName)
+	if err != nil {
+		fmt.Printf("  Warning: failed to resolve CSI driver: %v\n", err)
+		csiDriver = ""
+	}
+
 	// Create manifest
 	manifest := metadata.SnapshotManifest{
 		Name:              snap.Name,
@@ -151,109 +398,208 @@ func runBackup(cmd *cobra.Command, args []string) error {
 		BlockSize:         blockSize,
 		SnapshotClassName: snapshotClass,
 		VolumeMode:        "Block",
-		CSIDriver:         "hostpath.csi.k8s.io",
+		CSIDriver:         csiDriver,
+		DataSource:        sourceDevice,
+		BlockLayout:       metadata.LayoutPerSnapshot,
+		Compression:       compressionCodec,
+	}
+	if keyring != nil {
+		manifest.Cipher = encryption.Algorithm
+		manifest.KeyID = keyring.ActiveKeyID()
+	}
+	switch {
+	case dedup:
+		manifest.BlockLayout = metadata.LayoutContentAddressed
+	case packBlocks:
+		manifest.BlockLayout = metadata.LayoutPacked
+	}
+	if moverMode {
+		manifest.DataSource = sourceSnapshot
+	}
+	if ckpt != nil {
+		// Layout, compression and key were fixed when the backup started
+		manifest = ckpt.Manifest
 	}
 
 	fmt.Printf("✓ Snapshot ready: %s (size: %d bytes)\n", snap.Name, manifest.VolumeSize)
 
-	// Initialize CBT client
-	fmt.Println("\n[5/8] Analyzing blocks to backup using CBT...")
-	cbtClient, err := metadata.NewCBTClient(namespace, kubeconfig, serviceAccountName)
-	if err != nil {
-		return fmt.Errorf("failed to create CBT client: %w", err)
+	// Extents are uploaded while they are still being listed, so the block
+	// list and its totals are only known once the upload is done
+	var (
+		source          extentSource
+		cbtClient       *metadata.CBTClient // nil unless CBT is still listing
+		cbtEnabled      bool
+		resumed, stored []blocks.BlockMetadata
+		listedThrough   int64
+	)
+	if ckpt != nil {
+		// The extents listed by the interrupted attempt come first; listing
+		// continues where it stopped
+		fmt.Println("\n[5/8] Resuming from checkpoint...")
+		cbtEnabled = ckpt.CBTEnabled
+		resumed, stored, err = checkpointExtents(ctx, s3Client, ckpt)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("✓ Checkpoint lists %d extents, %d already uploaded (saved %s)\n",
+			len(resumed), len(stored), ckpt.Updated.Format(time.RFC3339))
+
+		source = sliceExtents(resumed)
+		listedThrough = ckpt.ListedThrough
+		if ckpt.ListingIncomplete {
+			fmt.Printf("  Listing continues from offset %d\n", ckpt.ListedThrough)
+			var more extentSource
+			if cbtEnabled {
+				more, cbtClient, err = listExtents(ctx, &manifest, cbtBaseSnapshot, ckpt.ListedThrough, true)
+				if err != nil {
+					return err
+				}
+				defer cbtClient.Close()
+			} else {
+				more, err = scanExtents(ckpt.ListedThrough)
+				if err != nil {
+					return err
+				}
+			}
+			source = concatExtents(source, more)
+		}
+	} else {
+		fmt.Println("\n[5/8] Analyzing blocks to backup using CBT...")
+		source, cbtClient, err = listExtents(ctx, &manifest, cbtBaseSnapshot, 0, false)
+		if err != nil {
+			return err
+		}
+		if cbtClient != nil {
+			defer cbtClient.Close()
+		}
+		cbtEnabled = cbtClient != nil
 	}
-	defer cbtClient.Close()
 
-	if cbtEndpoint != "" {
-		cbtClient.SetEndpoint(cbtEndpoint)
+	// Mark the backup as started; until the manifest is rewritten with its
+	// final state, list and restore ignore it
+	manifestPath := fmt.Sprintf("metadata/%s/manifest.json", snap.Name)
+	manifest.State = metadata.StateInProgress
+	if err := s3Client.UploadJSON(ctx, manifestPath, manifest); err != nil {
+		return fmt.Errorf("failed to upload manifest: %w", err)
 	}
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		manifest.State = metadata.StateFailed
+		if err := s3Client.UploadJSON(ctx, manifestPath, manifest); err != nil {
+			fmt.Printf("Warning: Failed to mark backup as failed: %v\n", err)
+		}
+	}()
 
-	// Try to connect to CSI driver
-	fmt.Println("Connecting to CSI driver...")
-	connectErr := cbtClient.Connect(ctx)
+	// Upload block data to the repository
+	fmt.Println("\n[6/8] Uploading block data to the repository...")
 
-	var blockList metadata.BlockList
-	var cbtEnabled bool
+	store, err := newBlockStore(ctx, s3Client, &manifest, keyring)
+	if err != nil {
+		return err
+	}
 
-	if connectErr != nil {
-		// CBT not available - fall back to full device scan
-		fmt.Printf("⚠ CBT not available: %v\n", connectErr)
-		cbtEnabled = false
+	list := &metadata.BlockListWriter{}
+	segmentRun := 0 // run whose segments hold the entries list has written out
+	if devicePath != "" {
+		reader, err := blocks.NewReader(devicePath, blockSize)
+		if err != nil {
+			return fmt.Errorf("failed to open device for reading: %w", err)
+		}
+		defer reader.Close()
 
-		if devicePath != "" {
-			// Scan device for non-zero blocks (fallback when CBT is unavailable)
-			fmt.Println("  Falling back to full device scan for non-zero blocks...")
-			allocatedBlocks, scanErr := blocks.ScanNonZeroBlocks(devicePath, blockSize)
-			if scanErr != nil {
-				return fmt.Errorf("failed to scan device: %w", scanErr)
+		var checkpoint *checkpointer
+		if checkpointInterval > 0 {
+			checkpoint = newCheckpointer(s3Client, store, manifest, cbtClient, cbtEnabled, checkpointInterval)
+			if ckpt != nil {
+				// The resumed run rewrites every entry into segments of
+				// its own
+				checkpoint.state.SegmentRun = ckpt.SegmentRun + 1
 			}
-			blockList = metadata.BlockList{Blocks: allocatedBlocks}
-			fmt.Printf("✓ Found %d non-zero blocks via device scan\n", len(allocatedBlocks))
-		} else {
-			fmt.Println("  No device path specified - metadata-only backup")
-			blockList = metadata.BlockList{Blocks: []blocks.BlockMetadata{}}
+			segmentRun = checkpoint.state.SegmentRun
 		}
-	} else {
-		cbtEnabled = true
-
-		// Determine which blocks to backup
-		var allocatedBlocks []blocks.BlockMetadata
+		progress := newUploadProgress(store, list, listedThrough, checkpoint)
 
-		if baseSnapshotName != "" {
-			// Incremental backup - get changed blocks
-			fmt.Printf("Getting changed blocks between %s and %s...\n", baseSnapshotName, snap.Name)
-			allocatedBlocks, err = cbtClient.GetDeltaBlocks(ctx, baseSnapshotName, snap.Name)
-			if err != nil {
-				return fmt.Errorf("failed to get delta blocks: %w", err)
+		opts := uploadOptions{
+			Workers:     uploadConcurrency,
+			MemoryLimit: uploadMemory,
+		}
+		if ckpt != nil {
+			if store.packs != nil {
+				store.packs.StartAt(ckpt.NextPack)
 			}
-			fmt.Printf("✓ Found %d changed blocks\n", len(allocatedBlocks))
-		} else {
-			// Full backup - get all allocated blocks
-			fmt.Printf("Getting allocated blocks for %s...\n", snap.Name)
-			allocatedBlocks, err = cbtClient.GetAllocatedBlocks(ctx, snap.Name)
+			opts.Done, err = resumeUploads(ctx, s3Client, store, ckpt, resumed, stored)
 			if err != nil {
-				return fmt.Errorf("failed to get allocated blocks: %w", err)
+				return err
 			}
-			fmt.Printf("✓ Found %d allocated blocks\n", len(allocatedBlocks))
+		} else if err := progress.save(ctx); err != nil {
+			// Record the backup before uploading so even an early failure
+			// can be resumed
+			return err
 		}
 
-		blockList = metadata.BlockList{Blocks: allocatedBlocks}
+		fmt.Printf("  Uploading with %d workers (memory limit %.0f MB)\n", uploadConcurrency, float64(uploadMemory)/(1024*1024))
+		if err := uploadBlocks(ctx, reader, store, source, progress, opts); err != nil {
+			if checkpoint != nil {
+				fmt.Printf("Backup interrupted; continue it with --resume %s\n", snap.Name)
+			}
+			return err
+		}
 
-		// Calculate total allocated size
-		var allocatedSize int64
-		for _, block := range allocatedBlocks {
-			allocatedSize += block.Size
+		if err := store.flush(ctx); err != nil {
+			return err
 		}
 
-		fmt.Printf("Total allocated size: %d bytes (%.2f MB)\n", allocatedSize, float64(allocatedSize)/(1024*1024))
-		fmt.Printf("Volume size: %d bytes (%.2f MB)\n", manifest.VolumeSize, float64(manifest.VolumeSize)/(1024*1024))
-		if manifest.VolumeSize > 0 {
-			savingsPercent := 100.0 * (1.0 - float64(allocatedSize)/float64(manifest.VolumeSize))
-			fmt.Printf("Data transfer savings: %.2f%%\n", savingsPercent)
+		if list.Len() == 0 {
+			fmt.Println("No blocks to upload")
+		} else {
+			fmt.Printf("✓ Uploaded %d blocks (%d bytes) to the repository\n", store.blocksUploaded, store.bytesUploaded)
+		}
+		if store.blocksSkipped > 0 {
+			fmt.Printf("✓ Skipped %d blocks already in the repository\n", store.blocksSkipped)
+		}
+	} else {
+		// Without a device only the block list is recorded
+		for e, err := range source(ctx) {
+			if err != nil {
+				return fmt.Errorf("failed to list extents: %w", err)
+			}
+			if err := list.Add(e); err != nil {
+				return err
+			}
+		}
+
+		if list.Len() > 0 {
+			fmt.Println("⚠ No device path specified - skipping block data upload")
+			fmt.Println("  Use --device to specify block device path for full backup")
+		} else {
+			fmt.Println("No blocks to upload")
 		}
 	}
 
-	manifest.TotalBlocks = len(blockList.Blocks)
+	manifest.TotalBlocks = list.Len()
+	manifest.TotalSize = list.TotalSize()
+	recordListing(&manifest, cbtClient)
+	if cbtEnabled {
+		printListingSummary(list, manifest.VolumeSize)
+	}
 
-	// Calculate total size from blocks
-	var totalSize int64
-	for _, block := range blockList.Blocks {
-		totalSize += block.Size
+	if manifest.Compression != compression.None {
+		manifest.CompressedSize = store.bytesUploaded
 	}
-	manifest.TotalSize = totalSize
 
-	// Upload metadata to S3
-	fmt.Println("\n[6/8] Uploading backup metadata to S3...")
+	// Upload metadata after the block data so it can record per-block
+	// digests, storage locations and compressed sizes
+	fmt.Println("\n[7/8] Uploading backup metadata to the repository...")
 
-	// Upload manifest
-	manifestPath := fmt.Sprintf("metadata/%s/manifest.json", snap.Name)
-	if err := s3Client.UploadJSON(ctx, manifestPath, manifest); err != nil {
-		return fmt.Errorf("failed to upload manifest: %w", err)
+	// Upload block list, joined from the segments written at checkpoints
+	blockList, err := joinBlockList(ctx, s3Client, snap.Name, segmentRun, list)
+	if err != nil {
+		return err
 	}
-	fmt.Printf("✓ Uploaded manifest: %s\n", manifestPath)
-
-	// Upload block list
-	blocksPath := fmt.Sprintf("metadata/%s/blocks.json", snap.Name)
+	blocksPath := blockListPath(snap.Name)
 	if err := s3Client.UploadJSON(ctx, blocksPath, blockList); err != nil {
 		return fmt.Errorf("failed to upload block list: %w", err)
 	}
@@ -264,10 +610,7 @@ func runBackup(cmd *cobra.Command, args []string) error {
 		SnapshotName:     snap.Name,
 		BaseSnapshotName: baseSnapshotName,
 		IsIncremental:    baseSnapshotName != "",
-		Dependencies:     []string{},
-	}
-	if baseSnapshotName != "" {
-		chain.Dependencies = append(chain.Dependencies, baseSnapshotName)
+		Dependencies:     resolveDependencies(ctx, s3Client, baseSnapshotName),
 	}
 
 	chainPath := fmt.Sprintf("metadata/%s/chain.json", snap.Name)
@@ -276,46 +619,31 @@ func runBackup(cmd *cobra.Command, args []string) error {
 	}
 	fmt.Printf("✓ Uploaded chain info: %s\n", chainPath)
 
-	// Upload block data to S3
-	fmt.Println("\n[7/8] Uploading block data to S3...")
-
-	var bytesUploaded int64
-	var blocksUploaded int
-
-	if len(blockList.Blocks) > 0 && devicePath != "" {
-		reader, err := blocks.NewReader(devicePath, blockSize)
-		if err != nil {
-			return fmt.Errorf("failed to open device for reading: %w", err)
-		}
-		defer reader.Close()
-
-		for i, blockMeta := range blockList.Blocks {
-			blockData, err := reader.ReadBlock(blockMeta.Offset, blockMeta.Size)
-			if err != nil {
-				return fmt.Errorf("failed to read block at offset %d: %w", blockMeta.Offset, err)
-			}
-
-			blockPath := fmt.Sprintf("blocks/%s/block-%d-%d", snap.Name, blockMeta.Offset, blockMeta.Size)
-			if err := s3Client.UploadBlock(ctx, blockPath, blockData.Data); err != nil {
-				return fmt.Errorf("failed to upload block at offset %d: %w", blockMeta.Offset, err)
-			}
-
-			bytesUploaded += int64(len(blockData.Data))
-			blocksUploaded++
-
-			if (i+1)%100 == 0 || i == len(blockList.Blocks)-1 {
-				fmt.Printf("  Progress: %d/%d blocks uploaded (%.2f MB)\n",
-					i+1, len(blockList.Blocks),
-					float64(bytesUploaded)/(1024*1024))
-			}
-		}
+	// Commit the backup: the manifest is rewritten with its final state only
+	// once everything it refers to is in place
+	manifest.State = metadata.StateCompleted
+	if devicePath == "" && (list.Len() > 0 || !cbtEnabled) {
+		manifest.State = metadata.StateMetadataOnly
+	}
+	if err := s3Client.UploadJSON(ctx, manifestPath, manifest); err != nil {
+		return fmt.Errorf("failed to upload manifest: %w", err)
+	}
+	committed = true
+	fmt.Printf("✓ Committed manifest: %s (%s)\n", manifestPath, manifest.State)
 
-		fmt.Printf("✓ Uploaded %d blocks (%d bytes) to S3\n", blocksUploaded, bytesUploaded)
-	} else if len(blockList.Blocks) > 0 {
-		fmt.Println("⚠ No device path specified - skipping block data upload")
-		fmt.Println("  Use --device to specify block device path for full backup")
+	// Record the snapshot in the global catalog
+	if err := updateCatalog(ctx, s3Client, func(c *metadata.Catalog) { c.Upsert(&manifest) }); err != nil {
+		fmt.Printf("Warning: Failed to update catalog: %v\n", err)
 	} else {
-		fmt.Println("No blocks to upload")
+		fmt.Printf("✓ Updated catalog: %s\n", metadata.CatalogPath)
+	}
+
+	// The backup is complete; the checkpoint is no longer needed
+	if err := s3Client.DeleteObject(ctx, checkpointPath(snap.Name)); err != nil {
+		fmt.Printf("Warning: Failed to delete checkpoint: %v\n", err)
+	}
+	if err := deleteBlockListSegments(ctx, s3Client, snap.Name); err != nil {
+		fmt.Printf("Warning: Failed to delete block list segments: %v\n", err)
 	}
 
 	// Create backup stats
@@ -327,24 +655,53 @@ func runBackup(cmd *cobra.Command, args []string) error {
 		BaseSnapshotName: baseSnapshotName,
 		CBTEnabled:       cbtEnabled,
 		BytesRead:        manifest.TotalSize,
-		BytesUploaded:    bytesUploaded,
+		BytesUploaded:    store.bytesUploaded,
 		BlocksRead:       manifest.TotalBlocks,
-		BlocksUploaded:   blocksUploaded,
+		BlocksUploaded:   store.blocksUploaded,
+		BlocksSkipped:    store.blocksSkipped,
+		CompressionRatio: store.compressionRatio(),
+	}
+	if manifest.TotalBlocks > 0 {
+		stats.AverageBlockSize = manifest.TotalSize / int64(manifest.TotalBlocks)
+	}
+	if stats.Duration.Seconds() > 0 {
+		stats.UploadThroughput = float64(store.bytesUploaded) / (1024 * 1024) / stats.Duration.Seconds()
 	}
 
 	if !cbtEnabled {
 		stats.Errors = []string{"CBT not available - metadata only backup"}
 	}
 
+	statsPath := fmt.Sprintf("metadata/%s/backup-stats.json", snap.Name)
+	if err := s3Client.UploadJSON(ctx, statsPath, stats); err != nil {
+		fmt.Printf("Warning: Failed to save backup stats: %v\n", err)
+	}
+
 	fmt.Println("\n[8/8] Backup Summary")
 	fmt.Println("========================================")
 	fmt.Printf("Snapshot Name:     %s\n", snap.Name)
 	fmt.Printf("Volume Size:       %d bytes\n", manifest.VolumeSize)
 	fmt.Printf("Blocks Backed Up:  %d\n", manifest.TotalBlocks)
-	fmt.Printf("Data Uploaded:     %d bytes\n", manifest.TotalSize)
+	fmt.Printf("Data Uploaded:     %d bytes\n", store.bytesUploaded)
+	if dedup {
+		fmt.Printf("Blocks Deduped:    %d\n", store.blocksSkipped)
+	}
+	if manifest.Compression != compression.None {
+		fmt.Printf("Compression:       %s (ratio %.2fx)\n", manifest.Compression, stats.CompressionRatio)
+	}
+	if manifest.KeyID != "" {
+		fmt.Printf("Encryption:        %s (key %s)\n", manifest.Cipher, manifest.KeyID)
+	}
 	fmt.Printf("Duration:          %s\n", stats.Duration)
 	fmt.Printf("Type:              %s\n", map[bool]string{true: "Incremental", false: "Full"}[manifest.IsIncremental])
+	if manifest.CSIDriver != "" {
+		fmt.Printf("CSI Driver:        %s\n", manifest.CSIDriver)
+	}
 	fmt.Printf("CBT Enabled:       %v\n", cbtEnabled)
+	if manifest.BlockMetadataType != "" {
+		fmt.Printf("CBT Metadata:      %s\n", manifest.BlockMetadataType)
+	}
+	fmt.Printf("Data Source:       %s\n", manifest.DataSource)
 	fmt.Println("========================================")
 
 	if cbtEnabled {
@@ -367,56 +724,43 @@ func runList(cmd *cobra.Command, args []string) error {
 	fmt.Println("Available Backups")
 	fmt.Println("========================================")
 
-	// Initialize S3 client
-	s3Client, err := s3.NewClient(s3.Config{
-		Endpoint:  s3Endpoint,
-		AccessKey: s3AccessKey,
-		SecretKey: s3SecretKey,
-		Bucket:    s3Bucket,
-		UseSSL:    s3UseSSL,
-	})
+	s3Client, _, err := newStorageClient(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to create S3 client: %w", err)
+		return fmt.Errorf("failed to open repository: %w", err)
 	}
 
-	// List all manifests
-	objects, err := s3Client.ListObjects(ctx, "metadata/")
+	catalog, err := loadCatalog(ctx, s3Client)
 	if err != nil {
-		return fmt.Errorf("failed to list objects: %w", err)
+		return err
 	}
 
-	if len(objects) == 0 {
+	if len(catalog.Snapshots) == 0 {
 		fmt.Println("No backups found.")
 		return nil
 	}
 
-	// Filter manifest files and load them
-	manifests := make(map[string]metadata.SnapshotManifest)
-	for _, obj := range objects {
-		if len(obj) > 14 && obj[len(obj)-14:] == "/manifest.json" {
-			var manifest metadata.SnapshotManifest
-			if err := s3Client.DownloadJSON(ctx, obj, &manifest); err != nil {
-				fmt.Printf("Warning: Failed to load %s: %v\n", obj, err)
-				continue
-			}
-			manifests[manifest.Name] = manifest
-		}
+	// Display snapshots grouped by PVC, oldest first
+	fmt.Printf("\nFound %d backup(s):\n\n", len(catalog.Snapshots))
+	pvcs := make([]string, 0, len(catalog.Chains))
+	for pvc := range catalog.Chains {
+		pvcs = append(pvcs, pvc)
 	}
-
-	// Display manifests
-	fmt.Printf("\nFound %d backup(s):\n\n", len(manifests))
-	for _, manifest := range manifests {
-		fmt.Printf("Snapshot: %s\n", manifest.Name)
-		fmt.Printf("  PVC:           %s\n", manifest.PVCName)
-		fmt.Printf("  Timestamp:     %s\n", manifest.Timestamp.Format(time.RFC3339))
-		fmt.Printf("  Type:          %s\n", map[bool]string{true: "Incremental", false: "Full"}[manifest.IsIncremental])
-		if manifest.BaseSnapshotName != "" {
-			fmt.Printf("  Base Snapshot: %s\n", manifest.BaseSnapshotName)
+	sort.Strings(pvcs)
+
+	for _, pvc := range pvcs {
+		for _, name := range catalog.Chains[pvc] {
+			entry, _ := catalog.Find(name)
+			fmt.Printf("Snapshot: %s\n", entry.Name)
+			fmt.Printf("  PVC:           %s\n", entry.PVCName)
+			fmt.Printf("  Timestamp:     %s\n", entry.Timestamp.Format(time.RFC3339))
+			fmt.Printf("  Type:          %s\n", map[bool]string{true: "Incremental", false: "Full"}[entry.IsIncremental])
+			if entry.BaseSnapshot != "" {
+				fmt.Printf("  Base Snapshot: %s\n", entry.BaseSnapshot)
+			}
+			fmt.Printf("  Total Blocks:  %d\n", entry.BlockCount)
+			fmt.Printf("  Total Size:    %d bytes\n", entry.TotalSize)
+			fmt.Println()
 		}
-		fmt.Printf("  Volume Size:   %d bytes\n", manifest.VolumeSize)
-		fmt.Printf("  Total Blocks:  %d\n", manifest.TotalBlocks)
-		fmt.Printf("  Total Size:    %d bytes\n", manifest.TotalSize)
-		fmt.Println()
 	}
 
 	fmt.Println("========================================")
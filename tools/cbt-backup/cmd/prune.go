@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/metadata"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/retention"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+var (
+	retentionPolicy retention.Policy
+	dryRun          bool
+)
+
+func newPruneCmd() *cobra.Command {
+	pruneCmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Delete backups that fall outside the retention policy",
+		Long: `Applies the retention policy to the snapshots of each PVC and deletes
+the ones it does not keep. A snapshot that a retained incremental depends on
+is always kept, so every retained snapshot stays restorable.
+
+Content-addressed block objects shared between snapshots are not deleted
+here; they are reclaimed by garbage collection.`,
+		RunE: runPrune,
+	}
+
+	pruneCmd.Flags().StringVarP(&pvcName, "pvc", "p", "", "Only prune snapshots of this PVC")
+	pruneCmd.Flags().IntVar(&retentionPolicy.KeepLast, "keep-last", 0, "Keep the N most recent snapshots")
+	pruneCmd.Flags().IntVar(&retentionPolicy.KeepHourly, "keep-hourly", 0, "Keep the newest snapshot of each of the last N hours")
+	pruneCmd.Flags().IntVar(&retentionPolicy.KeepDaily, "keep-daily", 0, "Keep the newest snapshot of each of the last N days")
+	pruneCmd.Flags().IntVar(&retentionPolicy.KeepWeekly, "keep-weekly", 0, "Keep the newest snapshot of each of the last N weeks")
+	pruneCmd.Flags().IntVar(&retentionPolicy.KeepMonthly, "keep-monthly", 0, "Keep the newest snapshot of each of the last N months")
+	pruneCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Print what would be deleted without deleting anything")
+	addStorageFlags(pruneCmd)
+	addLockFlags(pruneCmd)
+
+	return pruneCmd
+}
+
+func runPrune(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+
+	if retentionPolicy.Empty() {
+		return fmt.Errorf("no retention policy given; set at least one --keep-* flag")
+	}
+
+	fmt.Println("========================================")
+	fmt.Println("Pruning Backups")
+	fmt.Println("========================================")
+	if dryRun {
+		fmt.Println("Dry run: nothing will be deleted")
+	}
+
+	s3Client, _, err := newStorageClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open repository: %w", err)
+	}
+
+	repoLock, lockCtx, err := lockRepository(ctx, s3Client, !dryRun, "prune")
+	if err != nil {
+		return err
+	}
+	defer unlockRepository(repoLock)
+	ctx = lockCtx
+
+	// The manifests, not the catalog, decide what exists: a backup whose
+	// catalog update failed is committed all the same, and its bases must
+	// not be deleted
+	repo, err := loadRepository(ctx, s3Client)
+	if err != nil {
+		return err
+	}
+	var manifests []metadata.SnapshotManifest
+	for _, name := range repo.Names {
+		snap := repo.Snapshots[name]
+		for _, u := range snap.Unreadable {
+			if strings.HasPrefix(u, "manifest.json:") || strings.HasPrefix(u, "chain.json:") {
+				// Any snapshot might depend on one whose chain is unknown
+				return fmt.Errorf("metadata of %s cannot be read (%s); fix or delete it before pruning", name, u)
+			}
+		}
+		if snap.Manifest != nil {
+			manifests = append(manifests, *snap.Manifest)
+		}
+	}
+	catalog := metadata.BuildCatalog(manifests)
+
+	pvcs := make([]string, 0, len(catalog.Chains))
+	for pvc := range catalog.Chains {
+		if pvcName == "" || pvc == pvcName {
+			pvcs = append(pvcs, pvc)
+		}
+	}
+	sort.Strings(pvcs)
+
+	var doomed []string
+	for _, pvc := range pvcs {
+		var entries []metadata.CatalogEntry
+		for _, name := range catalog.Chains[pvc] {
+			if entry, ok := catalog.Find(name); ok {
+				entries = append(entries, entry)
+			}
+		}
+
+		keep := retentionPolicy.Apply(entries)
+		if err := keepDependencies(repo, keep); err != nil {
+			return err
+		}
+
+		fmt.Printf("\nPVC %s:\n", pvc)
+		for _, e := range entries {
+			if reasons, ok := keep[e.Name]; ok {
+				fmt.Printf("  keep   %s  %s (%s)\n", e.Timestamp.Format("2006-01-02 15:04:05"), e.Name, strings.Join(reasons, ", "))
+			} else {
+				fmt.Printf("  delete %s  %s\n", e.Timestamp.Format("2006-01-02 15:04:05"), e.Name)
+				doomed = append(doomed, e.Name)
+			}
+		}
+	}
+
+	if len(doomed) == 0 {
+		fmt.Println("\nNothing to prune")
+		return nil
+	}
+	if dryRun {
+		fmt.Printf("\nWould delete %d snapshot(s)\n", len(doomed))
+		return nil
+	}
+
+	// Drop the snapshots from the catalog first so nothing tries to restore
+	// a half-deleted backup. Committed snapshots the catalog is missing are
+	// added back on the way.
+	err = updateCatalog(ctx, s3Client, func(c *metadata.Catalog) {
+		for _, name := range doomed {
+			c.Remove(name)
+		}
+		for _, e := range catalog.Snapshots {
+			if _, ok := c.Find(e.Name); !ok && !slices.Contains(doomed, e.Name) {
+				fmt.Printf("  Adding %s, missing from the catalog\n", e.Name)
+				c.Upsert(repo.Snapshots[e.Name].Manifest)
+			}
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update catalog: %w", err)
+	}
+
+	var objectsDeleted int
+	for _, name := range doomed {
+		n, err := deleteSnapshotObjects(ctx, s3Client, name)
+		objectsDeleted += n
+		if err != nil {
+			return err
+		}
+		fmt.Printf("✓ Deleted %s (%d objects)\n", name, n)
+	}
+
+	fmt.Println("\n========================================")
+	fmt.Printf("Snapshots Deleted: %d\n", len(doomed))
+	fmt.Printf("Objects Deleted:   %d\n", objectsDeleted)
+	fmt.Println("========================================")
+	return nil
+}
+
+// keepDependencies adds to keep every snapshot that a kept snapshot needs for
+// restore. Dependencies come from each snapshot's chain.json; the manifest's
+// base snapshot is used when there is no chain file.
+func keepDependencies(repo *repository, keep map[string][]string) error {
+	pending := make([]string, 0, len(keep))
+	for name := range keep {
+		pending = append(pending, name)
+	}
+
+	for len(pending) > 0 {
+		name := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		var deps []string
+		if snap := repo.Snapshots[name]; snap != nil {
+			switch {
+			case snap.Chain != nil:
+				deps = snap.Chain.Dependencies
+			case snap.Manifest != nil && snap.Manifest.IsIncremental:
+				if snap.Manifest.BaseSnapshotName == "" {
+					return fmt.Errorf("cannot determine the base of incremental snapshot %s", name)
+				}
+				deps = []string{snap.Manifest.BaseSnapshotName}
+			}
+		}
+
+		for _, dep := range deps {
+			if _, ok := keep[dep]; ok {
+				continue
+			}
+			keep[dep] = []string{"base of " + name}
+			pending = append(pending, dep)
+		}
+	}
+
+	return nil
+}
+
+// deleteSnapshotObjects deletes a snapshot's metadata and block data and
+// returns the number of objects deleted. The manifest goes first so a
+// partially deleted snapshot is no longer listed.
+func deleteSnapshotObjects(ctx context.Context, s3Client *storage.Client, name string) (int, error) {
+	manifestPath := fmt.Sprintf("metadata/%s/manifest.json", name)
+	deleted := 0
+	if err := s3Client.DeleteObject(ctx, manifestPath); err != nil {
+		return deleted, err
+	}
+	deleted++
+
+	for _, prefix := range []string{fmt.Sprintf("blocks/%s/", name), fmt.Sprintf("metadata/%s/", name)} {
+		objects, err := s3Client.ListObjects(ctx, prefix)
+		if err != nil {
+			return deleted, fmt.Errorf("failed to list %s: %w", prefix, err)
+		}
+		for _, obj := range objects {
+			if obj == manifestPath {
+				continue
+			}
+			if err := s3Client.DeleteObject(ctx, obj); err != nil {
+				return deleted, err
+			}
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
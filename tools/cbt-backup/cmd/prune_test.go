@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/metadata"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/storage"
+)
+
+func TestKeepDependencies(t *testing.T) {
+	base := time.Date(2025, 1, 15, 10, 0, 0, 0, time.UTC)
+	manifest := func(name, baseName string, hours int) metadata.SnapshotManifest {
+		return metadata.SnapshotManifest{
+			Name:             name,
+			PVCName:          "data",
+			Timestamp:        base.Add(time.Duration(hours) * time.Hour),
+			IsIncremental:    baseName != "",
+			BaseSnapshotName: baseName,
+		}
+	}
+	manifests := []metadata.SnapshotManifest{
+		manifest("full-1", "", 0),
+		manifest("inc-2", "full-1", 1),
+		manifest("inc-3", "inc-2", 2),
+		manifest("consolidated", "", 3),
+		manifest("inc-4", "inc-3", 4),
+		manifest("orphan", "missing", 5),
+		manifest("unknown-base", "", 6),
+	}
+	// An incremental without a recorded base can only be resolved through
+	// its chain file
+	manifests[6].IsIncremental = true
+
+	tests := []struct {
+		name    string
+		chains  map[string][]string // chain.json dependencies by snapshot
+		keep    []string
+		want    map[string][]string
+		wantErr string
+	}{
+		{
+			name:   "chain files",
+			chains: map[string][]string{"inc-3": {"full-1", "inc-2"}},
+			keep:   []string{"inc-3"},
+			want: map[string][]string{
+				"inc-3":  {"kept"},
+				"inc-2":  {"base of inc-3"},
+				"full-1": {"base of inc-3"},
+			},
+		},
+		{
+			name:   "manifest base without chain files",
+			keep:   []string{"inc-3"},
+			chains: map[string][]string{},
+			want: map[string][]string{
+				"inc-3":  {"kept"},
+				"inc-2":  {"base of inc-3"},
+				"full-1": {"base of inc-2"},
+			},
+		},
+		{
+			name: "chain file takes precedence over the manifest",
+			// inc-4 was rebased onto the consolidated backup
+			chains: map[string][]string{"inc-4": {"consolidated"}},
+			keep:   []string{"inc-4"},
+			want: map[string][]string{
+				"inc-4":        {"kept"},
+				"consolidated": {"base of inc-4"},
+			},
+		},
+		{
+			name:   "kept dependency keeps its reasons",
+			chains: map[string][]string{"inc-2": {"full-1"}},
+			keep:   []string{"inc-2", "full-1"},
+			want: map[string][]string{
+				"inc-2":  {"kept"},
+				"full-1": {"kept"},
+			},
+		},
+		{
+			name:   "full backup",
+			chains: map[string][]string{"full-1": {}},
+			keep:   []string{"full-1"},
+			want:   map[string][]string{"full-1": {"kept"}},
+		},
+		{
+			name:   "missing base is still kept",
+			keep:   []string{"orphan"},
+			chains: map[string][]string{},
+			want: map[string][]string{
+				"orphan":  {"kept"},
+				"missing": {"base of orphan"},
+			},
+		},
+		{
+			name:    "unknown base",
+			keep:    []string{"unknown-base"},
+			chains:  map[string][]string{},
+			wantErr: "cannot determine the base of incremental snapshot unknown-base",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &repository{Snapshots: make(map[string]*repoSnapshot)}
+			for i := range manifests {
+				name := manifests[i].Name
+				snap := &repoSnapshot{Name: name, Manifest: &manifests[i]}
+				if deps, ok := tt.chains[name]; ok {
+					snap.Chain = &metadata.SnapshotChain{SnapshotName: name, Dependencies: deps}
+				}
+				repo.Snapshots[name] = snap
+				repo.Names = append(repo.Names, name)
+			}
+
+			keep := make(map[string][]string)
+			for _, name := range tt.keep {
+				keep[name] = []string{"kept"}
+			}
+
+			err := keepDependencies(repo, keep)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("keepDependencies error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("keepDependencies: %v", err)
+			}
+			if !reflect.DeepEqual(keep, tt.want) {
+				t.Errorf("keep = %v, want %v", keep, tt.want)
+			}
+		})
+	}
+}
+
+// TestPruneKeepsBasesOfKeptIncrementals prunes down to the newest snapshot
+// and checks that the chain it depends on survives while an unrelated older
+// full backup is deleted
+func TestPruneKeepsBasesOfKeptIncrementals(t *testing.T) {
+	h := newHarness(t, 1<<20)
+
+	h.cbt.setAllocated("snap-0", h.write(t, 0, 4096))
+	h.backup(t, "--snapshot=snap-0")
+	h.cbt.setAllocated("snap-1", h.write(t, 8192, 4096))
+	h.backup(t, "--snapshot=snap-1")
+	h.cbt.setDelta("snap-1", "snap-2", h.write(t, 16384, 4096))
+	h.backup(t, "--snapshot=snap-2", "--base-snapshot=snap-1")
+	h.cbt.setDelta("snap-2", "snap-3", h.write(t, 32768, 4096))
+	h.backup(t, "--snapshot=snap-3", "--base-snapshot=snap-2")
+
+	if err := h.run(t, "prune", "--keep-last=1"); err != nil {
+		t.Fatalf("prune failed: %v", err)
+	}
+
+	ctx := context.Background()
+	client := storage.NewClient(h.repo)
+	for snap, want := range map[string]bool{"snap-0": false, "snap-1": true, "snap-2": true, "snap-3": true} {
+		exists, err := client.ObjectExists(ctx, fmt.Sprintf("metadata/%s/manifest.json", snap))
+		if err != nil {
+			t.Fatalf("failed to check %s: %v", snap, err)
+		}
+		if exists != want {
+			t.Errorf("manifest of %s exists = %v after prune, want %v", snap, exists, want)
+		}
+	}
+
+	objects, err := client.ListObjects(ctx, "blocks/snap-0/")
+	if err != nil {
+		t.Fatalf("failed to list blocks: %v", err)
+	}
+	if len(objects) != 0 {
+		t.Errorf("pruned snap-0 left %d block objects", len(objects))
+	}
+	if err := h.run(t, "check"); err != nil {
+		t.Errorf("check after prune failed: %v", err)
+	}
+}
+
+// TestPruneSeesSnapshotsMissingFromCatalog prunes a repository whose newest
+// backup, an incremental, never made it into the catalog, and checks that
+// it and its base are kept
+func TestPruneSeesSnapshotsMissingFromCatalog(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t, 1<<20)
+	client := storage.NewClient(h.repo)
+
+	h.cbt.setAllocated("snap-1", h.write(t, 0, 4096))
+	h.backup(t, "--snapshot=snap-1")
+	h.cbt.setAllocated("snap-2", h.write(t, 8192, 4096))
+	h.backup(t, "--snapshot=snap-2")
+	h.cbt.setDelta("snap-1", "snap-3", h.write(t, 16384, 4096))
+	h.backup(t, "--snapshot=snap-3", "--base-snapshot=snap-1")
+
+	// As if the catalog update of snap-3 had failed
+	err := updateCatalog(ctx, client, func(c *metadata.Catalog) { c.Remove("snap-3") })
+	if err != nil {
+		t.Fatalf("failed to update catalog: %v", err)
+	}
+
+	if err := h.run(t, "prune", "--keep-last=1"); err != nil {
+		t.Fatalf("prune failed: %v", err)
+	}
+
+	for snap, want := range map[string]bool{"snap-1": true, "snap-2": false, "snap-3": true} {
+		exists, err := client.ObjectExists(ctx, fmt.Sprintf("metadata/%s/manifest.json", snap))
+		if err != nil {
+			t.Fatalf("failed to check %s: %v", snap, err)
+		}
+		if exists != want {
+			t.Errorf("manifest of %s exists = %v after prune, want %v", snap, exists, want)
+		}
+	}
+
+	catalog := metadata.NewCatalog()
+	if err := client.DownloadJSON(ctx, metadata.CatalogPath, catalog); err != nil {
+		t.Fatalf("failed to read catalog: %v", err)
+	}
+	if _, ok := catalog.Find("snap-3"); !ok {
+		t.Error("prune did not add the missing snapshot back to the catalog")
+	}
+	if err := h.run(t, "check"); err != nil {
+		t.Errorf("check after prune failed: %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/blocks"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/metadata"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/storage"
+)
+
+// repoSnapshot is everything the bucket holds about one snapshot. Metadata
+// objects that are missing are nil; the ones that exist but cannot be read
+// are recorded in Unreadable.
+type repoSnapshot struct {
+	Name       string
+	Manifest   *metadata.SnapshotManifest
+	Blocks     *metadata.BlockList
+	Chain      *metadata.SnapshotChain
+	Checkpoint *metadata.BackupCheckpoint
+	Segments   []blocks.BlockMetadata // Entries of the block list segments of every run of an unfinished backup
+	Unreadable []string
+}
+
+// repository is the metadata of every snapshot in the bucket
+type repository struct {
+	Snapshots map[string]*repoSnapshot
+	Names     []string // Sorted snapshot names
+}
+
+// loadRepository reads the metadata of every snapshot under metadata/
+func loadRepository(ctx context.Context, s3Client *storage.Client) (*repository, error) {
+	objects, err := s3Client.ListObjects(ctx, "metadata/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	repo := &repository{Snapshots: make(map[string]*repoSnapshot)}
+	for _, obj := range objects {
+		// metadata/<snapshot>/<file> or metadata/<snapshot>/segments/<file>;
+		// the catalog sits directly under metadata/
+		parts := strings.Split(obj, "/")
+		segment := len(parts) == 4 && parts[2] == "segments"
+		if len(parts) != 3 && !segment {
+			continue
+		}
+		name, file := parts[1], strings.Join(parts[2:], "/")
+
+		snap := repo.Snapshots[name]
+		if snap == nil {
+			snap = &repoSnapshot{Name: name}
+			repo.Snapshots[name] = snap
+			repo.Names = append(repo.Names, name)
+		}
+
+		if segment {
+			var list metadata.BlockList
+			if err := s3Client.DownloadJSON(ctx, obj, &list); err != nil {
+				snap.Unreadable = append(snap.Unreadable, fmt.Sprintf("%s: %v", file, err))
+				continue
+			}
+			snap.Segments = append(snap.Segments, list.Blocks...)
+			continue
+		}
+
+		var target interface{}
+		switch file {
+		case "manifest.json":
+			snap.Manifest = &metadata.SnapshotManifest{}
+			target = snap.Manifest
+		case "blocks.json":
+			snap.Blocks = &metadata.BlockList{}
+			target = snap.Blocks
+		case "chain.json":
+			snap.Chain = &metadata.SnapshotChain{}
+			target = snap.Chain
+		case "checkpoint.json":
+			snap.Checkpoint = &metadata.BackupCheckpoint{}
+			target = snap.Checkpoint
+		default:
+			continue
+		}
+
+		if err := s3Client.DownloadJSON(ctx, obj, target); err != nil {
+			snap.Unreadable = append(snap.Unreadable, fmt.Sprintf("%s: %v", file, err))
+			switch file {
+			case "manifest.json":
+				snap.Manifest = nil
+			case "blocks.json":
+				snap.Blocks = nil
+			case "chain.json":
+				snap.Chain = nil
+			case "checkpoint.json":
+				snap.Checkpoint = nil
+			}
+		}
+	}
+
+	sort.Strings(repo.Names)
+	return repo, nil
+}
+
+// referencedObjects returns every block object that the block list of a
+// committed snapshot, or the block list segments and checkpoint of an
+// unfinished backup, points at.
+// Unfinished backups also claim their whole blocks/<snapshot>/ prefix, as a
+// resumed backup may still reference objects uploaded after its last
+// checkpoint; those prefixes are returned separately.
+func (r *repository) referencedObjects() (map[string]bool, []string) {
+	referenced := make(map[string]bool)
+	var claimed []string
+
+	for _, name := range r.Names {
+		snap := r.Snapshots[name]
+		if snap.Manifest != nil && snap.Manifest.Committed() && snap.Blocks != nil {
+			for _, e := range snap.Blocks.Blocks {
+				referenced[metadata.BlockObjectPath(snap.Manifest, e)] = true
+			}
+		}
+		if !snap.unfinished() {
+			continue
+		}
+		if snap.Checkpoint != nil {
+			for _, e := range snap.Checkpoint.Uploaded {
+				referenced[metadata.BlockObjectPath(&snap.Checkpoint.Manifest, e)] = true
+			}
+			if snap.Blocks != nil {
+				for _, e := range snap.Blocks.Blocks {
+					referenced[metadata.BlockObjectPath(&snap.Checkpoint.Manifest, e)] = true
+				}
+			}
+			for _, e := range snap.Segments {
+				referenced[metadata.BlockObjectPath(&snap.Checkpoint.Manifest, e)] = true
+			}
+		}
+		claimed = append(claimed, fmt.Sprintf("blocks/%s/", name))
+	}
+
+	return referenced, claimed
+}
+
+// unfinished reports whether the snapshot's backup is still running or may
+// be resumed: it is in progress, or it stopped without committing and left a
+// checkpoint
+func (s *repoSnapshot) unfinished() bool {
+	if s.Manifest != nil {
+		if s.Manifest.Committed() {
+			return false
+		}
+		if s.Manifest.State == metadata.StateInProgress {
+			return true
+		}
+	}
+	return s.Checkpoint != nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/snapshot"
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// sourceDevice reads block data from the device given by --device
+	sourceDevice = "device"
+	// sourceSnapshot reads block data from a PVC provisioned from the snapshot
+	sourceSnapshot = "snapshot"
+
+	// moverDevicePath is where the snapshot PVC is attached inside the mover pod
+	moverDevicePath = "/dev/xvda"
+
+	// moverAccessKeyEnv and moverSecretKeyEnv hold the S3 credentials in the
+	// mover pod, taken from the Secret named by --s3-credentials-secret
+	moverAccessKeyEnv = "CBT_S3_ACCESS_KEY"
+	moverSecretKeyEnv = "CBT_S3_SECRET_KEY"
+)
+
+// moverLocalFlags are never passed on to the mover pod: they are handled by
+// the orchestrating process, would expose secrets in the pod spec, or name
+// files the pod cannot reach.
+var moverLocalFlags = map[string]bool{
+	"snapshot":              true,
+	"device":                true,
+	"source":                true,
+	"mover-image":           true,
+	"mover-timeout":         true,
+	"reuse-snapshot":        true,
+	"kubeconfig":            true,
+	"s3-access-key":         true,
+	"s3-secret-key":         true,
+	"s3-credentials-secret": true,
+	"encryption-key-file":   true,
+	"local-path":            true,
+}
+
+// runSnapshotSourceBackup creates the VolumeSnapshot, provisions a temporary
+// Block-mode PVC from it and runs the backup in a mover pod that reads from
+// that PVC. The uploaded data is therefore exactly the snapshot contents that
+// the CBT metadata describes, not the live device the workload is writing to.
+func runSnapshotSourceBackup(ctx context.Context, cmd *cobra.Command) error {
+	fmt.Println("========================================")
+	fmt.Println("Kubernetes CBT Backup Tool (snapshot source)")
+	fmt.Println("========================================")
+	fmt.Printf("PVC: %s/%s\n", namespace, pvcName)
+	fmt.Printf("Mover image: %s\n", moverImage)
+	fmt.Println("========================================")
+
+	fmt.Println("\n[1/5] Initializing Kubernetes client...")
+	snapMgr, err := newSnapshotManager(namespace, kubeconfig)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot manager: %w", err)
+	}
+
+	sourcePVC, err := snapMgr.GetPVC(ctx, pvcName)
+	if err != nil {
+		return fmt.Errorf("failed to get PVC %s: %w", pvcName, err)
+	}
+
+	var snap *snapshotv1.VolumeSnapshot
+	if resumeSnapshot != "" {
+		// The mover resumes the upload from the snapshot's checkpoint
+		fmt.Printf("\n[2/5] Using VolumeSnapshot %s of the interrupted backup...\n", resumeSnapshot)
+		snap, err = snapMgr.GetSnapshot(ctx, resumeSnapshot)
+		if err != nil {
+			return fmt.Errorf("failed to get snapshot %s: %w", resumeSnapshot, err)
+		}
+	} else {
+		fmt.Println("\n[2/5] Creating VolumeSnapshot...")
+		snap, err = snapMgr.CreateSnapshot(ctx, pvcName, snapshotName, snapshotClass)
+		if err != nil {
+			return fmt.Errorf("failed to create snapshot: %w", err)
+		}
+	}
+
+	snap, err = snapMgr.WaitForSnapshotReady(ctx, snap.Name, 5*time.Minute)
+	if err != nil {
+		return fmt.Errorf("failed to wait for snapshot: %w", err)
+	}
+
+	fmt.Println("\n[3/5] Provisioning PVC from snapshot...")
+	sourceName := fmt.Sprintf("%s-source", snap.Name)
+	if _, err := snapMgr.CreatePVCFromSnapshot(ctx, snap, sourcePVC, sourceName); err != nil {
+		return err
+	}
+	defer func() {
+		if err := snapMgr.DeletePVC(context.Background(), sourceName); err != nil {
+			fmt.Printf("Warning: failed to delete PVC %s: %v\n", sourceName, err)
+		} else {
+			fmt.Printf("Deleted PVC %s\n", sourceName)
+		}
+	}()
+
+	fmt.Println("\n[4/5] Running backup in mover pod...")
+	moverName := fmt.Sprintf("%s-mover", snap.Name)
+	_, err = snapMgr.CreateMoverPod(ctx, snapshot.MoverPodOptions{
+		Name:               moverName,
+		SnapshotName:       snap.Name,
+		Image:              moverImage,
+		ServiceAccountName: serviceAccountName,
+		PVCName:            sourceName,
+		DevicePath:         moverDevicePath,
+		Command:            moverCommand(cmd, snap.Name),
+		Env:                moverEnv(),
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := snapMgr.DeletePod(context.Background(), moverName); err != nil {
+			fmt.Printf("Warning: failed to delete mover pod %s: %v\n", moverName, err)
+		} else {
+			fmt.Printf("Deleted mover pod %s\n", moverName)
+		}
+	}()
+
+	moverCtx, cancel := context.WithTimeout(ctx, moverTimeout)
+	defer cancel()
+
+	if err := snapMgr.WaitForPodStarted(moverCtx, moverName, moverTimeout); err != nil {
+		return err
+	}
+
+	fmt.Println("---------------- mover output ----------------")
+	if err := snapMgr.StreamPodLogs(moverCtx, moverName, os.Stdout); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+	fmt.Println("----------------------------------------------")
+
+	if err := snapMgr.WaitForPodCompletion(moverCtx, moverName, moverTimeout); err != nil {
+		return fmt.Errorf("mover backup failed: %w", err)
+	}
+
+	fmt.Println("\n[5/5] Cleaning up mover resources...")
+	fmt.Printf("✓ Backup of snapshot %s completed from snapshot contents\n", snap.Name)
+	return nil
+}
+
+// moverCommand builds the cbt-backup invocation for the mover pod. Every flag
+// the user set is forwarded except those that only make sense for the
+// orchestrating process; the mover backs up the existing snapshot from the
+// attached PVC.
+func moverCommand(cmd *cobra.Command, snapName string) []string {
+	command := []string{"/usr/local/bin/cbt-backup", "create"}
+
+	cmd.Flags().Visit(func(f *pflag.Flag) {
+		if moverLocalFlags[f.Name] {
+			return
+		}
+		command = append(command, fmt.Sprintf("--%s=%s", f.Name, f.Value.String()))
+	})
+
+	return append(command,
+		"--snapshot="+snapName,
+		"--reuse-snapshot",
+		"--device="+moverDevicePath,
+		"--source="+sourceSnapshot,
+		"--mover",
+	)
+}
+
+// moverEnv returns the environment of the mover pod. The S3 credentials are
+// referenced from their Secret, so they never appear in the pod spec.
+func moverEnv() []corev1.EnvVar {
+	if s3CredentialsSecret == "" {
+		return nil
+	}
+	secretEnv := func(name, key string) corev1.EnvVar {
+		return corev1.EnvVar{
+			Name: name,
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: s3CredentialsSecret},
+					Key:                  key,
+				},
+			},
+		}
+	}
+	return []corev1.EnvVar{
+		secretEnv(moverAccessKeyEnv, "access-key"),
+		secretEnv(moverSecretKeyEnv, "secret-key"),
+	}
+}
+
+// readMoverCredentials takes the S3 credentials from the environment set up
+// by moverEnv, if there is one
+func readMoverCredentials() {
+	if v := os.Getenv(moverAccessKeyEnv); v != "" {
+		s3AccessKey = v
+	}
+	if v := os.Getenv(moverSecretKeyEnv); v != "" {
+		s3SecretKey = v
+	}
+}
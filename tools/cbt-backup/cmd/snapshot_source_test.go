@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMoverCommandKeepsSecretsOutOfPodSpec(t *testing.T) {
+	cmd := newBackupCmd()
+	if err := cmd.ParseFlags([]string{
+		"--pvc=" + testPVC,
+		"--source=snapshot",
+		"--s3-access-key=AKIDEXAMPLE",
+		"--s3-secret-key=hunter2",
+		"--s3-credentials-secret=s3-creds",
+		"--s3-bucket=backups",
+		"--encryption-key-secret=backup-key",
+		"--compression=zstd",
+	}); err != nil {
+		t.Fatalf("failed to parse flags: %v", err)
+	}
+
+	command := strings.Join(moverCommand(cmd, "snap-1"), " ")
+	for _, leaked := range []string{"AKIDEXAMPLE", "hunter2", "--s3-credentials-secret", "--s3-access-key", "--s3-secret-key"} {
+		if strings.Contains(command, leaked) {
+			t.Errorf("mover command %q contains %q", command, leaked)
+		}
+	}
+	for _, forwarded := range []string{"--s3-bucket=backups", "--encryption-key-secret=backup-key", "--compression=zstd", "--snapshot=snap-1", "--mover"} {
+		if !strings.Contains(command, forwarded) {
+			t.Errorf("mover command %q does not forward %q", command, forwarded)
+		}
+	}
+
+	env := moverEnv()
+	want := map[string]string{moverAccessKeyEnv: "access-key", moverSecretKeyEnv: "secret-key"}
+	if len(env) != len(want) {
+		t.Fatalf("mover env has %d variables, want %d", len(env), len(want))
+	}
+	for _, e := range env {
+		if e.Value != "" {
+			t.Errorf("mover env %s holds a plaintext value", e.Name)
+		}
+		ref := e.ValueFrom.SecretKeyRef
+		if ref == nil || ref.Name != "s3-creds" || ref.Key != want[e.Name] {
+			t.Errorf("mover env %s = %+v, want key %s of Secret s3-creds", e.Name, e.ValueFrom, want[e.Name])
+		}
+	}
+}
+
+func TestReadMoverCredentials(t *testing.T) {
+	t.Setenv(moverAccessKeyEnv, "AKIDEXAMPLE")
+	t.Setenv(moverSecretKeyEnv, "hunter2")
+
+	saved := [2]string{s3AccessKey, s3SecretKey}
+	t.Cleanup(func() { s3AccessKey, s3SecretKey = saved[0], saved[1] })
+
+	readMoverCredentials()
+	if s3AccessKey != "AKIDEXAMPLE" || s3SecretKey != "hunter2" {
+		t.Errorf("credentials = %q/%q, want the ones from the environment", s3AccessKey, s3SecretKey)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sync"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/blocks"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/compression"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/encryption"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/metadata"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/pack"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/storage"
+)
+
+// blockStore writes block data to the bucket according to the manifest's
+// layout and compression settings, and records in each block list entry
+// where and how its data was stored. put is safe for concurrent use; each
+// call must be given a different entry.
+type blockStore struct {
+	client   *storage.Client
+	manifest *metadata.SnapshotManifest
+	keyring  *encryption.Keyring
+
+	mu     sync.Mutex      // guards the fields below
+	stored map[string]bool // content-addressed object names already in the bucket or being uploaded
+	packs  *pack.Writer
+
+	blocksUploaded int
+	blocksSkipped  int
+	rawBytes       int64 // uncompressed size of uploaded blocks
+	bytesUploaded  int64 // bytes written to the bucket for uploaded blocks
+}
+
+// newBlockStore prepares a block store for the snapshot described by
+// manifest. With a keyring, stored block data is encrypted with its active key.
+func newBlockStore(ctx context.Context, client *storage.Client, manifest *metadata.SnapshotManifest, keyring *encryption.Keyring) (*blockStore, error) {
+	s := &blockStore{
+		client:   client,
+		manifest: manifest,
+		keyring:  keyring,
+	}
+
+	switch manifest.BlockLayout {
+	case metadata.LayoutContentAddressed:
+		// Blocks whose digest is already stored (by this or any earlier
+		// backup) are not uploaded again
+		objects, err := client.ListObjects(ctx, metadata.ContentAddressedPrefix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list content-addressed blocks: %w", err)
+		}
+		s.stored = make(map[string]bool, len(objects))
+		for _, obj := range objects {
+			s.stored[path.Base(obj)] = true
+		}
+		fmt.Printf("  Repository holds %d content-addressed blocks\n", len(s.stored))
+	case metadata.LayoutPacked:
+		s.packs = pack.NewWriter(client, manifest.Name, packSize)
+	}
+
+	return s, nil
+}
+
+// put stores one block and fills in the storage fields of its entry
+func (s *blockStore) put(ctx context.Context, entry *blocks.BlockMetadata, block *blocks.BlockData) error {
+	// Recorded for every layout so the restore can verify the data
+	entry.Checksum = block.Checksum
+
+	var contentID string
+	if s.manifest.BlockLayout == metadata.LayoutContentAddressed {
+		// Encrypted repositories name objects by a keyed digest so that
+		// object names do not reveal plaintext hashes
+		contentID = block.Checksum
+		if s.keyring != nil {
+			id, err := s.keyring.ContentID(block.Data)
+			if err != nil {
+				return err
+			}
+			contentID = id
+		}
+
+		// Reuse an existing copy, preferring one in the requested codec
+		s.mu.Lock()
+		for _, codec := range []string{s.manifest.Compression, ""} {
+			if codec == compression.None {
+				continue
+			}
+			if s.stored[path.Base(metadata.ContentAddressedPath(contentID, codec))] {
+				s.skip(entry, contentID, codec)
+				s.mu.Unlock()
+				return nil
+			}
+		}
+		s.mu.Unlock()
+	}
+
+	payload, codec, err := compression.Compress(s.manifest.Compression, block.Data)
+	if err != nil {
+		return fmt.Errorf("failed to compress block at offset %d: %w", entry.Offset, err)
+	}
+	entry.Compression = codec
+
+	if s.keyring != nil {
+		if contentID != "" {
+			entry.Object = metadata.ContentAddressedPath(contentID, codec)
+		}
+		payload, err = s.keyring.Encrypt(payload, metadata.BlockAssociatedData(s.manifest, *entry))
+		if err != nil {
+			return fmt.Errorf("failed to encrypt block at offset %d: %w", entry.Offset, err)
+		}
+	}
+	entry.StoredSize = int64(len(payload))
+
+	if s.packs != nil {
+		// Packs are filled one block at a time; a full pack is uploaded
+		// while the lock is held
+		s.mu.Lock()
+		loc, err := s.packs.Add(ctx, payload)
+		s.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed to pack block at offset %d: %w", entry.Offset, err)
+		}
+		entry.Object = loc.Object
+		entry.ObjectOffset = loc.Offset
+	} else {
+		blockPath := metadata.BlockObjectPath(s.manifest, *entry)
+		if s.stored != nil {
+			// Another worker may have stored the same content meanwhile.
+			// The name is claimed before uploading; if the upload fails
+			// the whole backup fails with it.
+			s.mu.Lock()
+			if s.stored[path.Base(blockPath)] {
+				s.skip(entry, contentID, codec)
+				s.mu.Unlock()
+				return nil
+			}
+			s.stored[path.Base(blockPath)] = true
+			s.mu.Unlock()
+		}
+		if err := s.client.UploadBlock(ctx, blockPath, payload); err != nil {
+			return fmt.Errorf("failed to upload block at offset %d: %w", entry.Offset, err)
+		}
+	}
+
+	s.mu.Lock()
+	s.blocksUploaded++
+	s.rawBytes += int64(len(block.Data))
+	s.bytesUploaded += int64(len(payload))
+	s.mu.Unlock()
+	return nil
+}
+
+// skip points entry at the stored content-addressed copy of its data. The
+// caller holds s.mu.
+func (s *blockStore) skip(entry *blocks.BlockMetadata, contentID, codec string) {
+	entry.Compression = codec
+	entry.StoredSize = 0
+	entry.Object = ""
+	if s.keyring != nil {
+		entry.Object = metadata.ContentAddressedPath(contentID, codec)
+	}
+	s.blocksSkipped++
+}
+
+// uploaded returns the number of bytes written to the bucket so far
+func (s *blockStore) uploaded() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bytesUploaded
+}
+
+// resume credits an entry stored by an earlier attempt of the same backup to
+// the store's counters
+func (s *blockStore) resume(entry blocks.BlockMetadata) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry.StoredSize == 0 {
+		s.blocksSkipped++
+		return
+	}
+	s.blocksUploaded++
+	s.rawBytes += entry.Size
+	s.bytesUploaded += entry.StoredSize
+}
+
+// sync uploads any partially filled pack so every block stored so far is
+// readable, and returns the sequence number of the next pack
+func (s *blockStore) sync(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.packs == nil {
+		return 0, nil
+	}
+	if err := s.packs.Flush(ctx); err != nil {
+		return 0, err
+	}
+	return s.packs.Next(), nil
+}
+
+// flush uploads any partially filled pack
+func (s *blockStore) flush(ctx context.Context) error {
+	if s.packs == nil {
+		return nil
+	}
+	if err := s.packs.Flush(ctx); err != nil {
+		return err
+	}
+	fmt.Printf("✓ Wrote %d pack objects\n", s.packs.PacksUploaded)
+	return nil
+}
+
+// compressionRatio returns uncompressed bytes per stored byte for the blocks
+// uploaded so far
+func (s *blockStore) compressionRatio() float64 {
+	if s.bytesUploaded == 0 {
+		return 0
+	}
+	return float64(s.rawBytes) / float64(s.bytesUploaded)
+}
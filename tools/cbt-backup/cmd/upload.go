@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/blocks"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/metadata"
+)
+
+const (
+	// defaultUploadConcurrency is the default number of upload workers
+	defaultUploadConcurrency = 4
+	// defaultUploadMemory is the default budget for block data held by the
+	// upload pipeline (256MB)
+	defaultUploadMemory = 256 * 1024 * 1024
+)
+
+// uploadOptions tunes uploadBlocks
+type uploadOptions struct {
+	Workers     int    // Blocks read and uploaded at the same time
+	MemoryLimit int64  // Bytes of block data held in flight
+	Done        []bool // Leading extents already stored by an earlier attempt, yielded with their storage fields; nil when starting afresh
+}
+
+// uploadJob is an extent handed to an upload worker
+type uploadJob struct {
+	index  int
+	entry  blocks.BlockMetadata
+	weight int64
+}
+
+// uploadBlocks reads every extent yielded by source from the device and
+// hands it to the block store, filling in the entry's storage fields. Blocks
+// are uploaded while the source is still listing, and their entries are
+// added to the block list of progress in listing order. Up to opts.Workers
+// blocks are read and uploaded at the same time, and extents are only taken
+// from the source while the data held in flight fits in opts.MemoryLimit.
+// The first error, from listing or uploading, cancels the remaining work and
+// is returned. With a checkpointer, progress is recorded periodically and
+// once more when the upload fails.
+func uploadBlocks(ctx context.Context, reader *blocks.Reader, store *blockStore, source extentSource, progress *uploadProgress, opts uploadOptions) error {
+	workers := opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	parent := ctx
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		errOnce  sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	budget := newMemoryBudget(opts.MemoryLimit)
+
+	// Each block is charged twice its size: the device data and the
+	// compressed or encrypted copy are alive at the same time
+	weight := func(e blocks.BlockMetadata) int64 {
+		size := e.Size
+		if size <= 0 {
+			size = blockSize
+		}
+		return budget.clamp(2 * size)
+	}
+
+	jobs := make(chan uploadJob)
+	go func() {
+		defer close(jobs)
+		i := 0
+		for entry, err := range source(ctx) {
+			if err != nil {
+				fail(fmt.Errorf("failed to list extents: %w", err))
+				return
+			}
+			if ctx.Err() != nil {
+				return
+			}
+
+			index := progress.add(entry)
+			resumed := i < len(opts.Done) && opts.Done[i]
+			i++
+			if resumed {
+				if err := progress.done(ctx, index, entry); err != nil {
+					fail(err)
+					return
+				}
+				continue
+			}
+
+			job := uploadJob{index: index, entry: entry, weight: weight(entry)}
+			if err := budget.acquire(ctx, job.weight); err != nil {
+				return
+			}
+			select {
+			case jobs <- job:
+			case <-ctx.Done():
+				budget.release(job.weight)
+				return
+			}
+		}
+		progress.finishListing()
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if ctx.Err() == nil {
+					if err := uploadBlock(ctx, reader, store, &job.entry); err != nil {
+						fail(err)
+					} else if err := progress.done(ctx, job.index, job.entry); err != nil {
+						fail(err)
+					}
+				}
+				budget.release(job.weight)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		if err := progress.save(parent); err != nil {
+			fmt.Printf("  Warning: %v\n", err)
+		}
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// uploadBlock reads one block from the device and stores it
+func uploadBlock(ctx context.Context, reader *blocks.Reader, store *blockStore, entry *blocks.BlockMetadata) error {
+	blockData, err := reader.ReadBlock(entry.Offset, entry.Size)
+	if err != nil {
+		return fmt.Errorf("failed to read block at offset %d: %w", entry.Offset, err)
+	}
+	return store.put(ctx, entry, blockData)
+}
+
+// memoryBudget bounds the bytes of block data held by the pipeline. acquire
+// is only called from a single goroutine.
+type memoryBudget struct {
+	mu    sync.Mutex
+	limit int64
+	used  int64
+	freed chan struct{} // signalled whenever memory is released
+}
+
+func newMemoryBudget(limit int64) *memoryBudget {
+	if limit <= 0 {
+		limit = defaultUploadMemory
+	}
+	return &memoryBudget{
+		limit: limit,
+		freed: make(chan struct{}, 1),
+	}
+}
+
+// clamp caps a request at the limit so a block larger than the budget can
+// still be processed, on its own
+func (b *memoryBudget) clamp(n int64) int64 {
+	if n > b.limit {
+		return b.limit
+	}
+	return n
+}
+
+// acquire waits until n bytes fit in the budget or ctx is cancelled
+func (b *memoryBudget) acquire(ctx context.Context, n int64) error {
+	for {
+		b.mu.Lock()
+		if b.used+n <= b.limit {
+			b.used += n
+			b.mu.Unlock()
+			return nil
+		}
+		b.mu.Unlock()
+
+		select {
+		case <-b.freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release returns n bytes to the budget
+func (b *memoryBudget) release(n int64) {
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+
+	select {
+	case b.freed <- struct{}{}:
+	default:
+	}
+}
+
+// uploadProgress tracks the extents of a backup from the moment they are
+// listed until their entries are final. Blocks complete out of order; an
+// entry is added to the block list, and its pending record dropped, once
+// every extent listed before it has completed, so the block list only ever
+// grows in listing order.
+type uploadProgress struct {
+	mu            sync.Mutex
+	store         *blockStore
+	list          *metadata.BlockListWriter
+	pending       []pendingExtent // extents listed after the last entry of list, in order
+	base          int             // index of pending[0] in listing order
+	listedThrough int64           // end of the last extent listed
+	listingDone   bool
+	checkpoint    *checkpointer
+	saving        chan struct{} // held while a checkpoint is saved
+}
+
+// pendingExtent is a listed extent whose entry is not in the block list yet
+type pendingExtent struct {
+	extent   blocks.BlockMetadata // as listed, without storage fields
+	entry    blocks.BlockMetadata // with storage fields, once stored
+	finished bool
+}
+
+// newUploadProgress returns the progress of a backup that adds its entries
+// to list. listedThrough is where listing starts; listing is taken to be
+// incomplete until finishListing is called.
+func newUploadProgress(store *blockStore, list *metadata.BlockListWriter, listedThrough int64, checkpoint *checkpointer) *uploadProgress {
+	return &uploadProgress{
+		store:         store,
+		list:          list,
+		listedThrough: listedThrough,
+		checkpoint:    checkpoint,
+		saving:        make(chan struct{}, 1),
+	}
+}
+
+// add records a listed extent and returns its index in listing order
+func (p *uploadProgress) add(e blocks.BlockMetadata) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pending = append(p.pending, pendingExtent{
+		extent: blocks.BlockMetadata{Offset: e.Offset, Size: e.Size},
+	})
+	p.listedThrough = e.Offset + e.Size
+	return p.base + len(p.pending) - 1
+}
+
+// finishListing records that every extent has been listed
+func (p *uploadProgress) finishListing() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.listingDone = true
+}
+
+// done marks extent i as stored with entry, adds the entries that have
+// become final to the block list, prints progress every 100 blocks and saves
+// a checkpoint when one is due and none is being saved. A failed checkpoint
+// does not fail the backup; it only means a resumed backup uploads more
+// again.
+func (p *uploadProgress) done(ctx context.Context, i int, entry blocks.BlockMetadata) error {
+	p.mu.Lock()
+	err := p.finishLocked(i, entry)
+	p.mu.Unlock()
+	if err != nil || p.checkpoint == nil {
+		return err
+	}
+
+	select {
+	case p.saving <- struct{}{}:
+	default:
+		return nil
+	}
+	defer func() { <-p.saving }()
+
+	if p.checkpoint.due() {
+		if err := p.checkpointHeld(ctx); err != nil {
+			fmt.Printf("  Warning: %v\n", err)
+		}
+	}
+	return nil
+}
+
+// finishLocked records the entry of extent i and moves the entries that have
+// become final to the block list
+func (p *uploadProgress) finishLocked(i int, entry blocks.BlockMetadata) error {
+	p.pending[i-p.base].entry = entry
+	p.pending[i-p.base].finished = true
+	for len(p.pending) > 0 && p.pending[0].finished {
+		if err := p.list.Add(p.pending[0].entry); err != nil {
+			return err
+		}
+		p.pending[0] = pendingExtent{}
+		p.pending = p.pending[1:]
+		p.base++
+
+		if p.base%100 == 0 {
+			fmt.Printf("  Progress: %d blocks processed, %d listed (%.2f MB uploaded)\n",
+				p.base, p.base+len(p.pending),
+				float64(p.store.uploaded())/(1024*1024))
+		}
+	}
+	return nil
+}
+
+// save records a checkpoint, if the upload has a checkpointer, after
+// waiting for one being saved to finish
+func (p *uploadProgress) save(ctx context.Context) error {
+	if p.checkpoint == nil {
+		return nil
+	}
+
+	select {
+	case p.saving <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-p.saving }()
+
+	return p.checkpointHeld(ctx)
+}
+
+// checkpointHeld records a checkpoint while the caller holds p.saving. The
+// progress is copied under p.mu, but stored without it, so blocks keep
+// completing while the checkpoint is uploaded.
+func (p *uploadProgress) checkpointHeld(ctx context.Context) error {
+	p.mu.Lock()
+	progress := p.progressLocked()
+	p.mu.Unlock()
+
+	if err := p.checkpoint.save(ctx, progress); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.list.Flushed(progress.entries)
+	p.mu.Unlock()
+	return nil
+}
+
+// progressLocked returns what a checkpoint records: the entries of the block
+// list not in a segment yet, the extents listed after the block list and the
+// entries of those that are stored
+func (p *uploadProgress) progressLocked() checkpointProgress {
+	progress := checkpointProgress{
+		extents:           make([]blocks.BlockMetadata, 0, len(p.pending)),
+		uploaded:          make([]blocks.BlockMetadata, 0, len(p.pending)),
+		segments:          p.list.Segments(),
+		listedThrough:     p.listedThrough,
+		listingIncomplete: !p.listingDone,
+	}
+	progress.segment, progress.entries = p.list.Segment()
+	for _, e := range p.pending {
+		progress.extents = append(progress.extents, e.extent)
+		if e.finished {
+			progress.uploaded = append(progress.uploaded, e.entry)
+		}
+	}
+	return progress
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"iter"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/blocks"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/metadata"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/storage"
+)
+
+// recordingBackend records the order in which block objects are stored and
+// how many are being stored at once. A put of hold waits until every other
+// block has been stored.
+type recordingBackend struct {
+	*memoryBackend
+	hold   string
+	others int // blocks stored before hold is released
+
+	mu       sync.Mutex
+	order    []string
+	inFlight int
+	peak     int
+	stored   chan struct{}
+}
+
+func newRecordingBackend(hold string, others int) *recordingBackend {
+	return &recordingBackend{
+		memoryBackend: newMemoryBackend(),
+		hold:          hold,
+		others:        others,
+		stored:        make(chan struct{}, others),
+	}
+}
+
+func (r *recordingBackend) Put(ctx context.Context, key string, data []byte) error {
+	r.mu.Lock()
+	r.inFlight++
+	r.peak = max(r.peak, r.inFlight)
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.inFlight--
+		r.order = append(r.order, key)
+		r.mu.Unlock()
+	}()
+
+	if key == r.hold {
+		for i := 0; i < r.others; i++ {
+			select {
+			case <-r.stored:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return r.memoryBackend.Put(ctx, key, data)
+	}
+	err := r.memoryBackend.Put(ctx, key, data)
+	if r.hold != "" {
+		r.stored <- struct{}{}
+	}
+	return err
+}
+
+// sliceSource yields extents in order
+func sliceSource(extents []blocks.BlockMetadata) extentSource {
+	return func(ctx context.Context) iter.Seq2[blocks.BlockMetadata, error] {
+		return func(yield func(blocks.BlockMetadata, error) bool) {
+			for _, e := range extents {
+				if !yield(e, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// runUpload uploads extents from a zeroed volume of size bytes to backend and
+// returns the resulting block list, saving checkpoints at checkpointInterval
+// if it is set. It fails the test if the upload does not finish within a
+// minute.
+func runUpload(t *testing.T, backend storage.Backend, size int64, extents []blocks.BlockMetadata, opts uploadOptions, checkpointInterval time.Duration) []blocks.BlockMetadata {
+	t.Helper()
+
+	device := filepath.Join(t.TempDir(), "volume")
+	if err := os.WriteFile(device, make([]byte, size), 0o644); err != nil {
+		t.Fatalf("failed to create volume: %v", err)
+	}
+	reader, err := blocks.NewReader(device, blocks.DefaultBlockSize)
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	defer reader.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	manifest := &metadata.SnapshotManifest{Name: "snap-1"}
+	client := storage.NewClient(backend)
+	store, err := newBlockStore(ctx, client, manifest, nil)
+	if err != nil {
+		t.Fatalf("newBlockStore: %v", err)
+	}
+	var checkpoint *checkpointer
+	if checkpointInterval > 0 {
+		checkpoint = newCheckpointer(client, store, *manifest, nil, false, checkpointInterval)
+	}
+	list := &metadata.BlockListWriter{}
+	progress := newUploadProgress(store, list, 0, checkpoint)
+
+	if err := uploadBlocks(ctx, reader, store, sliceSource(extents), progress, opts); err != nil {
+		t.Fatalf("uploadBlocks: %v", err)
+	}
+
+	data, err := joinBlockList(ctx, client, manifest.Name, 0, list)
+	if err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+	var blockList metadata.BlockList
+	if err := json.Unmarshal(data, &blockList); err != nil {
+		t.Fatalf("failed to decode block list: %v", err)
+	}
+	return blockList.Blocks
+}
+
+// TestUploadKeepsListingOrder holds back the upload of the first extent until
+// all others have been stored and checks that the block list is still in
+// listing order
+func TestUploadKeepsListingOrder(t *testing.T) {
+	var extents []blocks.BlockMetadata
+	for i := int64(0); i < 8; i++ {
+		extents = append(extents, blocks.BlockMetadata{Offset: i * 4096, Size: 4096})
+	}
+	manifest := &metadata.SnapshotManifest{Name: "snap-1"}
+	hold := metadata.BlockObjectPath(manifest, extents[0])
+	backend := newRecordingBackend(hold, len(extents)-1)
+
+	got := runUpload(t, backend, 8*4096, extents, uploadOptions{Workers: 4}, 0)
+
+	if last := backend.order[len(backend.order)-1]; last != hold {
+		t.Fatalf("%s was stored before %s; blocks did not complete out of order", hold, last)
+	}
+	if len(got) != len(extents) {
+		t.Fatalf("block list has %d entries, want %d", len(got), len(extents))
+	}
+	for i, e := range got {
+		if e.Offset != extents[i].Offset || e.Size != extents[i].Size {
+			t.Errorf("entry %d covers %d+%d, want %d+%d", i, e.Offset, e.Size, extents[i].Offset, extents[i].Size)
+		}
+		if e.Checksum == "" {
+			t.Errorf("entry %d has no checksum", i)
+		}
+	}
+}
+
+// TestUploadExtentsLargerThanBudget uploads extents that each exceed the
+// memory budget. Each is processed on its own instead of waiting forever for
+// memory that can never be freed.
+func TestUploadExtentsLargerThanBudget(t *testing.T) {
+	const extentSize = 64 << 10
+	extents := []blocks.BlockMetadata{
+		{Offset: 0, Size: extentSize},
+		{Offset: extentSize, Size: extentSize},
+		{Offset: 2 * extentSize, Size: extentSize},
+	}
+	backend := newRecordingBackend("", 0)
+
+	got := runUpload(t, backend, 3*extentSize, extents, uploadOptions{Workers: 4, MemoryLimit: 4096}, 0)
+
+	if len(got) != len(extents) {
+		t.Fatalf("block list has %d entries, want %d", len(got), len(extents))
+	}
+	if backend.peak != 1 {
+		t.Errorf("%d oversized blocks were uploaded at once, want 1", backend.peak)
+	}
+}
+
+// checkpointBackend holds the first checkpoint until every block has been
+// stored and records how many checkpoints are uploaded at once
+type checkpointBackend struct {
+	*memoryBackend
+	checkpoint string
+	blocks     int
+	stored     chan struct{}
+
+	mu       sync.Mutex
+	held     bool
+	inFlight int
+	peak     int
+	saved    int
+}
+
+func (c *checkpointBackend) Put(ctx context.Context, key string, data []byte) error {
+	if strings.HasPrefix(key, "blocks/") {
+		err := c.memoryBackend.Put(ctx, key, data)
+		c.stored <- struct{}{}
+		return err
+	}
+	if key != c.checkpoint {
+		return c.memoryBackend.Put(ctx, key, data)
+	}
+
+	c.mu.Lock()
+	hold := !c.held
+	c.held = true
+	c.inFlight++
+	c.peak = max(c.peak, c.inFlight)
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.inFlight--
+		c.saved++
+		c.mu.Unlock()
+	}()
+
+	if hold {
+		for i := 0; i < c.blocks; i++ {
+			select {
+			case <-c.stored:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return c.memoryBackend.Put(ctx, key, data)
+}
+
+// TestCheckpointDoesNotBlockUploads holds the first checkpoint until every
+// block has been stored. Blocks complete while it is uploaded, and no other
+// checkpoint is saved until it is done.
+func TestCheckpointDoesNotBlockUploads(t *testing.T) {
+	var extents []blocks.BlockMetadata
+	for i := int64(0); i < 8; i++ {
+		extents = append(extents, blocks.BlockMetadata{Offset: i * 4096, Size: 4096})
+	}
+	backend := &checkpointBackend{
+		memoryBackend: newMemoryBackend(),
+		checkpoint:    checkpointPath("snap-1"),
+		blocks:        len(extents),
+		stored:        make(chan struct{}, len(extents)),
+	}
+
+	got := runUpload(t, backend, 8*4096, extents, uploadOptions{Workers: 4}, time.Nanosecond)
+
+	if len(got) != len(extents) {
+		t.Fatalf("block list has %d entries, want %d", len(got), len(extents))
+	}
+	if backend.saved == 0 {
+		t.Fatal("no checkpoint was saved")
+	}
+	if backend.peak != 1 {
+		t.Errorf("%d checkpoints were uploaded at once, want 1", backend.peak)
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	budget := newMemoryBudget(4096)
+	if got := budget.clamp(1 << 20); got != 4096 {
+		t.Fatalf("clamp = %d, want the limit", got)
+	}
+
+	ctx := context.Background()
+	if err := budget.acquire(ctx, 4096); err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+
+	// A full budget blocks until memory is released
+	acquired := make(chan error, 1)
+	go func() { acquired <- budget.acquire(ctx, 1024) }()
+	select {
+	case err := <-acquired:
+		t.Fatalf("acquire on a full budget returned %v without waiting", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	budget.release(4096)
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatalf("acquire after release: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("acquire still blocked after release")
+	}
+
+	// and gives up when its context is cancelled
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := budget.acquire(cancelled, 4096); err == nil {
+		t.Error("acquire beyond the budget succeeded with a cancelled context")
+	}
+}
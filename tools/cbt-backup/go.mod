@@ -3,10 +3,13 @@ module github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup
 go 1.25.8
 
 require (
+	github.com/klauspost/compress v1.17.11
 	github.com/kubernetes-csi/external-snapshot-metadata v1.0.1-0.20260323064014-1ab306d8a985
 	github.com/kubernetes-csi/external-snapshotter/client/v8 v8.4.0
 	github.com/minio/minio-go/v7 v7.0.82
+	github.com/pierrec/lz4/v4 v4.1.22
 	github.com/spf13/cobra v1.8.1
+	github.com/spf13/pflag v1.0.10
 	google.golang.org/grpc v1.79.2
 	k8s.io/api v0.35.0
 	k8s.io/apimachinery v0.35.0
@@ -39,7 +42,6 @@ require (
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/json-iterator/go v1.1.12 // indirect
-	github.com/klauspost/compress v1.17.11 // indirect
 	github.com/klauspost/cpuid/v2 v2.2.8 // indirect
 	github.com/kr/text v0.2.0 // indirect
 	github.com/minio/md5-simd v1.1.2 // indirect
@@ -47,7 +49,6 @@ require (
 	github.com/modern-go/reflect2 v1.0.3-0.20250322232337-35a7c28c31ee // indirect
 	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
 	github.com/rs/xid v1.6.0 // indirect
-	github.com/spf13/pflag v1.0.10 // indirect
 	github.com/x448/float16 v0.8.4 // indirect
 	go.yaml.in/yaml/v2 v2.4.4 // indirect
 	go.yaml.in/yaml/v3 v3.0.4 // indirect
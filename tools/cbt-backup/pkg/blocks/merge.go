@@ -0,0 +1,82 @@
+package blocks
+
+import "sort"
+
+// Piece is the part of a block list entry that is still current after later
+// block lists have been overlaid on it
+type Piece struct {
+	Layer  int           // Index of the block list the entry came from
+	Block  BlockMetadata // The source entry
+	Offset int64         // Volume offset of the piece
+	Size   int64         // Length of the piece
+}
+
+// Whole reports whether the piece covers its entire source entry
+func (p Piece) Whole() bool {
+	return p.Offset == p.Block.Offset && p.Size == p.Block.Size
+}
+
+// End returns the volume offset just past the piece
+func (p Piece) End() int64 {
+	return p.Offset + p.Size
+}
+
+// MergeBlockLists overlays block lists in apply order (base first) and
+// returns the resulting extents sorted by offset. Where entries overlap, the
+// later list wins; entries it partially overwrites are trimmed to the bytes
+// that remain current. Entries within one list must not overlap.
+func MergeBlockLists(layers [][]BlockMetadata) []Piece {
+	var merged []Piece
+
+	for layer, entries := range layers {
+		top := make([]Piece, 0, len(entries))
+		for _, e := range entries {
+			if e.Size <= 0 {
+				continue
+			}
+			top = append(top, Piece{Layer: layer, Block: e, Offset: e.Offset, Size: e.Size})
+		}
+		sort.Slice(top, func(i, j int) bool { return top[i].Offset < top[j].Offset })
+
+		merged = overlay(merged, top)
+	}
+
+	return merged
+}
+
+// overlay removes from base every byte covered by top and merges the two.
+// Both inputs are sorted by offset and free of internal overlaps.
+func overlay(base, top []Piece) []Piece {
+	result := make([]Piece, 0, len(base)+len(top))
+
+	j := 0
+	for _, b := range base {
+		for j < len(top) && top[j].End() <= b.Offset {
+			j++
+		}
+
+		cur := b.Offset
+		for k := j; k < len(top) && top[k].Offset < b.End(); k++ {
+			if top[k].Offset > cur {
+				result = append(result, b.slice(cur, top[k].Offset))
+			}
+			if top[k].End() > cur {
+				cur = top[k].End()
+			}
+		}
+		if cur < b.End() {
+			result = append(result, b.slice(cur, b.End()))
+		}
+	}
+
+	result = append(result, top...)
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Offset < result[j].Offset })
+	return result
+}
+
+// slice returns the part of p between the volume offsets start and end
+func (p Piece) slice(start, end int64) Piece {
+	p.Offset = start
+	p.Size = end - start
+	return p
+}
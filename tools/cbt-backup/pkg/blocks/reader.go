@@ -51,22 +51,17 @@ func (r *Reader) Close() error {
 	return nil
 }
 
-// ReadBlock reads a single block at the given offset
+// ReadBlock reads a single block at the given offset. It does not move the
+// device's file offset, so it is safe for concurrent use.
 func (r *Reader) ReadBlock(offset int64, size int64) (*BlockData, error) {
 	if size <= 0 {
 		size = r.blockSize
 	}
 
-	// Seek to offset
-	_, err := r.device.Seek(offset, io.SeekStart)
-	if err != nil {
-		return nil, fmt.Errorf("failed to seek to offset %d: %w", offset, err)
-	}
-
 	// Read data
 	data := make([]byte, size)
-	n, err := io.ReadFull(r.device, data)
-	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+	n, err := r.device.ReadAt(data, offset)
+	if err != nil && err != io.EOF {
 		return nil, fmt.Errorf("failed to read block at offset %d: %w", offset, err)
 	}
 
@@ -180,8 +175,14 @@ func ScanNonZeroBlocks(devicePath string, blockSize int64) ([]BlockMetadata, err
 
 // BlockMetadata describes a block's location
 type BlockMetadata struct {
-	Offset int64 `json:"offset"`
-	Size   int64 `json:"size"`
+	Offset       int64  `json:"offset"`
+	Size         int64  `json:"size"`
+	Checksum     string `json:"checksum,omitempty"`     // SHA-256 of the block data
+	Object       string `json:"object,omitempty"`       // Object holding the data, when not implied by the layout
+	ObjectOffset int64  `json:"objectOffset,omitempty"` // Byte offset of the data within Object
+	StoredSize   int64  `json:"storedSize,omitempty"`   // Bytes stored for this block
+	Compression  string `json:"compression,omitempty"`  // Codec of the stored data; empty when stored raw
+	SealedBy     string `json:"sealedBy,omitempty"`     // Snapshot that encrypted the data, when copied from another
 }
 
 // Writer writes blocks to a device
@@ -0,0 +1,134 @@
+package compression
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Supported block codecs
+const (
+	None = "none"
+	Zstd = "zstd"
+	LZ4  = "lz4"
+)
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// initZstd creates the shared zstd encoder and decoder. EncodeAll and
+// DecodeAll are safe for concurrent use.
+func initZstd() error {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	return zstdErr
+}
+
+// Validate checks that codec is a supported codec name
+func Validate(codec string) error {
+	switch codec {
+	case None, Zstd, LZ4:
+		return nil
+	}
+	return fmt.Errorf("unsupported compression %q (must be %s, %s or %s)", codec, None, Zstd, LZ4)
+}
+
+// Compress encodes data with codec. It returns the data unchanged and an
+// empty codec when compression does not make the block smaller, so
+// incompressible blocks are stored raw.
+func Compress(codec string, data []byte) ([]byte, string, error) {
+	var out []byte
+	var err error
+
+	switch codec {
+	case "", None:
+		return data, "", nil
+	case Zstd:
+		if err := initZstd(); err != nil {
+			return nil, "", fmt.Errorf("failed to initialize zstd: %w", err)
+		}
+		out = zstdEncoder.EncodeAll(data, nil)
+	case LZ4:
+		out, err = encodeLZ4(data)
+		if err != nil {
+			return nil, "", fmt.Errorf("lz4 compression failed: %w", err)
+		}
+	default:
+		return nil, "", Validate(codec)
+	}
+
+	if len(out) >= len(data) {
+		return data, "", nil
+	}
+	return out, codec, nil
+}
+
+// Decompress decodes data that was stored with codec. An empty codec means
+// the data was stored raw.
+func Decompress(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case "", None:
+		return data, nil
+	case Zstd:
+		if err := initZstd(); err != nil {
+			return nil, fmt.Errorf("failed to initialize zstd: %w", err)
+		}
+		out, err := zstdDecoder.DecodeAll(data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("zstd decompression failed: %w", err)
+		}
+		return out, nil
+	case LZ4:
+		out, err := decodeLZ4(data)
+		if err != nil {
+			return nil, fmt.Errorf("lz4 decompression failed: %w", err)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unsupported compression %q", codec)
+}
+
+// encodeLZ4 returns data as an LZ4 block preceded by its uncompressed length
+// as a 4-byte little-endian integer. It returns data unchanged when LZ4
+// cannot make it smaller.
+func encodeLZ4(data []byte) ([]byte, error) {
+	out := make([]byte, 4+lz4.CompressBlockBound(len(data)))
+	binary.LittleEndian.PutUint32(out, uint32(len(data)))
+	n, err := lz4.CompressBlock(data, out[4:], nil)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return data, nil
+	}
+	return out[:4+n], nil
+}
+
+// decodeLZ4 decodes an LZ4 block preceded by its uncompressed length as a
+// 4-byte little-endian integer
+func decodeLZ4(data []byte) ([]byte, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("block of %d bytes has no length header", len(data))
+	}
+	out := make([]byte, binary.LittleEndian.Uint32(data))
+	n, err := lz4.UncompressBlock(data[4:], out)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(out) {
+		return nil, fmt.Errorf("block decoded to %d bytes, expected %d", n, len(out))
+	}
+	return out, nil
+}
@@ -0,0 +1,43 @@
+package compression
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+)
+
+func TestLZ4RoundTrip(t *testing.T) {
+	raw := bytes.Repeat([]byte("compressible block data "), 512)
+
+	stored, codec, err := Compress(LZ4, raw)
+	if err != nil {
+		t.Fatalf("Compress: %v", err)
+	}
+	if codec != LZ4 || len(stored) >= len(raw) {
+		t.Fatalf("Compress stored %d of %d bytes with codec %q", len(stored), len(raw), codec)
+	}
+	// Blocks keep the framing of earlier releases: the uncompressed length
+	// as a 4-byte little-endian integer before the LZ4 block
+	if n := binary.LittleEndian.Uint32(stored); n != uint32(len(raw)) {
+		t.Errorf("length header = %d, want %d", n, len(raw))
+	}
+
+	got, err := Decompress(codec, stored)
+	if err != nil {
+		t.Fatalf("Decompress: %v", err)
+	}
+	if !bytes.Equal(got, raw) {
+		t.Error("data mismatch after decompress")
+	}
+
+	noise := make([]byte, 4096)
+	rand.Read(noise)
+	stored, codec, err = Compress(LZ4, noise)
+	if err != nil {
+		t.Fatalf("Compress: %v", err)
+	}
+	if codec != "" || !bytes.Equal(stored, noise) {
+		t.Errorf("incompressible block stored with codec %q in %d bytes, want it raw", codec, len(stored))
+	}
+}
@@ -0,0 +1,317 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Algorithm is the authenticated encryption used for block data,
+	// metadata and wrapped keys
+	Algorithm = "AES-256-GCM"
+
+	// KeySize is the size of master and repository keys in bytes
+	KeySize = 32
+
+	// KeysPrefix holds the wrapped repository keys
+	KeysPrefix = "keys/"
+)
+
+var (
+	// ErrEncrypted is returned when an encrypted object is read without a key
+	ErrEncrypted = errors.New("object is encrypted; an encryption key is required")
+	// ErrNotEncrypted is returned when metadata of an encrypted repository is
+	// read from an object that was not sealed, as it may have been planted
+	ErrNotEncrypted = errors.New("object is not encrypted")
+)
+
+// WrappedKey is a repository key encrypted with a master key. It is stored
+// in plaintext at keys/<id>.json.
+type WrappedKey struct {
+	ID          string    `json:"id"`
+	Algorithm   string    `json:"algorithm"`
+	MasterKeyID string    `json:"masterKeyId"`
+	Created     time.Time `json:"created"`
+	Key         string    `json:"key"` // base64 of nonce || ciphertext
+}
+
+// Envelope is the stored form of an encrypted metadata object
+type Envelope struct {
+	Encryption EnvelopeHeader `json:"encryption"`
+	Ciphertext []byte         `json:"ciphertext"`
+}
+
+// EnvelopeHeader identifies how an envelope was sealed
+type EnvelopeHeader struct {
+	Algorithm string `json:"algorithm"`
+	KeyID     string `json:"keyId"`
+}
+
+// repoKey holds the subkeys derived from one repository key
+type repoKey struct {
+	created time.Time
+	aead    cipher.AEAD
+	macKey  []byte
+}
+
+// Keyring holds the repository keys that a master key can unwrap
+type Keyring struct {
+	master      cipher.AEAD
+	masterKeyID string
+	keys        map[string]*repoKey
+	activeID    string
+}
+
+// ParseMasterKey accepts a raw 32-byte key, or one encoded as base64 or hex
+func ParseMasterKey(data []byte) ([]byte, error) {
+	if len(data) == KeySize {
+		return data, nil
+	}
+
+	text := strings.TrimSpace(string(data))
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+	if key, err := hex.DecodeString(text); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("master key must be %d bytes (raw, base64 or hex)", KeySize)
+}
+
+// NewKeyring creates a keyring for the given master key
+func NewKeyring(masterKey []byte) (*Keyring, error) {
+	master, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(masterKey)
+	return &Keyring{
+		master:      master,
+		masterKeyID: hex.EncodeToString(sum[:8]),
+		keys:        make(map[string]*repoKey),
+	}, nil
+}
+
+// MasterKeyID is a fingerprint of the master key, recorded in wrapped keys
+func (k *Keyring) MasterKeyID() string {
+	return k.masterKeyID
+}
+
+// ActiveKeyID returns the repository key used for new data
+func (k *Keyring) ActiveKeyID() string {
+	return k.activeID
+}
+
+// Len returns the number of repository keys in the keyring
+func (k *Keyring) Len() int {
+	return len(k.keys)
+}
+
+// AddWrapped unwraps a repository key and adds it to the keyring. Keys
+// wrapped by a different master key are skipped and reported as not added.
+// The newest key becomes the active key.
+func (k *Keyring) AddWrapped(w WrappedKey) (bool, error) {
+	if w.MasterKeyID != k.masterKeyID {
+		return false, nil
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(w.Key)
+	if err != nil {
+		return false, fmt.Errorf("invalid wrapped key %s: %w", w.ID, err)
+	}
+	raw, err := open(k.master, sealed, []byte(w.ID))
+	if err != nil {
+		return false, fmt.Errorf("failed to unwrap key %s: %w", w.ID, err)
+	}
+
+	rk, err := deriveRepoKey(raw, w.Created)
+	if err != nil {
+		return false, err
+	}
+	k.keys[w.ID] = rk
+
+	if k.activeID == "" || w.Created.After(k.keys[k.activeID].created) {
+		k.activeID = w.ID
+	}
+	return true, nil
+}
+
+// GenerateKey creates a new repository key, makes it active and returns it
+// wrapped by the master key for storage
+func (k *Keyring) GenerateKey() (WrappedKey, error) {
+	raw := make([]byte, KeySize)
+	if _, err := rand.Read(raw); err != nil {
+		return WrappedKey{}, fmt.Errorf("failed to generate key: %w", err)
+	}
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return WrappedKey{}, fmt.Errorf("failed to generate key ID: %w", err)
+	}
+
+	w := WrappedKey{
+		ID:          hex.EncodeToString(idBytes),
+		Algorithm:   Algorithm,
+		MasterKeyID: k.masterKeyID,
+		Created:     time.Now().UTC(),
+	}
+
+	sealed, err := seal(k.master, raw, []byte(w.ID))
+	if err != nil {
+		return WrappedKey{}, err
+	}
+	w.Key = base64.StdEncoding.EncodeToString(sealed)
+
+	if _, err := k.AddWrapped(w); err != nil {
+		return WrappedKey{}, err
+	}
+	k.activeID = w.ID
+	return w, nil
+}
+
+// KeyIDs returns the IDs of all keys in the keyring
+func (k *Keyring) KeyIDs() []string {
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Encrypt seals data with the active repository key. The ciphertext is
+// bound to additional, which must be passed again to Decrypt, so it cannot
+// be passed off as another object.
+func (k *Keyring) Encrypt(data, additional []byte) ([]byte, error) {
+	rk, ok := k.keys[k.activeID]
+	if !ok {
+		return nil, fmt.Errorf("no active encryption key")
+	}
+	return seal(rk.aead, data, additional)
+}
+
+// Decrypt opens data sealed with the given repository key and additional
+// data
+func (k *Keyring) Decrypt(keyID string, data, additional []byte) ([]byte, error) {
+	rk, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("encryption key %s is not available for this master key", keyID)
+	}
+	return open(rk.aead, data, additional)
+}
+
+// ContentID returns a keyed digest of data for naming content-addressed
+// objects, so object names do not reveal plaintext hashes
+func (k *Keyring) ContentID(data []byte) (string, error) {
+	rk, ok := k.keys[k.activeID]
+	if !ok {
+		return "", fmt.Errorf("no active encryption key")
+	}
+	mac := hmac.New(sha256.New, rk.macKey)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// SealJSON wraps JSON data in an envelope encrypted with the active key and
+// bound to the object key it is stored under
+func (k *Keyring) SealJSON(objectPath string, data []byte) ([]byte, error) {
+	ciphertext, err := k.Encrypt(data, []byte(objectPath))
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(Envelope{
+		Encryption: EnvelopeHeader{Algorithm: Algorithm, KeyID: k.activeID},
+		Ciphertext: ciphertext,
+	}, "", "  ")
+}
+
+// OpenJSON returns the plaintext of the metadata object stored under
+// objectPath. Envelopes need a keyring holding their key. Objects that are
+// not envelopes are returned unchanged without a keyring and rejected with
+// ErrNotEncrypted with one; objects that are plaintext by design, such as
+// locks and wrapped keys, are read without a keyring.
+func OpenJSON(k *Keyring, objectPath string, data []byte) ([]byte, error) {
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil || env.Encryption.Algorithm == "" {
+		if k != nil {
+			return nil, ErrNotEncrypted
+		}
+		return data, nil
+	}
+	if env.Encryption.Algorithm != Algorithm {
+		return nil, fmt.Errorf("unsupported encryption algorithm %q", env.Encryption.Algorithm)
+	}
+	if k == nil {
+		return nil, ErrEncrypted
+	}
+	return k.Decrypt(env.Encryption.KeyID, env.Ciphertext, []byte(objectPath))
+}
+
+// deriveRepoKey derives independent encryption and content-ID subkeys from a
+// repository key
+func deriveRepoKey(raw []byte, created time.Time) (*repoKey, error) {
+	if len(raw) != KeySize {
+		return nil, fmt.Errorf("repository key must be %d bytes", KeySize)
+	}
+
+	aead, err := newAEAD(subkey(raw, "encryption"))
+	if err != nil {
+		return nil, err
+	}
+	return &repoKey{
+		created: created,
+		aead:    aead,
+		macKey:  subkey(raw, "content-id"),
+	}, nil
+}
+
+func subkey(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("cbt-backup " + label))
+	return mac.Sum(nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	return aead, nil
+}
+
+// seal returns nonce || ciphertext
+func seal(aead cipher.AEAD, plaintext, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+func open(aead cipher.AEAD, data, additional []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additional)
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed: %w", err)
+	}
+	return plaintext, nil
+}
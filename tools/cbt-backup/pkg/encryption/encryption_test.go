@@ -0,0 +1,110 @@
+package encryption
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func newTestKeyring(t *testing.T) *Keyring {
+	t.Helper()
+	k, err := NewKeyring(bytes.Repeat([]byte{0x42}, KeySize))
+	if err != nil {
+		t.Fatalf("failed to create keyring: %v", err)
+	}
+	if _, err := k.GenerateKey(); err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	return k
+}
+
+func TestOpenJSON(t *testing.T) {
+	k := newTestKeyring(t)
+	plain := []byte(`{"name": "snap-1"}`)
+
+	sealed, err := k.SealJSON("metadata/snap-1/manifest.json", plain)
+	if err != nil {
+		t.Fatalf("failed to seal: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		keyring *Keyring
+		path    string
+		data    []byte
+		want    []byte
+		wantErr error
+	}{
+		{
+			name:    "sealed",
+			keyring: k,
+			path:    "metadata/snap-1/manifest.json",
+			data:    sealed,
+			want:    plain,
+		},
+		{
+			name:    "sealed without keyring",
+			path:    "metadata/snap-1/manifest.json",
+			data:    sealed,
+			wantErr: ErrEncrypted,
+		},
+		{
+			name:    "sealed under another key",
+			keyring: k,
+			path:    "metadata/snap-2/manifest.json",
+			data:    sealed,
+		},
+		{
+			name: "plaintext without keyring",
+			path: "metadata/snap-1/manifest.json",
+			data: plain,
+			want: plain,
+		},
+		{
+			name:    "plaintext with keyring",
+			keyring: k,
+			path:    "metadata/snap-1/manifest.json",
+			data:    plain,
+			wantErr: ErrNotEncrypted,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := OpenJSON(tt.keyring, tt.path, tt.data)
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("OpenJSON returned %q, want an error", got)
+				}
+				if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+					t.Fatalf("OpenJSON error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("OpenJSON: %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("OpenJSON = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecryptChecksAdditionalData(t *testing.T) {
+	k := newTestKeyring(t)
+
+	sealed, err := k.Encrypt([]byte("block data"), []byte("extent 0+10"))
+	if err != nil {
+		t.Fatalf("failed to encrypt: %v", err)
+	}
+	if _, err := k.Decrypt(k.ActiveKeyID(), sealed, []byte("extent 0+10")); err != nil {
+		t.Errorf("Decrypt with the sealing data: %v", err)
+	}
+	if _, err := k.Decrypt(k.ActiveKeyID(), sealed, []byte("extent 4096+10")); err == nil {
+		t.Error("Decrypt accepted a block bound to another extent")
+	}
+	if _, err := k.Decrypt(k.ActiveKeyID(), sealed, nil); err == nil {
+		t.Error("Decrypt accepted a block without its additional data")
+	}
+}
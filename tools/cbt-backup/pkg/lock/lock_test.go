@@ -0,0 +1,265 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/encryption"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/storage"
+)
+
+func newTestClient(t *testing.T) (*storage.Client, *storage.Local) {
+	t.Helper()
+	backend, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocal: %v", err)
+	}
+	return storage.NewClient(backend), backend
+}
+
+// writeLock stores a lock as another process would have
+func writeLock(t *testing.T, client *storage.Client, info Info) {
+	t.Helper()
+	if err := client.UploadPlainJSON(context.Background(), Path(info.ID), info); err != nil {
+		t.Fatalf("failed to write lock: %v", err)
+	}
+}
+
+func TestAcquireConflicts(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		held      Info
+		exclusive bool
+		wantErr   bool
+	}{
+		{
+			name: "shared with shared",
+			held: Info{ID: "other", Operation: "backup", Heartbeat: now},
+		},
+		{
+			name:      "exclusive with shared",
+			held:      Info{ID: "other", Operation: "backup", Heartbeat: now},
+			exclusive: true,
+			wantErr:   true,
+		},
+		{
+			name:    "shared with exclusive",
+			held:    Info{ID: "other", Exclusive: true, Operation: "prune", Heartbeat: now},
+			wantErr: true,
+		},
+		{
+			name:      "exclusive with stale exclusive",
+			held:      Info{ID: "other", Exclusive: true, Operation: "prune", Heartbeat: now.Add(-StaleTimeout - time.Minute)},
+			exclusive: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			client, _ := newTestClient(t)
+			writeLock(t, client, tt.held)
+
+			lk, _, err := Acquire(ctx, client, Options{Exclusive: tt.exclusive, Operation: "test"})
+			if tt.wantErr {
+				if !errors.Is(err, ErrLocked) {
+					t.Fatalf("Acquire error = %v, want ErrLocked", err)
+				}
+				locks, err := List(ctx, client)
+				if err != nil {
+					t.Fatalf("List: %v", err)
+				}
+				if len(locks) != 1 {
+					t.Errorf("backed-off Acquire left %d locks, want only the held one", len(locks))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Acquire: %v", err)
+			}
+			if err := lk.Release(); err != nil {
+				t.Fatalf("Release: %v", err)
+			}
+		})
+	}
+}
+
+func TestStale(t *testing.T) {
+	now := time.Now()
+	if (&Info{Heartbeat: now.Add(-StaleTimeout + time.Minute)}).Stale(now) {
+		t.Error("lock refreshed within StaleTimeout reported stale")
+	}
+	if !(&Info{Heartbeat: now.Add(-StaleTimeout - time.Minute)}).Stale(now) {
+		t.Error("lock not refreshed for longer than StaleTimeout not reported stale")
+	}
+}
+
+func TestReleaseRemovesLock(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t)
+
+	lk, lockCtx, err := Acquire(ctx, client, Options{Exclusive: true, Operation: "prune"})
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	locks, err := List(ctx, client)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(locks) != 1 || locks[0].ID != lk.info.ID || !locks[0].Exclusive || locks[0].Operation != "prune" {
+		t.Fatalf("List = %+v, want the acquired lock", locks)
+	}
+	if locks[0].PID != os.Getpid() {
+		t.Errorf("lock PID = %d, want %d", locks[0].PID, os.Getpid())
+	}
+
+	if err := lk.Release(); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if lockCtx.Err() == nil {
+		t.Error("lock context not canceled by Release")
+	}
+	if context.Cause(lockCtx) != context.Canceled {
+		t.Errorf("lock context cause = %v, want context.Canceled", context.Cause(lockCtx))
+	}
+
+	locks, err = List(ctx, client)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(locks) != 0 {
+		t.Errorf("List after Release = %+v, want none", locks)
+	}
+
+	// Once released, the repository can be locked exclusively again
+	lk, _, err = Acquire(ctx, client, Options{Exclusive: true, Operation: "gc"})
+	if err != nil {
+		t.Fatalf("Acquire after Release: %v", err)
+	}
+	if err := lk.Release(); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+}
+
+func TestLocksAreReadableWithoutKey(t *testing.T) {
+	ctx := context.Background()
+	client, backend := newTestClient(t)
+
+	keyring, err := encryption.NewKeyring(make([]byte, encryption.KeySize))
+	if err != nil {
+		t.Fatalf("NewKeyring: %v", err)
+	}
+	if _, err := keyring.GenerateKey(); err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	encrypted := storage.NewClient(backend)
+	encrypted.SetKeyring(keyring)
+
+	lk, _, err := Acquire(ctx, encrypted, Options{Exclusive: true, Operation: "backup"})
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer lk.Release()
+
+	_, _, err = Acquire(ctx, client, Options{Operation: "restore"})
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("keyless Acquire error = %v, want ErrLocked from the encrypted process's lock", err)
+	}
+}
+
+func TestListReportsUnreadableLocks(t *testing.T) {
+	ctx := context.Background()
+	client, backend := newTestClient(t)
+
+	writeLock(t, client, Info{ID: "readable", Operation: "backup", Heartbeat: time.Now()})
+	if err := backend.Put(ctx, Path("garbled"), []byte("not a lock")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	locks, err := List(ctx, client)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(locks) != 2 {
+		t.Fatalf("List returned %d locks, want 2", len(locks))
+	}
+
+	var unreadable *Info
+	for i := range locks {
+		if locks[i].ID == "garbled" {
+			unreadable = &locks[i]
+		} else if locks[i].Unreadable != "" {
+			t.Errorf("lock %s reported unreadable: %s", locks[i].ID, locks[i].Unreadable)
+		}
+	}
+	if unreadable == nil || unreadable.Unreadable == "" {
+		t.Fatalf("garbled lock not reported as unreadable: %+v", locks)
+	}
+	if unreadable.Heartbeat.IsZero() || unreadable.Stale(time.Now()) {
+		t.Errorf("unreadable lock heartbeat = %v, want its modification time", unreadable.Heartbeat)
+	}
+	if !strings.HasPrefix(unreadable.String(), "unreadable lock garbled") {
+		t.Errorf("String() = %q", unreadable.String())
+	}
+
+	// An unreadable lock may be of either kind, so it keeps every other lock
+	// out until it is stale or removed
+	if err := Remove(ctx, client, "readable"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	for _, exclusive := range []bool{false, true} {
+		lk, _, err := Acquire(ctx, client, Options{Exclusive: exclusive, Operation: "test"})
+		if !errors.Is(err, ErrLocked) || !strings.Contains(err.Error(), "unreadable lock garbled") {
+			t.Fatalf("Acquire (exclusive %v) error = %v, want ErrLocked from the unreadable lock", exclusive, err)
+		}
+		if lk != nil {
+			t.Fatal("Acquire returned a lock along with an error")
+		}
+	}
+	if err := Remove(ctx, client, "garbled"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	lk, _, err := Acquire(ctx, client, Options{Exclusive: true, Operation: "prune"})
+	if err != nil {
+		t.Fatalf("Acquire after removing the unreadable lock: %v", err)
+	}
+	if err := lk.Release(); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+}
+
+// TestHeartbeatDoesNotRestoreRemovedLock checks that a lock removed by
+// unlock is reported lost instead of being written back by its holder
+func TestHeartbeatDoesNotRestoreRemovedLock(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t)
+
+	lk, _, err := Acquire(ctx, client, Options{Operation: "backup"})
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer lk.Release()
+
+	if err := lk.heartbeat(ctx); err != nil {
+		t.Fatalf("heartbeat: %v", err)
+	}
+	if err := Remove(ctx, client, lk.info.ID); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if err := lk.heartbeat(ctx); !errors.Is(err, errRemoved) {
+		t.Fatalf("heartbeat after Remove = %v, want errRemoved", err)
+	}
+	locks, err := List(ctx, client)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(locks) != 0 {
+		t.Errorf("heartbeat wrote back a removed lock: %+v", locks)
+	}
+}
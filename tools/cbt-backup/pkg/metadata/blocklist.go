@@ -0,0 +1,133 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/blocks"
+)
+
+// BlockListWriter builds a block list in segments. Entries are held in their
+// compact JSON encoding only until they are written out as a segment with
+// Segment and Flushed, so memory and the cost of each checkpoint depend on
+// the entries added since the last segment, not on the length of the list.
+// Join assembles the complete list from the segments when the backup
+// commits.
+type BlockListWriter struct {
+	pending  bytes.Buffer // entries not written as a segment yet, comma separated
+	sizes    []int        // encoded length of each pending entry
+	segments int
+	count    int
+	size     int64
+	end      int64
+}
+
+// Add appends an entry to the list
+func (w *BlockListWriter) Add(entry blocks.BlockMetadata) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode block entry: %w", err)
+	}
+	if len(w.sizes) > 0 {
+		w.pending.WriteByte(',')
+	}
+	w.pending.Write(data)
+	w.sizes = append(w.sizes, len(data))
+
+	w.count++
+	w.size += entry.Size
+	w.end = entry.Offset + entry.Size
+	return nil
+}
+
+// Len returns the number of entries written
+func (w *BlockListWriter) Len() int {
+	return w.count
+}
+
+// TotalSize returns the bytes covered by the entries written
+func (w *BlockListWriter) TotalSize() int64 {
+	return w.size
+}
+
+// End returns the end offset of the last entry written, or 0 if there is none
+func (w *BlockListWriter) End() int64 {
+	return w.end
+}
+
+// Segments returns the number of segments written
+func (w *BlockListWriter) Segments() int {
+	return w.segments
+}
+
+// Segment returns the pending entries as a BlockList document and their
+// number. Once the document is stored as segment Segments(), Flushed drops
+// them; entries added in the meantime stay pending.
+func (w *BlockListWriter) Segment() (json.RawMessage, int) {
+	return wrapEntries(w.pending.Bytes()), len(w.sizes)
+}
+
+// Flushed records that the first n pending entries were stored as the next
+// segment
+func (w *BlockListWriter) Flushed(n int) {
+	if n == 0 {
+		return
+	}
+	cut := n - 1 // separating commas
+	for _, size := range w.sizes[:n] {
+		cut += size
+	}
+	if n < len(w.sizes) {
+		cut++ // the comma after the last flushed entry
+	}
+
+	rest := w.pending.Bytes()[cut:]
+	var pending bytes.Buffer
+	pending.Write(rest)
+	w.pending = pending
+	w.sizes = append([]int(nil), w.sizes[n:]...)
+	w.segments++
+}
+
+// Join returns the complete block list: the entries of every segment, read
+// one at a time with read, followed by the pending entries. Only the
+// result is held in memory as a whole.
+func (w *BlockListWriter) Join(read func(segment int) (json.RawMessage, error)) (json.RawMessage, error) {
+	var entries bytes.Buffer
+	for i := 0; i < w.segments; i++ {
+		data, err := read(i)
+		if err != nil {
+			return nil, err
+		}
+		var segment struct {
+			Blocks []json.RawMessage `json:"blocks"`
+		}
+		if err := json.Unmarshal(data, &segment); err != nil {
+			return nil, fmt.Errorf("failed to decode block list segment %d: %w", i, err)
+		}
+		for _, e := range segment.Blocks {
+			if entries.Len() > 0 {
+				entries.WriteByte(',')
+			}
+			if err := json.Compact(&entries, e); err != nil {
+				return nil, fmt.Errorf("failed to decode block list segment %d: %w", i, err)
+			}
+		}
+	}
+	if len(w.sizes) > 0 {
+		if entries.Len() > 0 {
+			entries.WriteByte(',')
+		}
+		entries.Write(w.pending.Bytes())
+	}
+	return wrapEntries(entries.Bytes()), nil
+}
+
+// wrapEntries returns comma separated entries as a BlockList document
+func wrapEntries(entries []byte) json.RawMessage {
+	doc := make([]byte, 0, len(entries)+len(`{"blocks":[]}`))
+	doc = append(doc, `{"blocks":[`...)
+	doc = append(doc, entries...)
+	return append(doc, `]}`...)
+}
@@ -0,0 +1,76 @@
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/blocks"
+)
+
+func TestBlockListWriterSegments(t *testing.T) {
+	w := &BlockListWriter{}
+	stored := map[int]json.RawMessage{}
+	add := func(from, to int) {
+		t.Helper()
+		for i := from; i < to; i++ {
+			if err := w.Add(blocks.BlockMetadata{Offset: int64(i) * 4096, Size: 4096}); err != nil {
+				t.Fatalf("Add: %v", err)
+			}
+		}
+	}
+	// flush stores the pending entries as a segment, with more entries added
+	// while it is being stored
+	flush := func(wantEntries, addedMeanwhile int) {
+		t.Helper()
+		doc, n := w.Segment()
+		if n != wantEntries {
+			t.Fatalf("Segment holds %d entries, want %d", n, wantEntries)
+		}
+		var segment BlockList
+		if err := json.Unmarshal(doc, &segment); err != nil || len(segment.Blocks) != n {
+			t.Fatalf("Segment document %s: %v", doc, err)
+		}
+		start := w.Len()
+		add(start, start+addedMeanwhile)
+		stored[w.Segments()] = doc
+		w.Flushed(n)
+	}
+
+	add(0, 3)
+	flush(3, 2)
+	flush(2, 0)
+	flush(0, 0)
+	add(5, 9)
+	flush(4, 1)
+
+	if w.Segments() != 3 {
+		t.Fatalf("Segments = %d, want 3", w.Segments())
+	}
+	if w.Len() != 10 || w.TotalSize() != 10*4096 || w.End() != 10*4096 {
+		t.Errorf("Len, TotalSize, End = %d, %d, %d", w.Len(), w.TotalSize(), w.End())
+	}
+
+	doc, err := w.Join(func(segment int) (json.RawMessage, error) {
+		data, ok := stored[segment]
+		if !ok {
+			return nil, fmt.Errorf("segment %d was not stored", segment)
+		}
+		return data, nil
+	})
+	if err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+	var list BlockList
+	if err := json.Unmarshal(doc, &list); err != nil {
+		t.Fatalf("Join returned %s: %v", doc, err)
+	}
+	if len(list.Blocks) != 10 {
+		t.Fatalf("joined list has %d entries, want 10", len(list.Blocks))
+	}
+	for i, e := range list.Blocks {
+		if e.Offset != int64(i)*4096 {
+			t.Errorf("entry %d at offset %d, want %d", i, e.Offset, int64(i)*4096)
+		}
+	}
+}
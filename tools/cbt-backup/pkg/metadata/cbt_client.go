@@ -7,6 +7,8 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
+	"iter"
+	"sync"
 	"time"
 
 	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/blocks"
@@ -14,9 +16,12 @@ import (
 	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
 	snapclientset "github.com/kubernetes-csi/external-snapshotter/client/v8/clientset/versioned"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 	authv1 "k8s.io/api/authentication/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
@@ -29,16 +34,38 @@ import (
 type CBTClient struct {
 	conn               *grpc.ClientConn
 	client             api.SnapshotMetadataClient
-	snapClient         *snapclientset.Clientset
-	kubeClient         *kubernetes.Clientset
+	snapClient         snapclientset.Interface
+	kubeClient         kubernetes.Interface
 	dynClient          dynamic.Interface
 	config             *rest.Config
 	namespace          string
 	serviceAccountName string
 	socketAddress      string // override endpoint (skips discovery)
+	driver             string // CSI driver whose SnapshotMetadataService is used
 	securityToken      string // SA token for gRPC security_token field
+	maxResults         int32  // extents per stream message; 0 lets the service choose
+	retries            int    // reopens of a broken stream per call
+	retryBackoff       time.Duration
+	volumeCapacity     int64 // expected VolumeCapacityBytes; 0 skips the check
+
+	mu      sync.Mutex
+	listing ListingInfo
+}
+
+// ListingInfo describes the volume as reported by the metadata streams
+type ListingInfo struct {
+	BlockMetadataType   string // "FIXED_LENGTH" or "VARIABLE_LENGTH"; empty until a message was received
+	VolumeCapacityBytes int64
 }
 
+const (
+	// DefaultStreamRetries is how often a broken metadata stream is reopened
+	DefaultStreamRetries = 3
+	// DefaultRetryBackoff is the wait before the first reopen of a broken
+	// metadata stream; it doubles for each further one
+	DefaultRetryBackoff = time.Second
+)
+
 // NewCBTClient creates a new CBT client
 func NewCBTClient(namespace string, kubeconfig string, serviceAccountName string) (*CBTClient, error) {
 	var config *rest.Config
@@ -79,16 +106,68 @@ func NewCBTClient(namespace string, kubeconfig string, serviceAccountName string
 		config:             config,
 		namespace:          namespace,
 		serviceAccountName: serviceAccountName,
+		retries:            DefaultStreamRetries,
+		retryBackoff:       DefaultRetryBackoff,
 	}, nil
 }
 
+// NewCBTClientForClients creates a CBT client that uses existing Kubernetes
+// clients and an already connected SnapshotMetadata client, e.g. in-process
+// fakes in tests. Connect is a no-op for it.
+func NewCBTClientForClients(namespace string, snapClient snapclientset.Interface, kubeClient kubernetes.Interface, client api.SnapshotMetadataClient) *CBTClient {
+	return &CBTClient{
+		client:       client,
+		snapClient:   snapClient,
+		kubeClient:   kubeClient,
+		namespace:    namespace,
+		retries:      DefaultStreamRetries,
+		retryBackoff: DefaultRetryBackoff,
+	}
+}
+
 // SetEndpoint overrides the default gRPC endpoint address (skips service discovery)
 func (c *CBTClient) SetEndpoint(endpoint string) {
 	c.socketAddress = endpoint
 }
 
+// SetDriver sets the CSI driver of the volume being backed up. Discovery
+// then uses the SnapshotMetadataService named after the driver.
+func (c *CBTClient) SetDriver(driver string) {
+	c.driver = driver
+}
+
+// SetMaxResults sets how many extents the service may send per stream
+// message. Zero lets the service choose.
+func (c *CBTClient) SetMaxResults(maxResults int32) {
+	c.maxResults = maxResults
+}
+
+// SetRetries sets how often a broken metadata stream is reopened per call,
+// and the wait before the first reopen, which doubles for each further one
+func (c *CBTClient) SetRetries(retries int, backoff time.Duration) {
+	c.retries = retries
+	c.retryBackoff = backoff
+}
+
+// SetVolumeCapacity sets the capacity the snapshot is expected to have,
+// e.g. its RestoreSize. A stream reporting a different VolumeCapacityBytes
+// fails, as its extents may not describe the snapshot being backed up.
+func (c *CBTClient) SetVolumeCapacity(capacity int64) {
+	c.volumeCapacity = capacity
+}
+
+// ListingInfo returns the block metadata type and volume capacity reported
+// by the last message received
+func (c *CBTClient) ListingInfo() ListingInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.listing
+}
+
 // discoverService reads the SnapshotMetadataService CR to find the gRPC endpoint,
-// CA certificate, and audience for token-based authentication.
+// CA certificate, and audience for token-based authentication. The CR is named
+// after the CSI driver it serves; without a driver set, discovery only
+// succeeds if the cluster has a single SnapshotMetadataService.
 func (c *CBTClient) discoverService(ctx context.Context) (address, caCertBase64, audience string, err error) {
 	gvr := schema.GroupVersionResource{
 		Group:    "cbt.storage.k8s.io",
@@ -96,16 +175,28 @@ func (c *CBTClient) discoverService(ctx context.Context) (address, caCertBase64,
 		Resource: "snapshotmetadataservices",
 	}
 
-	list, err := c.dynClient.Resource(gvr).List(ctx, metav1.ListOptions{})
-	if err != nil {
-		return "", "", "", fmt.Errorf("failed to list SnapshotMetadataService resources: %w", err)
-	}
+	var item *unstructured.Unstructured
+	if c.driver != "" {
+		item, err = c.dynClient.Resource(gvr).Get(ctx, c.driver, metav1.GetOptions{})
+		if err != nil {
+			return "", "", "", fmt.Errorf("failed to get SnapshotMetadataService for CSI driver %s: %w", c.driver, err)
+		}
+	} else {
+		list, err := c.dynClient.Resource(gvr).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return "", "", "", fmt.Errorf("failed to list SnapshotMetadataService resources: %w", err)
+		}
 
-	if len(list.Items) == 0 {
-		return "", "", "", fmt.Errorf("no SnapshotMetadataService resources found")
+		switch len(list.Items) {
+		case 0:
+			return "", "", "", fmt.Errorf("no SnapshotMetadataService resources found")
+		case 1:
+			item = &list.Items[0]
+		default:
+			return "", "", "", fmt.Errorf("found %d SnapshotMetadataService resources; the CSI driver is needed to choose one", len(list.Items))
+		}
 	}
 
-	item := list.Items[0]
 	spec, ok := item.Object["spec"].(map[string]interface{})
 	if !ok {
 		return "", "", "", fmt.Errorf("invalid SnapshotMetadataService spec")
@@ -119,7 +210,7 @@ func (c *CBTClient) discoverService(ctx context.Context) (address, caCertBase64,
 		return "", "", "", fmt.Errorf("SnapshotMetadataService has no address")
 	}
 
-	fmt.Printf("Discovered SnapshotMetadataService: address=%s, audience=%s\n", address, audience)
+	fmt.Printf("Discovered SnapshotMetadataService %s: address=%s, audience=%s\n", item.GetName(), address, audience)
 	return address, caCertBase64, audience, nil
 }
 
@@ -148,7 +239,7 @@ func (c *CBTClient) createSAToken(ctx context.Context, audience string) (string,
 
 // Connect establishes the gRPC connection to the snapshot metadata sidecar
 func (c *CBTClient) Connect(ctx context.Context) error {
-	if c.conn != nil {
+	if c.client != nil {
 		return nil
 	}
 
@@ -228,42 +319,38 @@ func buildTLSConfig(caCertBase64 string) (*tls.Config, error) {
 // GetAllocatedBlocks returns all allocated blocks in a snapshot
 // Uses the sidecar's GetMetadataAllocated RPC (which takes snapshot name, not CSI handle)
 func (c *CBTClient) GetAllocatedBlocks(ctx context.Context, snapshotName string) ([]blocks.BlockMetadata, error) {
-	if c.client == nil {
-		return nil, fmt.Errorf("not connected - call Connect() first")
-	}
-
-	req := &api.GetMetadataAllocatedRequest{
-		SecurityToken: c.securityToken,
-		Namespace:     c.namespace,
-		SnapshotName:  snapshotName,
-		StartingOffset: 0,
-		MaxResults:     0,
-	}
-
-	stream, err := c.client.GetMetadataAllocated(ctx, req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to call GetMetadataAllocated: %w", err)
-	}
+	return collectBlocks(c.AllocatedBlocks(ctx, snapshotName, 0))
+}
 
-	var blockList []blocks.BlockMetadata
-	for {
-		resp, err := stream.Recv()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, fmt.Errorf("error receiving block metadata: %w", err)
+// AllocatedBlocks streams the allocated blocks of a snapshot from
+// startingOffset on, yielding each extent as soon as it is received. The
+// sequence ends early with a non-nil error if listing fails; breaking out
+// of the loop closes the stream.
+func (c *CBTClient) AllocatedBlocks(ctx context.Context, snapshotName string, startingOffset int64) iter.Seq2[blocks.BlockMetadata, error] {
+	return func(yield func(blocks.BlockMetadata, error) bool) {
+		if c.client == nil {
+			yield(blocks.BlockMetadata{}, fmt.Errorf("not connected - call Connect() first"))
+			return
 		}
 
-		for _, block := range resp.BlockMetadata {
-			blockList = append(blockList, blocks.BlockMetadata{
-				Offset: block.ByteOffset,
-				Size:   block.SizeBytes,
-			})
+		open := func(ctx context.Context, startingOffset int64) (func() (blockMetadataResponse, error), error) {
+			req := &api.GetMetadataAllocatedRequest{
+				SecurityToken:  c.securityToken,
+				Namespace:      c.namespace,
+				SnapshotName:   snapshotName,
+				StartingOffset: startingOffset,
+				MaxResults:     c.maxResults,
+			}
+
+			stream, err := c.client.GetMetadataAllocated(ctx, req)
+			if err != nil {
+				return nil, fmt.Errorf("failed to call GetMetadataAllocated: %w", err)
+			}
+			return func() (blockMetadataResponse, error) { return stream.Recv() }, nil
 		}
-	}
 
-	return blockList, nil
+		c.yieldBlocks(ctx, "block metadata", startingOffset, open, yield)
+	}
 }
 
 // GetDeltaBlocks returns blocks that changed between two snapshots
@@ -271,64 +358,230 @@ func (c *CBTClient) GetAllocatedBlocks(ctx context.Context, snapshotName string)
 // baseSnapshotName is resolved to its CSI handle (base_snapshot_id field).
 // targetSnapshotName is passed directly (target_snapshot_name field).
 func (c *CBTClient) GetDeltaBlocks(ctx context.Context, baseSnapshotName, targetSnapshotName string) ([]blocks.BlockMetadata, error) {
-	if c.client == nil {
-		return nil, fmt.Errorf("not connected - call Connect() first")
+	return collectBlocks(c.DeltaBlocks(ctx, baseSnapshotName, targetSnapshotName, 0))
+}
+
+// DeltaBlocks streams the blocks that changed between two snapshots from
+// startingOffset on, like AllocatedBlocks
+func (c *CBTClient) DeltaBlocks(ctx context.Context, baseSnapshotName, targetSnapshotName string, startingOffset int64) iter.Seq2[blocks.BlockMetadata, error] {
+	return func(yield func(blocks.BlockMetadata, error) bool) {
+		if c.client == nil {
+			yield(blocks.BlockMetadata{}, fmt.Errorf("not connected - call Connect() first"))
+			return
+		}
+
+		baseHandle, err := c.snapshotHandle(ctx, baseSnapshotName)
+		if err != nil {
+			yield(blocks.BlockMetadata{}, err)
+			return
+		}
+
+		open := func(ctx context.Context, startingOffset int64) (func() (blockMetadataResponse, error), error) {
+			req := &api.GetMetadataDeltaRequest{
+				SecurityToken:      c.securityToken,
+				Namespace:          c.namespace,
+				BaseSnapshotId:     baseHandle,
+				TargetSnapshotName: targetSnapshotName,
+				StartingOffset:     startingOffset,
+				MaxResults:         c.maxResults,
+			}
+
+			stream, err := c.client.GetMetadataDelta(ctx, req)
+			if err != nil {
+				return nil, fmt.Errorf("failed to call GetMetadataDelta: %w", err)
+			}
+			return func() (blockMetadataResponse, error) { return stream.Recv() }, nil
+		}
+
+		c.yieldBlocks(ctx, "delta block metadata", startingOffset, open, yield)
 	}
+}
 
-	// Get base snapshot's CSI handle (the sidecar uses base_snapshot_id = CSI handle)
-	baseSnapshot, err := c.snapClient.SnapshotV1().VolumeSnapshots(c.namespace).Get(ctx, baseSnapshotName, metav1.GetOptions{})
+// snapshotHandle resolves a VolumeSnapshot to the CSI handle of its bound
+// VolumeSnapshotContent (the sidecar uses base_snapshot_id = CSI handle)
+func (c *CBTClient) snapshotHandle(ctx context.Context, snapshotName string) (string, error) {
+	snapshot, err := c.snapClient.SnapshotV1().VolumeSnapshots(c.namespace).Get(ctx, snapshotName, metav1.GetOptions{})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get base VolumeSnapshot %s: %w", baseSnapshotName, err)
+		return "", fmt.Errorf("failed to get base VolumeSnapshot %s: %w", snapshotName, err)
 	}
 
-	if baseSnapshot.Status == nil || baseSnapshot.Status.BoundVolumeSnapshotContentName == nil {
-		return nil, fmt.Errorf("base snapshot %s is not bound", baseSnapshotName)
+	if snapshot.Status == nil || snapshot.Status.BoundVolumeSnapshotContentName == nil {
+		return "", fmt.Errorf("base snapshot %s is not bound", snapshotName)
 	}
 
-	baseVSC, err := c.snapClient.SnapshotV1().VolumeSnapshotContents().Get(ctx, *baseSnapshot.Status.BoundVolumeSnapshotContentName, metav1.GetOptions{})
+	vsc, err := c.snapClient.SnapshotV1().VolumeSnapshotContents().Get(ctx, *snapshot.Status.BoundVolumeSnapshotContentName, metav1.GetOptions{})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get base VolumeSnapshotContent: %w", err)
+		return "", fmt.Errorf("failed to get base VolumeSnapshotContent: %w", err)
 	}
 
-	if baseVSC.Status == nil || baseVSC.Status.SnapshotHandle == nil {
-		return nil, fmt.Errorf("base VolumeSnapshotContent has no snapshot handle")
+	if vsc.Status == nil || vsc.Status.SnapshotHandle == nil {
+		return "", fmt.Errorf("base VolumeSnapshotContent has no snapshot handle")
 	}
 
-	baseHandle := *baseVSC.Status.SnapshotHandle
+	return *vsc.Status.SnapshotHandle, nil
+}
 
-	req := &api.GetMetadataDeltaRequest{
-		SecurityToken:      c.securityToken,
-		Namespace:          c.namespace,
-		BaseSnapshotId:     baseHandle,
-		TargetSnapshotName: targetSnapshotName,
-		StartingOffset:     0,
-		MaxResults:         0,
-	}
+// yieldBlocks runs streamBlocks for an iterator, passing a final error on
+// to yield. The stream is cancelled once the consumer stops.
+func (c *CBTClient) yieldBlocks(ctx context.Context, what string, startingOffset int64, open func(context.Context, int64) (func() (blockMetadataResponse, error), error), yield func(blocks.BlockMetadata, error) bool) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	stream, err := c.client.GetMetadataDelta(ctx, req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to call GetMetadataDelta: %w", err)
+	stopped := false
+	err := c.streamBlocks(ctx, what, startingOffset, open, func(block blocks.BlockMetadata) bool {
+		if !yield(block, nil) {
+			stopped = true
+		}
+		return !stopped
+	})
+	if err != nil && !stopped {
+		yield(blocks.BlockMetadata{}, err)
 	}
+}
 
+// collectBlocks gathers every extent of a metadata iterator
+func collectBlocks(seq iter.Seq2[blocks.BlockMetadata, error]) ([]blocks.BlockMetadata, error) {
 	var blockList []blocks.BlockMetadata
+	for block, err := range seq {
+		if err != nil {
+			return nil, err
+		}
+		blockList = append(blockList, block)
+	}
+	return blockList, nil
+}
+
+// blockMetadataResponse is a message of either metadata stream
+type blockMetadataResponse interface {
+	GetBlockMetadataType() api.BlockMetadataType
+	GetVolumeCapacityBytes() int64
+	GetBlockMetadata() []*api.BlockMetadata
+}
+
+// recordListing notes the block metadata type and volume capacity of a
+// stream message and checks the capacity against the expected one
+func (c *CBTClient) recordListing(resp blockMetadataResponse) error {
+	capacity := resp.GetVolumeCapacityBytes()
+	if c.volumeCapacity > 0 && capacity > 0 && capacity != c.volumeCapacity {
+		return fmt.Errorf("CBT service reports a volume capacity of %d bytes, but the snapshot's restore size is %d bytes", capacity, c.volumeCapacity)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t := resp.GetBlockMetadataType(); t != api.BlockMetadataType_UNKNOWN {
+		c.listing.BlockMetadataType = t.String()
+	}
+	if capacity > 0 {
+		c.listing.VolumeCapacityBytes = capacity
+	}
+	return nil
+}
+
+// streamBlocks passes every extent of a metadata stream from startingOffset
+// on to fn, until fn returns false. open starts the stream at a byte offset
+// and returns its receive function. FIXED_LENGTH blocks are coalesced into
+// runs of contiguous blocks before they are passed on. When the stream
+// breaks, it is reopened at the end of the last extent received, so extents
+// already delivered are neither lost nor repeated. At most c.retries reopens
+// are made per call, waiting c.retryBackoff before the first and twice as
+// long before each further one.
+func (c *CBTClient) streamBlocks(ctx context.Context, what string, startingOffset int64, open func(context.Context, int64) (func() (blockMetadataResponse, error), error), fn func(blocks.BlockMetadata) bool) error {
+	next := startingOffset
+	var received int
+	attempt := 0
+	backoff := c.retryBackoff
+
+	// run holds the FIXED_LENGTH blocks coalesced so far; it is passed on
+	// once a block does not continue it
+	var run *blocks.BlockMetadata
+	flush := func() bool {
+		if run == nil {
+			return true
+		}
+		block := *run
+		run = nil
+		return fn(block)
+	}
+
 	for {
-		resp, err := stream.Recv()
-		if err == io.EOF {
-			break
+		start := next
+		recv, err := open(ctx, start)
+		for err == nil {
+			var resp blockMetadataResponse
+			resp, err = recv()
+			if err != nil {
+				break
+			}
+			if err := c.recordListing(resp); err != nil {
+				return fmt.Errorf("error receiving %s: %w", what, err)
+			}
+			fixed := resp.GetBlockMetadataType() == api.BlockMetadataType_FIXED_LENGTH
+			for _, block := range resp.GetBlockMetadata() {
+				offset, size := block.GetByteOffset(), block.GetSizeBytes()
+				end := offset + size
+				if end <= start {
+					// Already delivered before the stream was reopened
+					continue
+				}
+				if offset < start {
+					offset, size = start, end-start
+				}
+				next = end
+				received++
+
+				if fixed && run != nil && run.Offset+run.Size == offset {
+					run.Size += size
+					continue
+				}
+				if !flush() {
+					return nil
+				}
+				if fixed {
+					run = &blocks.BlockMetadata{Offset: offset, Size: size}
+					continue
+				}
+				if !fn(blocks.BlockMetadata{Offset: offset, Size: size}) {
+					return nil
+				}
+			}
 		}
-		if err != nil {
-			return nil, fmt.Errorf("error receiving delta block metadata: %w", err)
+		if err == io.EOF {
+			flush()
+			return nil
 		}
 
-		for _, block := range resp.BlockMetadata {
-			blockList = append(blockList, blocks.BlockMetadata{
-				Offset: block.ByteOffset,
-				Size:   block.SizeBytes,
-			})
+		if !retryableStreamError(ctx, err) || attempt >= c.retries {
+			if attempt > 0 {
+				return fmt.Errorf("error receiving %s after %d retries: %w", what, attempt, err)
+			}
+			return fmt.Errorf("error receiving %s: %w", what, err)
 		}
+		attempt++
+
+		fmt.Printf("⚠ CBT stream broke after %d extents: %v\n", received, err)
+		fmt.Printf("  Resuming from offset %d in %s (retry %d/%d)\n", next, backoff, attempt, c.retries)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return fmt.Errorf("error receiving %s: %w", what, ctx.Err())
+		}
+		backoff *= 2
 	}
+}
 
-	return blockList, nil
+// retryableStreamError reports whether reopening a metadata stream that
+// failed with err may succeed. Errors that say the request itself is wrong,
+// and cancellation by the caller, are final.
+func retryableStreamError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.NotFound, codes.PermissionDenied, codes.Unauthenticated,
+		codes.FailedPrecondition, codes.OutOfRange, codes.Unimplemented, codes.Canceled:
+		return false
+	}
+	return true
 }
 
 // GetSnapshotInfo retrieves detailed information about a VolumeSnapshot
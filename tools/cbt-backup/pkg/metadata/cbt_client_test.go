@@ -0,0 +1,85 @@
+package metadata
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func snapshotMetadataService(name, address string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "cbt.storage.k8s.io/v1alpha1",
+		"kind":       "SnapshotMetadataService",
+		"metadata":   map[string]interface{}{"name": name},
+		"spec": map[string]interface{}{
+			"address": address,
+		},
+	}}
+}
+
+func TestDiscoverServiceByDriver(t *testing.T) {
+	gvr := schema.GroupVersionResource{Group: "cbt.storage.k8s.io", Version: "v1alpha1", Resource: "snapshotmetadataservices"}
+	listKinds := map[schema.GroupVersionResource]string{gvr: "SnapshotMetadataServiceList"}
+
+	hostpath := snapshotMetadataService("hostpath.csi.k8s.io", "hostpath-sidecar:6443")
+	ceph := snapshotMetadataService("rbd.csi.ceph.com", "ceph-sidecar:6443")
+
+	tests := []struct {
+		name        string
+		services    []runtime.Object
+		driver      string
+		wantAddress string
+		wantErr     string
+	}{
+		{
+			name:        "driver selects its service",
+			services:    []runtime.Object{hostpath, ceph},
+			driver:      "rbd.csi.ceph.com",
+			wantAddress: "ceph-sidecar:6443",
+		},
+		{
+			name:     "no service for driver",
+			services: []runtime.Object{hostpath},
+			driver:   "rbd.csi.ceph.com",
+			wantErr:  "for CSI driver rbd.csi.ceph.com",
+		},
+		{
+			name:        "single service without driver",
+			services:    []runtime.Object{hostpath},
+			wantAddress: "hostpath-sidecar:6443",
+		},
+		{
+			name:     "several services without driver",
+			services: []runtime.Object{hostpath, ceph},
+			wantErr:  "found 2 SnapshotMetadataService resources",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &CBTClient{
+				dynClient: dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, tt.services...),
+			}
+			c.SetDriver(tt.driver)
+
+			address, _, _, err := c.discoverService(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("discoverService() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("discoverService() failed: %v", err)
+			}
+			if address != tt.wantAddress {
+				t.Errorf("address = %q, want %q", address, tt.wantAddress)
+			}
+		})
+	}
+}
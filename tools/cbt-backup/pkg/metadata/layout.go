@@ -0,0 +1,76 @@
+package metadata
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/blocks"
+)
+
+// Block layouts describe where a snapshot's block data lives in the bucket
+const (
+	// LayoutPerSnapshot stores every extent of a snapshot under
+	// blocks/<snapshot>/block-<offset>-<size>. Manifests without a layout use it.
+	LayoutPerSnapshot = "per-snapshot"
+	// LayoutContentAddressed stores each distinct extent once, keyed by the
+	// SHA-256 of its data, so identical blocks are shared between snapshots
+	// and PVCs.
+	LayoutContentAddressed = "content-addressed"
+	// LayoutPacked appends a snapshot's extents to large pack objects under
+	// blocks/<snapshot>/pack-<n>. Each block list entry records the pack and
+	// the byte range of its data.
+	LayoutPacked = "packed"
+
+	// ContentAddressedPrefix holds content-addressed block objects. The
+	// underscore cannot appear in a Kubernetes object name, so the prefix
+	// never collides with a per-snapshot blocks/<snapshot>/ prefix.
+	ContentAddressedPrefix = "blocks/_sha256/"
+)
+
+// BlockObjectPath returns the object key holding a block of the snapshot
+// described by manifest
+func BlockObjectPath(manifest *SnapshotManifest, block blocks.BlockMetadata) string {
+	if block.Object != "" {
+		return block.Object
+	}
+	if manifest.BlockLayout == LayoutContentAddressed {
+		return ContentAddressedPath(block.Checksum, block.Compression)
+	}
+	return fmt.Sprintf("blocks/%s/block-%d-%d", manifest.Name, block.Offset, block.Size)
+}
+
+// PackObjectPath returns the object key of the n-th pack of a snapshot
+func PackObjectPath(snapshotName string, n int) string {
+	return fmt.Sprintf("blocks/%s/pack-%06d", snapshotName, n)
+}
+
+// ContentAddressedPath returns the object key for a block with the given
+// SHA-256 digest. Compressed copies carry the codec as a suffix so a digest
+// always maps to one encoding.
+func ContentAddressedPath(digest, compression string) string {
+	name := digest
+	if compression != "" {
+		name = digest + "." + compression
+	}
+	if len(digest) < 2 {
+		return ContentAddressedPrefix + name
+	}
+	return ContentAddressedPrefix + digest[:2] + "/" + name
+}
+
+// BlockAssociatedData returns what an encrypted block is bound to, so a
+// stored block cannot be passed off as another. Content-addressed objects
+// are bound to their key, which every extent with the same data shares.
+// Other blocks are bound to the snapshot that sealed them and the extent
+// they hold rather than their object: consolidation copies them under new
+// names, and packed blocks are sealed before their pack is chosen.
+func BlockAssociatedData(manifest *SnapshotManifest, block blocks.BlockMetadata) []byte {
+	if obj := BlockObjectPath(manifest, block); strings.HasPrefix(obj, ContentAddressedPrefix) {
+		return []byte(obj)
+	}
+	sealedBy := block.SealedBy
+	if sealedBy == "" {
+		sealedBy = manifest.Name
+	}
+	return []byte(fmt.Sprintf("snapshot %s extent %d+%d", sealedBy, block.Offset, block.Size))
+}
@@ -23,7 +23,41 @@ type SnapshotManifest struct {
 	StorageClass      string    `json:"storageClass"`
 	VolumeMode        string    `json:"volumeMode"`
 	CSIDriver         string    `json:"csiDriver"`
+	BlockMetadataType string    `json:"blockMetadataType,omitempty"`   // "FIXED_LENGTH" or "VARIABLE_LENGTH", as reported by CBT
+	VolumeCapacity    int64     `json:"volumeCapacityBytes,omitempty"` // Volume capacity reported by CBT
 	SnapshotClassName string    `json:"snapshotClassName"`
+	DataSource        string    `json:"dataSource,omitempty"`  // "device" (live source) or "snapshot" (PVC provisioned from the snapshot)
+	BlockLayout       string    `json:"blockLayout,omitempty"` // LayoutPerSnapshot (default), LayoutContentAddressed or LayoutPacked
+	Compression       string    `json:"compression,omitempty"` // Block codec requested for the backup ("none", "zstd", "lz4")
+	Cipher            string    `json:"cipher,omitempty"`      // Algorithm encrypting block data and metadata; empty when unencrypted
+	KeyID             string    `json:"keyId,omitempty"`       // Repository key that encrypted the block data and metadata
+	ConsolidatedFrom  []string  `json:"consolidatedFrom,omitempty"`
+	State             string    `json:"state,omitempty"` // Commit state of the backup; empty for backups written before states were recorded
+}
+
+// Backup states recorded in SnapshotManifest.State. A manifest is written
+// InProgress before any block data and rewritten with its final state only
+// after the block list and chain are in place.
+const (
+	StateInProgress   = "InProgress"
+	StateCompleted    = "Completed"
+	StateFailed       = "Failed"
+	StateMetadataOnly = "MetadataOnly" // Committed without block data, e.g. when CBT was unavailable and no device was given
+)
+
+// Committed reports whether the backup finished writing its metadata
+func (m *SnapshotManifest) Committed() bool {
+	switch m.State {
+	case "", StateCompleted, StateMetadataOnly:
+		return true
+	}
+	return false
+}
+
+// Restorable reports whether the backup holds the block data it describes,
+// so that it can be restored or serve as the base of an incremental
+func (m *SnapshotManifest) Restorable() bool {
+	return m.State == "" || m.State == StateCompleted
 }
 
 // BlockList contains the list of blocks in a snapshot
@@ -39,6 +73,23 @@ type SnapshotChain struct {
 	Dependencies     []string `json:"dependencies"` // List of snapshots needed for restore
 }
 
+// BackupCheckpoint records the progress of a backup that has not finished,
+// so that it can be resumed against the same VolumeSnapshot. The leading
+// extents whose entries are final are in the block list segments written
+// before the checkpoint; the checkpoint holds the extents listed after them.
+type BackupCheckpoint struct {
+	Manifest          SnapshotManifest       `json:"manifest"`                    // Manifest as of the start of the backup
+	Extents           []blocks.BlockMetadata `json:"extents"`                     // Extents listed but not yet in a block list segment
+	Uploaded          []blocks.BlockMetadata `json:"uploaded"`                    // Extents stored but not yet in a block list segment, with their storage fields
+	ListedThrough     int64                  `json:"listedThrough,omitempty"`     // End of the last extent listed
+	ListingIncomplete bool                   `json:"listingIncomplete,omitempty"` // Extents after ListedThrough are still to be listed
+	NextPack          int                    `json:"nextPack,omitempty"`          // Sequence number of the next pack (packed layout)
+	SegmentRun        int                    `json:"segmentRun,omitempty"`        // Attempt that wrote the block list segments; each resume starts a new one
+	Segments          int                    `json:"segments,omitempty"`          // Block list segments of SegmentRun holding the leading final entries
+	CBTEnabled        bool                   `json:"cbtEnabled"`
+	Updated           time.Time              `json:"updated"`
+}
+
 // Catalog is the global catalog of all snapshots
 type Catalog struct {
 	Version   string              `json:"version"`
@@ -96,6 +147,7 @@ type RestoreStats struct {
 	BlocksDownloaded  int           `json:"blocksDownloaded"`
 	BlocksWritten     int           `json:"blocksWritten"`
 	SnapshotsApplied  int           `json:"snapshotsApplied"`
+	BytesSuperseded   int64         `json:"bytesSuperseded"`
 	AverageBlockSize  int64         `json:"averageBlockSize"`
 	RestoreThroughput float64       `json:"restoreThroughput"` // MB/s
 	ChecksumVerified  int           `json:"checksumVerified"`
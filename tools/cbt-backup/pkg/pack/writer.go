@@ -0,0 +1,98 @@
+package pack
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/metadata"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/storage"
+)
+
+const (
+	// DefaultPackSize is the default target size of a pack object (64MB)
+	DefaultPackSize = 64 * 1024 * 1024
+)
+
+// Location is where a block's data was placed within a pack
+type Location struct {
+	Object string
+	Offset int64
+	Size   int64
+}
+
+// Writer aggregates block data into pack objects and uploads each pack once
+// it reaches the target size. Blocks are stored back to back; the byte range
+// of each one is recorded by the caller in the snapshot's block list.
+type Writer struct {
+	client       *storage.Client
+	snapshotName string
+	targetSize   int64
+	buf          bytes.Buffer
+	seq          int
+
+	PacksUploaded int
+	BytesUploaded int64
+}
+
+// NewWriter creates a pack writer for a snapshot
+func NewWriter(client *storage.Client, snapshotName string, targetSize int64) *Writer {
+	if targetSize <= 0 {
+		targetSize = DefaultPackSize
+	}
+
+	return &Writer{
+		client:       client,
+		snapshotName: snapshotName,
+		targetSize:   targetSize,
+	}
+}
+
+// Next returns the sequence number of the pack currently being filled
+func (w *Writer) Next() int {
+	return w.seq
+}
+
+// StartAt makes the writer continue at pack n, e.g. when a resumed backup
+// already uploaded the packs before it
+func (w *Writer) StartAt(n int) {
+	w.seq = n
+}
+
+// Add appends data to the current pack and returns its location. The pack is
+// uploaded when it reaches the target size, so the location is only readable
+// after the next upload or Flush.
+func (w *Writer) Add(ctx context.Context, data []byte) (Location, error) {
+	loc := Location{
+		Object: metadata.PackObjectPath(w.snapshotName, w.seq),
+		Offset: int64(w.buf.Len()),
+		Size:   int64(len(data)),
+	}
+	w.buf.Write(data)
+
+	if int64(w.buf.Len()) >= w.targetSize {
+		if err := w.Flush(ctx); err != nil {
+			return Location{}, err
+		}
+	}
+
+	return loc, nil
+}
+
+// Flush uploads the current pack if it holds any data
+func (w *Writer) Flush(ctx context.Context) error {
+	if w.buf.Len() == 0 {
+		return nil
+	}
+
+	packPath := metadata.PackObjectPath(w.snapshotName, w.seq)
+	if err := w.client.UploadBlock(ctx, packPath, w.buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to upload pack %s: %w", packPath, err)
+	}
+
+	w.PacksUploaded++
+	w.BytesUploaded += int64(w.buf.Len())
+	w.seq++
+	w.buf.Reset()
+	return nil
+}
@@ -0,0 +1,83 @@
+package retention
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/metadata"
+)
+
+// Policy describes how many snapshots of a PVC to keep. Each rule keeps the
+// newest snapshot of its most recent N periods; a snapshot kept by any rule
+// is retained.
+type Policy struct {
+	KeepLast    int
+	KeepHourly  int
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+}
+
+// Empty reports whether the policy has no rules. An empty policy would
+// delete every snapshot, so callers should refuse it.
+func (p Policy) Empty() bool {
+	return p.KeepLast <= 0 && p.KeepHourly <= 0 && p.KeepDaily <= 0 && p.KeepWeekly <= 0 && p.KeepMonthly <= 0
+}
+
+// rule keeps the newest snapshot in each of the latest count periods
+type rule struct {
+	name   string
+	count  int
+	period func(t time.Time) string
+}
+
+func (p Policy) rules() []rule {
+	return []rule{
+		{"last", p.KeepLast, func(t time.Time) string { return t.Format(time.RFC3339Nano) }},
+		{"hourly", p.KeepHourly, func(t time.Time) string { return t.Format("2006-01-02 15") }},
+		{"daily", p.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", p.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{"monthly", p.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+}
+
+// Apply selects the snapshots of one PVC that the policy keeps. It returns
+// the reasons each kept snapshot matched, keyed by snapshot name.
+func (p Policy) Apply(entries []metadata.CatalogEntry) map[string][]string {
+	sorted := make([]metadata.CatalogEntry, len(entries))
+	copy(sorted, entries)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Timestamp.Equal(sorted[j].Timestamp) {
+			// A consolidated full backup shares the timestamp of the
+			// incremental it replaces; prefer keeping the full backup
+			return !sorted[i].IsIncremental && sorted[j].IsIncremental
+		}
+		return sorted[i].Timestamp.After(sorted[j].Timestamp)
+	})
+
+	keep := make(map[string][]string)
+	for _, r := range p.rules() {
+		if r.count <= 0 {
+			continue
+		}
+
+		seen := make(map[string]bool)
+		for _, e := range sorted {
+			if len(seen) == r.count {
+				break
+			}
+			period := r.period(e.Timestamp.UTC())
+			if seen[period] {
+				continue
+			}
+			seen[period] = true
+			keep[e.Name] = append(keep[e.Name], r.name)
+		}
+	}
+
+	return keep
+}
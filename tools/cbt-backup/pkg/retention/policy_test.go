@@ -0,0 +1,141 @@
+package retention
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/metadata"
+)
+
+func TestApply(t *testing.T) {
+	at := func(day, hour int) time.Time {
+		return time.Date(2025, 1, day, hour, 0, 0, 0, time.UTC)
+	}
+	// 2025-01-13 is the Monday starting ISO week 3
+	entries := []metadata.CatalogEntry{
+		{Name: "f", Timestamp: at(2, 12)},
+		{Name: "e", Timestamp: at(10, 12), IsIncremental: true, BaseSnapshot: "f"},
+		{Name: "d", Timestamp: at(13, 12), IsIncremental: true, BaseSnapshot: "e"},
+		{Name: "c", Timestamp: at(14, 23), IsIncremental: true, BaseSnapshot: "d"},
+		{Name: "b", Timestamp: at(15, 8), IsIncremental: true, BaseSnapshot: "c"},
+		{Name: "a", Timestamp: at(15, 10), IsIncremental: true, BaseSnapshot: "b"},
+	}
+
+	tests := []struct {
+		name   string
+		policy Policy
+		want   map[string][]string
+	}{
+		{
+			name:   "keep last",
+			policy: Policy{KeepLast: 2},
+			want:   map[string][]string{"a": {"last"}, "b": {"last"}},
+		},
+		{
+			name:   "keep daily",
+			policy: Policy{KeepDaily: 3},
+			want:   map[string][]string{"a": {"daily"}, "c": {"daily"}, "d": {"daily"}},
+		},
+		{
+			name:   "keep weekly",
+			policy: Policy{KeepWeekly: 2},
+			want:   map[string][]string{"a": {"weekly"}, "e": {"weekly"}},
+		},
+		{
+			name:   "keep last and daily",
+			policy: Policy{KeepLast: 1, KeepDaily: 2},
+			want:   map[string][]string{"a": {"last", "daily"}, "c": {"daily"}},
+		},
+		{
+			name:   "keep daily, weekly and monthly",
+			policy: Policy{KeepDaily: 2, KeepWeekly: 3, KeepMonthly: 1},
+			want: map[string][]string{
+				"a": {"daily", "weekly", "monthly"},
+				"c": {"daily"},
+				"e": {"weekly"},
+				"f": {"weekly"},
+			},
+		},
+		{
+			name:   "more periods than snapshots",
+			policy: Policy{KeepLast: 10},
+			want: map[string][]string{
+				"a": {"last"}, "b": {"last"}, "c": {"last"},
+				"d": {"last"}, "e": {"last"}, "f": {"last"},
+			},
+		},
+		{
+			name:   "no rules",
+			policy: Policy{},
+			want:   map[string][]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.policy.Apply(entries)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Apply = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyPrefersConsolidatedFullBackup(t *testing.T) {
+	ts := time.Date(2025, 1, 15, 10, 0, 0, 0, time.UTC)
+	entries := []metadata.CatalogEntry{
+		{Name: "incremental", Timestamp: ts, IsIncremental: true, BaseSnapshot: "base"},
+		{Name: "consolidated", Timestamp: ts},
+		{Name: "base", Timestamp: ts.Add(-time.Hour)},
+	}
+
+	got := Policy{KeepLast: 1}.Apply(entries)
+	want := map[string][]string{"consolidated": {"last"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Apply = %v, want %v", got, want)
+	}
+}
+
+// TestApplySkipsUncommittedBackups checks that failed and in-progress
+// backups, which the catalog leaves out, are never selected even when they
+// are the newest
+func TestApplySkipsUncommittedBackups(t *testing.T) {
+	base := time.Date(2025, 1, 15, 10, 0, 0, 0, time.UTC)
+	manifests := []metadata.SnapshotManifest{
+		{Name: "snap-1", PVCName: "data", Timestamp: base, State: metadata.StateCompleted},
+		{Name: "snap-2", PVCName: "data", Timestamp: base.Add(time.Hour), State: metadata.StateFailed},
+		{Name: "snap-3", PVCName: "data", Timestamp: base.Add(2 * time.Hour), State: metadata.StateCompleted},
+		{Name: "snap-4", PVCName: "data", Timestamp: base.Add(3 * time.Hour), State: metadata.StateInProgress},
+		{Name: "snap-5", PVCName: "data", Timestamp: base.Add(4 * time.Hour), State: metadata.StateFailed},
+	}
+	catalog := metadata.BuildCatalog(manifests)
+
+	var entries []metadata.CatalogEntry
+	for _, name := range catalog.Chains["data"] {
+		if entry, ok := catalog.Find(name); ok {
+			entries = append(entries, entry)
+		}
+	}
+
+	got := Policy{KeepLast: 2, KeepHourly: 5}.Apply(entries)
+	want := map[string][]string{
+		"snap-3": {"last", "hourly"},
+		"snap-1": {"last", "hourly"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Apply = %v, want %v", got, want)
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	if !(Policy{}).Empty() {
+		t.Error("policy without rules is not empty")
+	}
+	if !(Policy{KeepLast: -1}).Empty() {
+		t.Error("policy with only a negative rule is not empty")
+	}
+	if (Policy{KeepMonthly: 1}).Empty() {
+		t.Error("policy with a monthly rule is empty")
+	}
+}
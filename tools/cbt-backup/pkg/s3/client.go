@@ -3,15 +3,17 @@ package s3
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
+	"strings"
 
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/storage"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 )
 
-// Client wraps MinIO/S3 operations
+// Client stores a repository in an S3 bucket through MinIO. It implements
+// storage.ConditionalBackend, storage.Copier and storage.Initializer.
 type Client struct {
 	client     *minio.Client
 	bucketName string
@@ -42,8 +44,8 @@ func NewClient(cfg Config) (*Client, error) {
 	}, nil
 }
 
-// EnsureBucket ensures the bucket exists
-func (c *Client) EnsureBucket(ctx context.Context) error {
+// Init ensures the bucket exists
+func (c *Client) Init(ctx context.Context) error {
 	exists, err := c.client.BucketExists(ctx, c.bucketName)
 	if err != nil {
 		return fmt.Errorf("failed to check bucket: %w", err)
@@ -60,113 +62,133 @@ func (c *Client) EnsureBucket(ctx context.Context) error {
 	return nil
 }
 
-// UploadBlock uploads a block of data
-func (c *Client) UploadBlock(ctx context.Context, objectPath string, data []byte) error {
-	reader := bytes.NewReader(data)
-	_, err := c.client.PutObject(ctx, c.bucketName, objectPath, reader, int64(len(data)), minio.PutObjectOptions{
-		ContentType: "application/octet-stream",
-	})
-	if err != nil {
-		return fmt.Errorf("failed to upload block %s: %w", objectPath, err)
-	}
-
-	return nil
+// Put creates or replaces an object
+func (c *Client) Put(ctx context.Context, key string, data []byte) error {
+	return c.put(ctx, key, data, minio.PutObjectOptions{})
 }
 
-// UploadJSON uploads JSON data
-func (c *Client) UploadJSON(ctx context.Context, objectPath string, data interface{}) error {
-	jsonData, err := json.MarshalIndent(data, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal JSON: %w", err)
+// PutIfMatch writes the object only if it still has the given ETag, or, when
+// etag is empty, only if it does not exist yet
+func (c *Client) PutIfMatch(ctx context.Context, key string, data []byte, etag string) error {
+	opts := minio.PutObjectOptions{}
+	if etag == "" {
+		opts.SetMatchETagExcept("*")
+	} else {
+		opts.SetMatchETag(etag)
 	}
+	return c.put(ctx, key, data, opts)
+}
 
-	reader := bytes.NewReader(jsonData)
-	_, err = c.client.PutObject(ctx, c.bucketName, objectPath, reader, int64(len(jsonData)), minio.PutObjectOptions{
-		ContentType: "application/json",
-	})
+func (c *Client) put(ctx context.Context, key string, data []byte, opts minio.PutObjectOptions) error {
+	opts.ContentType = "application/octet-stream"
+	if strings.HasSuffix(key, ".json") {
+		opts.ContentType = "application/json"
+	}
+	_, err := c.client.PutObject(ctx, c.bucketName, key, bytes.NewReader(data), int64(len(data)), opts)
 	if err != nil {
-		return fmt.Errorf("failed to upload JSON %s: %w", objectPath, err)
+		if minio.ToErrorResponse(err).Code == "PreconditionFailed" {
+			return storage.ErrPreconditionFailed
+		}
+		return err
 	}
 
 	return nil
 }
 
-// DownloadObject downloads an object
-func (c *Client) DownloadObject(ctx context.Context, objectPath string) ([]byte, error) {
-	obj, err := c.client.GetObject(ctx, c.bucketName, objectPath, minio.GetObjectOptions{})
-	if err != nil {
-		return nil, fmt.Errorf("failed to get object %s: %w", objectPath, err)
-	}
-	defer obj.Close()
+// Get reads a whole object
+func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	data, _, err := c.get(ctx, key, minio.GetObjectOptions{}, false)
+	return data, err
+}
 
-	data, err := io.ReadAll(obj)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read object %s: %w", objectPath, err)
-	}
+// GetWithETag reads a whole object along with its ETag
+func (c *Client) GetWithETag(ctx context.Context, key string) ([]byte, string, error) {
+	return c.get(ctx, key, minio.GetObjectOptions{}, true)
+}
 
-	return data, nil
+// GetRange reads length bytes of an object starting at offset
+func (c *Client) GetRange(ctx context.Context, key string, offset, length int64) ([]byte, error) {
+	opts := minio.GetObjectOptions{}
+	if err := opts.SetRange(offset, offset+length-1); err != nil {
+		return nil, fmt.Errorf("invalid range: %w", err)
+	}
+	data, _, err := c.get(ctx, key, opts, false)
+	return data, err
 }
 
-// DownloadJSON downloads and unmarshals JSON data
-func (c *Client) DownloadJSON(ctx context.Context, objectPath string, target interface{}) error {
-	data, err := c.DownloadObject(ctx, objectPath)
+func (c *Client) get(ctx context.Context, key string, opts minio.GetObjectOptions, withETag bool) ([]byte, string, error) {
+	obj, err := c.client.GetObject(ctx, c.bucketName, key, opts)
 	if err != nil {
-		return err
+		return nil, "", mapError(err)
 	}
+	defer obj.Close()
 
-	if err := json.Unmarshal(data, target); err != nil {
-		return fmt.Errorf("failed to unmarshal JSON from %s: %w", objectPath, err)
+	var etag string
+	if withETag {
+		info, err := obj.Stat()
+		if err != nil {
+			return nil, "", mapError(err)
+		}
+		etag = info.ETag
 	}
 
-	return nil
+	data, err := io.ReadAll(obj)
+	if err != nil {
+		return nil, "", mapError(err)
+	}
+
+	return data, etag, nil
 }
 
-// ListObjects lists objects with a given prefix
-func (c *Client) ListObjects(ctx context.Context, prefix string) ([]string, error) {
-	var objects []string
+// List returns every object whose key starts with prefix, in key order
+func (c *Client) List(ctx context.Context, prefix string) ([]storage.ObjectInfo, error) {
+	var objects []storage.ObjectInfo
 
 	for object := range c.client.ListObjects(ctx, c.bucketName, minio.ListObjectsOptions{
 		Prefix:    prefix,
 		Recursive: true,
 	}) {
 		if object.Err != nil {
-			return nil, fmt.Errorf("error listing objects: %w", object.Err)
+			return nil, object.Err
 		}
-		objects = append(objects, object.Key)
+		objects = append(objects, storage.ObjectInfo{
+			Key:          object.Key,
+			Size:         object.Size,
+			LastModified: object.LastModified,
+		})
 	}
 
 	return objects, nil
 }
 
-// ObjectExists checks if an object exists
-func (c *Client) ObjectExists(ctx context.Context, objectPath string) (bool, error) {
-	_, err := c.client.StatObject(ctx, c.bucketName, objectPath, minio.StatObjectOptions{})
+// Stat returns an object's size and modification time
+func (c *Client) Stat(ctx context.Context, key string) (storage.ObjectInfo, error) {
+	stat, err := c.client.StatObject(ctx, c.bucketName, key, minio.StatObjectOptions{})
 	if err != nil {
-		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
-			return false, nil
-		}
-		return false, fmt.Errorf("failed to stat object %s: %w", objectPath, err)
+		return storage.ObjectInfo{}, mapError(err)
 	}
 
-	return true, nil
+	return storage.ObjectInfo{Key: key, Size: stat.Size, LastModified: stat.LastModified}, nil
 }
 
-// GetObjectSize gets the size of an object
-func (c *Client) GetObjectSize(ctx context.Context, objectPath string) (int64, error) {
-	stat, err := c.client.StatObject(ctx, c.bucketName, objectPath, minio.StatObjectOptions{})
-	if err != nil {
-		return 0, fmt.Errorf("failed to stat object %s: %w", objectPath, err)
-	}
+// Copy copies an object within the bucket without downloading it
+func (c *Client) Copy(ctx context.Context, srcKey, dstKey string) error {
+	_, err := c.client.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: c.bucketName, Object: dstKey},
+		minio.CopySrcOptions{Bucket: c.bucketName, Object: srcKey},
+	)
+	return err
+}
 
-	return stat.Size, nil
+// Delete removes an object
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.client.RemoveObject(ctx, c.bucketName, key, minio.RemoveObjectOptions{})
 }
 
-// DeleteObject deletes an object
-func (c *Client) DeleteObject(ctx context.Context, objectPath string) error {
-	err := c.client.RemoveObject(ctx, c.bucketName, objectPath, minio.RemoveObjectOptions{})
-	if err != nil {
-		return fmt.Errorf("failed to delete object %s: %w", objectPath, err)
+// mapError wraps storage.ErrNotFound around S3's error for a missing object
+func mapError(err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return fmt.Errorf("%w: %v", storage.ErrNotFound, err)
 	}
-
-	return nil
+	return err
 }
@@ -0,0 +1,157 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// MoverLabel marks resources created for a snapshot-sourced backup
+	MoverLabel = "cbt-backup.kaovilai.io/mover"
+	// SnapshotLabel records the VolumeSnapshot a mover resource belongs to
+	SnapshotLabel = "cbt-backup.kaovilai.io/snapshot"
+)
+
+// MoverPodOptions describes a short-lived pod that reads block data from a
+// PVC provisioned from a snapshot
+type MoverPodOptions struct {
+	Name               string
+	SnapshotName       string
+	Image              string
+	ServiceAccountName string
+	PVCName            string
+	DevicePath         string
+	Command            []string
+	Env                []corev1.EnvVar
+}
+
+// CreateMoverPod creates a pod that attaches the PVC as a raw block device
+// and runs the given command
+func (m *Manager) CreateMoverPod(ctx context.Context, opts MoverPodOptions) (*corev1.Pod, error) {
+	privileged := true
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      opts.Name,
+			Namespace: m.namespace,
+			Labels: map[string]string{
+				MoverLabel:    "true",
+				SnapshotLabel: opts.SnapshotName,
+			},
+		},
+		Spec: corev1.PodSpec{
+			ServiceAccountName: opts.ServiceAccountName,
+			RestartPolicy:      corev1.RestartPolicyNever,
+			Containers: []corev1.Container{
+				{
+					Name:            "mover",
+					Image:           opts.Image,
+					ImagePullPolicy: corev1.PullIfNotPresent,
+					Command:         opts.Command,
+					Env:             opts.Env,
+					VolumeDevices: []corev1.VolumeDevice{
+						{
+							Name:       "snapshot-data",
+							DevicePath: opts.DevicePath,
+						},
+					},
+					SecurityContext: &corev1.SecurityContext{
+						Privileged: &privileged,
+					},
+				},
+			},
+			Volumes: []corev1.Volume{
+				{
+					Name: "snapshot-data",
+					VolumeSource: corev1.VolumeSource{
+						PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+							ClaimName: opts.PVCName,
+							ReadOnly:  true,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	created, err := m.k8sClient.CoreV1().Pods(m.namespace).Create(ctx, pod, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create mover pod %s: %w", opts.Name, err)
+	}
+
+	fmt.Printf("Created mover pod: %s\n", created.Name)
+	return created, nil
+}
+
+// WaitForPodStarted waits until a pod has left the Pending phase
+func (m *Manager) WaitForPodStarted(ctx context.Context, podName string, timeout time.Duration) error {
+	err := wait.PollUntilContextTimeout(ctx, 2*time.Second, timeout, true, func(ctx context.Context) (bool, error) {
+		pod, err := m.k8sClient.CoreV1().Pods(m.namespace).Get(ctx, podName, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return pod.Status.Phase != corev1.PodPending, nil
+	})
+	if err != nil {
+		return fmt.Errorf("pod %s did not start: %w", podName, err)
+	}
+	return nil
+}
+
+// StreamPodLogs follows the logs of a pod's first container until it exits
+func (m *Manager) StreamPodLogs(ctx context.Context, podName string, w io.Writer) error {
+	req := m.k8sClient.CoreV1().Pods(m.namespace).GetLogs(podName, &corev1.PodLogOptions{Follow: true})
+	stream, err := req.Stream(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to stream logs for pod %s: %w", podName, err)
+	}
+	defer stream.Close()
+
+	if _, err := io.Copy(w, stream); err != nil {
+		return fmt.Errorf("failed to read logs for pod %s: %w", podName, err)
+	}
+	return nil
+}
+
+// WaitForPodCompletion waits for a pod to succeed and returns an error if it
+// fails or the timeout expires
+func (m *Manager) WaitForPodCompletion(ctx context.Context, podName string, timeout time.Duration) error {
+	var pod *corev1.Pod
+	err := wait.PollUntilContextTimeout(ctx, 2*time.Second, timeout, true, func(ctx context.Context) (bool, error) {
+		var err error
+		pod, err = m.k8sClient.CoreV1().Pods(m.namespace).Get(ctx, podName, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed, nil
+	})
+	if err != nil {
+		return fmt.Errorf("pod %s did not complete: %w", podName, err)
+	}
+
+	if pod.Status.Phase == corev1.PodFailed {
+		reason := pod.Status.Reason
+		for _, cs := range pod.Status.ContainerStatuses {
+			if cs.State.Terminated != nil {
+				reason = fmt.Sprintf("exit code %d (%s)", cs.State.Terminated.ExitCode, cs.State.Terminated.Reason)
+			}
+		}
+		return fmt.Errorf("pod %s failed: %s", podName, reason)
+	}
+
+	return nil
+}
+
+// DeletePod deletes a pod immediately
+func (m *Manager) DeletePod(ctx context.Context, podName string) error {
+	gracePeriod := int64(0)
+	return m.k8sClient.CoreV1().Pods(m.namespace).Delete(ctx, podName, metav1.DeleteOptions{
+		GracePeriodSeconds: &gracePeriod,
+	})
+}
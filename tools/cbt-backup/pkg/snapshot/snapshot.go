@@ -53,6 +53,16 @@ func NewManager(namespace string, kubeconfig string) (*Manager, error) {
 	}, nil
 }
 
+// NewManagerForClients creates a snapshot manager that uses existing clients,
+// e.g. fake clientsets in tests
+func NewManagerForClients(k8sClient kubernetes.Interface, snapshotClient snapclientset.Interface, namespace string) *Manager {
+	return &Manager{
+		k8sClient:      k8sClient,
+		snapshotClient: snapshotClient,
+		namespace:      namespace,
+	}
+}
+
 // CreateSnapshot creates a VolumeSnapshot for the given PVC
 func (m *Manager) CreateSnapshot(ctx context.Context, pvcName, snapshotName, snapshotClass string) (*snapshotv1.VolumeSnapshot, error) {
 	// Verify PVC exists and is block mode
@@ -152,7 +162,100 @@ func (m *Manager) GetPVC(ctx context.Context, pvcName string) (*corev1.Persisten
 	return m.k8sClient.CoreV1().PersistentVolumeClaims(m.namespace).Get(ctx, pvcName, metav1.GetOptions{})
 }
 
+// GetCSIDriver returns the name of the CSI driver that provisioned the
+// volume bound to a PVC
+func (m *Manager) GetCSIDriver(ctx context.Context, pvcName string) (string, error) {
+	pvc, err := m.GetPVC(ctx, pvcName)
+	if err != nil {
+		return "", fmt.Errorf("failed to get PVC %s: %w", pvcName, err)
+	}
+	if pvc.Spec.VolumeName == "" {
+		return "", fmt.Errorf("PVC %s is not bound to a volume", pvcName)
+	}
+
+	pv, err := m.k8sClient.CoreV1().PersistentVolumes().Get(ctx, pvc.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get PersistentVolume %s: %w", pvc.Spec.VolumeName, err)
+	}
+	if pv.Spec.CSI == nil || pv.Spec.CSI.Driver == "" {
+		return "", fmt.Errorf("PersistentVolume %s was not provisioned by a CSI driver", pv.Name)
+	}
+	return pv.Spec.CSI.Driver, nil
+}
+
 // DeleteSnapshot deletes a snapshot
 func (m *Manager) DeleteSnapshot(ctx context.Context, snapshotName string) error {
 	return m.snapshotClient.SnapshotV1().VolumeSnapshots(m.namespace).Delete(ctx, snapshotName, metav1.DeleteOptions{})
 }
+
+// CreatePVCFromSnapshot provisions a Block-mode PVC whose data source is the
+// given VolumeSnapshot. Storage class and access modes are copied from the
+// source PVC, and the size is the larger of the snapshot's restore size and
+// the source PVC's request.
+func (m *Manager) CreatePVCFromSnapshot(ctx context.Context, snap *snapshotv1.VolumeSnapshot, sourcePVC *corev1.PersistentVolumeClaim, pvcName string) (*corev1.PersistentVolumeClaim, error) {
+	size := sourcePVC.Spec.Resources.Requests[corev1.ResourceStorage]
+	if snap.Status != nil && snap.Status.RestoreSize != nil && snap.Status.RestoreSize.Cmp(size) > 0 {
+		size = *snap.Status.RestoreSize
+	}
+
+	accessModes := sourcePVC.Spec.AccessModes
+	if len(accessModes) == 0 {
+		accessModes = []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce}
+	}
+
+	volumeMode := corev1.PersistentVolumeBlock
+	apiGroup := snapshotv1.GroupName
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pvcName,
+			Namespace: m.namespace,
+			Labels: map[string]string{
+				MoverLabel:    "true",
+				SnapshotLabel: snap.Name,
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      accessModes,
+			StorageClassName: sourcePVC.Spec.StorageClassName,
+			VolumeMode:       &volumeMode,
+			DataSource: &corev1.TypedLocalObjectReference{
+				APIGroup: &apiGroup,
+				Kind:     "VolumeSnapshot",
+				Name:     snap.Name,
+			},
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: size,
+				},
+			},
+		},
+	}
+
+	created, err := m.k8sClient.CoreV1().PersistentVolumeClaims(m.namespace).Create(ctx, pvc, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create PVC %s from snapshot %s: %w", pvcName, snap.Name, err)
+	}
+
+	fmt.Printf("Created PVC %s from snapshot %s (size: %s)\n", created.Name, snap.Name, size.String())
+	return created, nil
+}
+
+// DeletePVC deletes a PVC
+func (m *Manager) DeletePVC(ctx context.Context, pvcName string) error {
+	return m.k8sClient.CoreV1().PersistentVolumeClaims(m.namespace).Delete(ctx, pvcName, metav1.DeleteOptions{})
+}
+
+// GetSecretValue returns one data entry of a Secret
+func (m *Manager) GetSecretValue(ctx context.Context, secretName, key string) ([]byte, error) {
+	secret, err := m.k8sClient.CoreV1().Secrets(m.namespace).Get(ctx, secretName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret %s: %w", secretName, err)
+	}
+
+	value, ok := secret.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("secret %s has no key %q", secretName, key)
+	}
+	return value, nil
+}
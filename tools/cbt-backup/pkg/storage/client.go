@@ -0,0 +1,285 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-backup/pkg/encryption"
+)
+
+// Client reads and writes repository objects through a Backend. JSON
+// metadata is sealed with the repository key when a keyring is set.
+type Client struct {
+	backend Backend
+	keyring *encryption.Keyring
+}
+
+// NewClient creates a client for the repository stored in backend
+func NewClient(backend Backend) *Client {
+	return &Client{backend: backend}
+}
+
+// Init prepares the backend for writing, if it needs to be
+func (c *Client) Init(ctx context.Context) error {
+	if b, ok := c.backend.(Initializer); ok {
+		return b.Init(ctx)
+	}
+	return nil
+}
+
+// SetKeyring enables encryption of JSON metadata. Objects are sealed with the
+// keyring's active key on upload and opened on download.
+func (c *Client) SetKeyring(keyring *encryption.Keyring) {
+	c.keyring = keyring
+}
+
+// UploadBlock uploads a block of data
+func (c *Client) UploadBlock(ctx context.Context, objectPath string, data []byte) error {
+	if err := c.backend.Put(ctx, objectPath, data); err != nil {
+		return fmt.Errorf("failed to upload block %s: %w", objectPath, err)
+	}
+	return nil
+}
+
+// UploadJSON uploads JSON data
+func (c *Client) UploadJSON(ctx context.Context, objectPath string, data interface{}) error {
+	jsonData, err := c.marshalJSON(objectPath, data)
+	if err != nil {
+		return err
+	}
+	if err := c.backend.Put(ctx, objectPath, jsonData); err != nil {
+		return fmt.Errorf("failed to upload JSON %s: %w", objectPath, err)
+	}
+	return nil
+}
+
+// UploadJSONIfMatch uploads JSON data only if the object still has the given
+// ETag, or, when etag is empty, only if the object does not exist yet. It
+// returns ErrPreconditionFailed if another writer got there first.
+func (c *Client) UploadJSONIfMatch(ctx context.Context, objectPath string, data interface{}, etag string) error {
+	b, ok := c.backend.(ConditionalBackend)
+	if !ok {
+		return fmt.Errorf("storage backend does not support conditional writes")
+	}
+	jsonData, err := c.marshalJSON(objectPath, data)
+	if err != nil {
+		return err
+	}
+	if err := b.PutIfMatch(ctx, objectPath, jsonData, etag); err != nil {
+		return fmt.Errorf("failed to upload JSON %s: %w", objectPath, err)
+	}
+	return nil
+}
+
+// UploadPlainJSON uploads JSON data without sealing it, even when a keyring
+// is set. It is for objects every process must be able to read whatever key
+// it holds, such as locks and wrapped keys.
+func (c *Client) UploadPlainJSON(ctx context.Context, objectPath string, data interface{}) error {
+	jsonData, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+	if err := c.backend.Put(ctx, objectPath, jsonData); err != nil {
+		return fmt.Errorf("failed to upload JSON %s: %w", objectPath, err)
+	}
+	return nil
+}
+
+// UploadPlainJSONIfMatch is UploadPlainJSON conditional on the object still
+// having the given ETag, or, when etag is empty, on the object not existing
+// yet. It returns ErrPreconditionFailed otherwise.
+func (c *Client) UploadPlainJSONIfMatch(ctx context.Context, objectPath string, data interface{}, etag string) error {
+	b, ok := c.backend.(ConditionalBackend)
+	if !ok {
+		return fmt.Errorf("storage backend does not support conditional writes")
+	}
+	jsonData, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+	if err := b.PutIfMatch(ctx, objectPath, jsonData, etag); err != nil {
+		return fmt.Errorf("failed to upload JSON %s: %w", objectPath, err)
+	}
+	return nil
+}
+
+func (c *Client) marshalJSON(objectPath string, data interface{}) ([]byte, error) {
+	jsonData, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+
+	if c.keyring != nil && c.keyring.ActiveKeyID() != "" {
+		jsonData, err = c.keyring.SealJSON(objectPath, jsonData)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt %s: %w", objectPath, err)
+		}
+	}
+	return jsonData, nil
+}
+
+// DownloadObject downloads an object
+func (c *Client) DownloadObject(ctx context.Context, objectPath string) ([]byte, error) {
+	data, err := c.backend.Get(ctx, objectPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object %s: %w", objectPath, err)
+	}
+	return data, nil
+}
+
+// DownloadRange downloads length bytes of an object starting at offset
+func (c *Client) DownloadRange(ctx context.Context, objectPath string, offset, length int64) ([]byte, error) {
+	data, err := c.backend.GetRange(ctx, objectPath, offset, length)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object %s: %w", objectPath, err)
+	}
+	if int64(len(data)) != length {
+		return nil, fmt.Errorf("short read from object %s: got %d bytes, expected %d", objectPath, len(data), length)
+	}
+	return data, nil
+}
+
+// DownloadJSON downloads and unmarshals JSON data
+func (c *Client) DownloadJSON(ctx context.Context, objectPath string, target interface{}) error {
+	data, err := c.DownloadObject(ctx, objectPath)
+	if err != nil {
+		return err
+	}
+	return c.unmarshalJSON(objectPath, data, target)
+}
+
+// DownloadPlainJSON downloads and unmarshals JSON data written by
+// UploadPlainJSON. Sealed objects are rejected with ErrEncrypted.
+func (c *Client) DownloadPlainJSON(ctx context.Context, objectPath string, target interface{}) error {
+	data, err := c.DownloadObject(ctx, objectPath)
+	if err != nil {
+		return err
+	}
+	return openJSON(nil, objectPath, data, target)
+}
+
+// DownloadJSONWithETag downloads and unmarshals JSON data and returns the
+// object's ETag for a later UploadJSONIfMatch. It returns ErrNotFound if the
+// object does not exist.
+func (c *Client) DownloadJSONWithETag(ctx context.Context, objectPath string, target interface{}) (string, error) {
+	b, ok := c.backend.(ConditionalBackend)
+	if !ok {
+		return "", fmt.Errorf("storage backend does not support conditional writes")
+	}
+	data, etag, err := b.GetWithETag(ctx, objectPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to get object %s: %w", objectPath, err)
+	}
+	if err := c.unmarshalJSON(objectPath, data, target); err != nil {
+		return "", err
+	}
+	return etag, nil
+}
+
+// DownloadPlainJSONWithETag is DownloadPlainJSON that also returns the
+// object's ETag for a later UploadPlainJSONIfMatch. It returns ErrNotFound if
+// the object does not exist.
+func (c *Client) DownloadPlainJSONWithETag(ctx context.Context, objectPath string, target interface{}) (string, error) {
+	b, ok := c.backend.(ConditionalBackend)
+	if !ok {
+		return "", fmt.Errorf("storage backend does not support conditional writes")
+	}
+	data, etag, err := b.GetWithETag(ctx, objectPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to get object %s: %w", objectPath, err)
+	}
+	if err := openJSON(nil, objectPath, data, target); err != nil {
+		return "", err
+	}
+	return etag, nil
+}
+
+func (c *Client) unmarshalJSON(objectPath string, data []byte, target interface{}) error {
+	return openJSON(c.keyring, objectPath, data, target)
+}
+
+func openJSON(keyring *encryption.Keyring, objectPath string, data []byte, target interface{}) error {
+	data, err := encryption.OpenJSON(keyring, objectPath, data)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt %s: %w", objectPath, err)
+	}
+
+	if err := json.Unmarshal(data, target); err != nil {
+		return fmt.Errorf("failed to unmarshal JSON from %s: %w", objectPath, err)
+	}
+	return nil
+}
+
+// ListObjects lists objects with a given prefix
+func (c *Client) ListObjects(ctx context.Context, prefix string) ([]string, error) {
+	infos, err := c.ListObjectInfo(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make([]string, len(infos))
+	for i, info := range infos {
+		objects[i] = info.Key
+	}
+	return objects, nil
+}
+
+// ListObjectInfo lists objects with a given prefix along with their size and
+// modification time
+func (c *Client) ListObjectInfo(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	infos, err := c.backend.List(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("error listing objects: %w", err)
+	}
+	return infos, nil
+}
+
+// ObjectExists checks if an object exists
+func (c *Client) ObjectExists(ctx context.Context, objectPath string) (bool, error) {
+	_, err := c.backend.Stat(ctx, objectPath)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to stat object %s: %w", objectPath, err)
+	}
+	return true, nil
+}
+
+// GetObjectSize gets the size of an object
+func (c *Client) GetObjectSize(ctx context.Context, objectPath string) (int64, error) {
+	info, err := c.backend.Stat(ctx, objectPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat object %s: %w", objectPath, err)
+	}
+	return info.Size, nil
+}
+
+// CopyObject copies an object within the repository. Backends that cannot
+// copy on their own get the data read and written back.
+func (c *Client) CopyObject(ctx context.Context, srcPath, dstPath string) error {
+	var err error
+	if b, ok := c.backend.(Copier); ok {
+		err = b.Copy(ctx, srcPath, dstPath)
+	} else {
+		var data []byte
+		data, err = c.backend.Get(ctx, srcPath)
+		if err == nil {
+			err = c.backend.Put(ctx, dstPath, data)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to copy object %s to %s: %w", srcPath, dstPath, err)
+	}
+	return nil
+}
+
+// DeleteObject deletes an object
+func (c *Client) DeleteObject(ctx context.Context, objectPath string) error {
+	if err := c.backend.Delete(ctx, objectPath); err != nil {
+		return fmt.Errorf("failed to delete object %s: %w", objectPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,290 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// lockRetry is how often PutIfMatch retries taking an object's write lock
+	lockRetry = 50 * time.Millisecond
+	// staleWriteLock is how old a write lock must be before it is assumed to
+	// be left behind by a crashed writer
+	staleWriteLock = time.Minute
+)
+
+// Local stores a repository in a directory, one file per object, e.g. on an
+// NFS mount or a hostPath volume. Objects are written to a temporary file
+// and renamed into place, so readers never see a partial object. Names of
+// temporary and lock files start with a dot and are never listed.
+type Local struct {
+	root string
+}
+
+// NewLocal returns a backend storing objects under the directory root
+func NewLocal(root string) (*Local, error) {
+	if root == "" {
+		return nil, fmt.Errorf("local repository path is empty")
+	}
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", root, err)
+	}
+	return &Local{root: abs}, nil
+}
+
+// Init creates the repository directory
+func (l *Local) Init(ctx context.Context) error {
+	if err := os.MkdirAll(l.root, 0o755); err != nil {
+		return fmt.Errorf("failed to create repository directory: %w", err)
+	}
+	return nil
+}
+
+// path returns the file holding key, rejecting keys that would escape the
+// repository directory
+func (l *Local) path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if key == "" || clean != "/"+key || strings.HasPrefix(path.Base(key), ".") {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return filepath.Join(l.root, filepath.FromSlash(key)), nil
+}
+
+// Put creates or replaces an object
+func (l *Local) Put(ctx context.Context, key string, data []byte) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(p, data)
+}
+
+// writeFileAtomic writes data to a temporary file next to p, syncs it and
+// renames it over p
+func writeFileAtomic(p string, data []byte) error {
+	dir := filepath.Dir(p)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(p)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// Get reads a whole object
+func (l *Local) Get(ctx context.Context, key string) ([]byte, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return data, nil
+}
+
+// GetRange reads length bytes of an object starting at offset
+func (l *Local) GetRange(ctx context.Context, key string, offset, length int64) ([]byte, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	defer f.Close()
+
+	data := make([]byte, length)
+	n, err := f.ReadAt(data, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+// List returns every object whose key starts with prefix, in key order
+func (l *Local) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	// Only the directory holding the prefix needs to be walked
+	dir := l.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = filepath.Join(l.root, filepath.FromSlash(prefix[:i]))
+	}
+
+	var objects []ObjectInfo
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() && p != dir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		objects = append(objects, ObjectInfo{Key: key, Size: info.Size(), LastModified: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// Stat returns an object's size and modification time
+func (l *Local) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return ObjectInfo{}, notFound(err)
+	}
+	if info.IsDir() {
+		return ObjectInfo{}, fmt.Errorf("%s: %w", key, ErrNotFound)
+	}
+	return ObjectInfo{Key: key, Size: info.Size(), LastModified: info.ModTime()}, nil
+}
+
+// Delete removes an object
+func (l *Local) Delete(ctx context.Context, key string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// GetWithETag reads a whole object. Its tag is the SHA-256 of its content.
+func (l *Local) GetWithETag(ctx context.Context, key string) ([]byte, string, error) {
+	data, err := l.Get(ctx, key)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, contentTag(data), nil
+}
+
+// PutIfMatch writes the object only if its content is unchanged since
+// GetWithETag returned etag. Writers of the same object are serialized by a
+// lock file created next to it, which works across processes sharing the
+// directory.
+func (l *Local) PutIfMatch(ctx context.Context, key string, data []byte, etag string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+
+	unlock, err := lockFile(ctx, filepath.Join(filepath.Dir(p), "."+filepath.Base(p)+".lock"))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := os.ReadFile(p)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if etag != "" {
+			return ErrPreconditionFailed
+		}
+	case err != nil:
+		return err
+	case etag == "" || contentTag(current) != etag:
+		return ErrPreconditionFailed
+	}
+
+	return writeFileAtomic(p, data)
+}
+
+// lockFile creates the lock file p exclusively, waiting while another writer
+// holds it, and returns a function that removes it
+func lockFile(ctx context.Context, p string) (func(), error) {
+	for {
+		f, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(p) }, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+		if info, err := os.Stat(p); err == nil && time.Since(info.ModTime()) > staleWriteLock {
+			os.Remove(p)
+			continue
+		}
+
+		select {
+		case <-time.After(lockRetry):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func contentTag(data []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// notFound maps a missing file to ErrNotFound
+func notFound(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %v", ErrNotFound, err)
+	}
+	return err
+}
@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestLocal(t *testing.T) *Local {
+	t.Helper()
+	l, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocal: %v", err)
+	}
+	return l
+}
+
+func TestLocalPath(t *testing.T) {
+	l := newTestLocal(t)
+
+	tests := []struct {
+		key   string
+		valid bool
+	}{
+		{"metadata/snap-1/manifest.json", true},
+		{"blocks/snap-1/block-0-4096", true},
+		{"", false},
+		{"../outside", false},
+		{"blocks/../../outside", false},
+		{"blocks/../metadata/x", false},
+		{"/absolute", false},
+		{"blocks//double", false},
+		{"blocks/trailing/", false},
+		{"blocks/./block", false},
+		{".hidden", false},
+		{"blocks/.block-0-4096.lock", false},
+		{"blocks/..", false},
+	}
+	for _, tt := range tests {
+		p, err := l.path(tt.key)
+		if tt.valid {
+			if err != nil {
+				t.Errorf("path(%q): %v", tt.key, err)
+			} else if p != filepath.Join(l.root, filepath.FromSlash(tt.key)) {
+				t.Errorf("path(%q) = %s", tt.key, p)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("path(%q) = %s, want an error", tt.key, p)
+		}
+	}
+}
+
+func TestLocalPutIfMatch(t *testing.T) {
+	ctx := context.Background()
+	l := newTestLocal(t)
+	const key = "locks/repo"
+
+	if err := l.PutIfMatch(ctx, key, []byte("v1"), "stale-tag"); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("PutIfMatch of a missing object with an etag = %v, want ErrPreconditionFailed", err)
+	}
+	if err := l.PutIfMatch(ctx, key, []byte("v1"), ""); err != nil {
+		t.Fatalf("PutIfMatch creating the object: %v", err)
+	}
+
+	// An empty etag only creates; it does not overwrite
+	if err := l.PutIfMatch(ctx, key, []byte("v2"), ""); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("PutIfMatch with an empty etag over an existing object = %v, want ErrPreconditionFailed", err)
+	}
+
+	data, etag, err := l.GetWithETag(ctx, key)
+	if err != nil || string(data) != "v1" {
+		t.Fatalf("GetWithETag = %q, %v; want v1", data, err)
+	}
+	if err := l.PutIfMatch(ctx, key, []byte("v2"), contentTag([]byte("other"))); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("PutIfMatch with a mismatched etag = %v, want ErrPreconditionFailed", err)
+	}
+	if err := l.PutIfMatch(ctx, key, []byte("v2"), etag); err != nil {
+		t.Fatalf("PutIfMatch with the current etag: %v", err)
+	}
+
+	// A lock file left behind by a crashed writer is taken over once stale
+	lock := filepath.Join(l.root, "locks", ".repo.lock")
+	if err := os.WriteFile(lock, nil, 0o644); err != nil {
+		t.Fatalf("failed to create lock file: %v", err)
+	}
+	old := time.Now().Add(-2 * staleWriteLock)
+	if err := os.Chtimes(lock, old, old); err != nil {
+		t.Fatalf("failed to age lock file: %v", err)
+	}
+	_, etag, err = l.GetWithETag(ctx, key)
+	if err != nil {
+		t.Fatalf("GetWithETag: %v", err)
+	}
+	if err := l.PutIfMatch(ctx, key, []byte("v3"), etag); err != nil {
+		t.Fatalf("PutIfMatch with a stale lock file: %v", err)
+	}
+	if _, err := os.Stat(lock); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("lock file left behind after PutIfMatch: %v", err)
+	}
+
+	// A fresh lock file is waited for
+	if err := os.WriteFile(lock, nil, 0o644); err != nil {
+		t.Fatalf("failed to create lock file: %v", err)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, 3*lockRetry)
+	defer cancel()
+	if err := l.PutIfMatch(waitCtx, key, []byte("v4"), contentTag([]byte("v3"))); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("PutIfMatch with a held lock file = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestLocalList(t *testing.T) {
+	ctx := context.Background()
+	l := newTestLocal(t)
+
+	for _, key := range []string{
+		"metadata/snap-1/manifest.json",
+		"metadata/snap-10/manifest.json",
+		"metadata/snap-2/manifest.json",
+		"blocks/snap-1/block-0-4096",
+		"blocks/snap-1/block-4096-4096",
+		"blocks/snap-1/block-40960-4096",
+	} {
+		if err := l.Put(ctx, key, []byte("x")); err != nil {
+			t.Fatalf("Put %s: %v", key, err)
+		}
+	}
+	// Temporary and lock files are never listed
+	if err := os.WriteFile(filepath.Join(l.root, "blocks", "snap-1", ".block-0-4096.lock"), nil, 0o644); err != nil {
+		t.Fatalf("failed to create lock file: %v", err)
+	}
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"metadata/snap-1", []string{"metadata/snap-1/manifest.json", "metadata/snap-10/manifest.json"}},
+		{"metadata/snap-1/", []string{"metadata/snap-1/manifest.json"}},
+		{"blocks/snap-1/block-4", []string{"blocks/snap-1/block-4096-4096", "blocks/snap-1/block-40960-4096"}},
+		{"blocks/snap-1/block-0", []string{"blocks/snap-1/block-0-4096"}},
+		{"met", []string{"metadata/snap-1/manifest.json", "metadata/snap-10/manifest.json", "metadata/snap-2/manifest.json"}},
+		{"blocks/snap-3/", nil},
+	}
+	for _, tt := range tests {
+		objects, err := l.List(ctx, tt.prefix)
+		if err != nil {
+			t.Fatalf("List(%q): %v", tt.prefix, err)
+		}
+		var got []string
+		for _, obj := range objects {
+			got = append(got, obj.Key)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("List(%q) = %v, want %v", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestLocalGetRange(t *testing.T) {
+	ctx := context.Background()
+	l := newTestLocal(t)
+	const key = "blocks/snap-1/pack-000000"
+	if err := l.Put(ctx, key, []byte("0123456789")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	tests := []struct {
+		offset, length int64
+		want           string
+	}{
+		{2, 3, "234"},
+		{8, 5, "89"}, // truncated at the end of the object
+		{10, 4, ""},
+		{20, 4, ""},
+	}
+	for _, tt := range tests {
+		data, err := l.GetRange(ctx, key, tt.offset, tt.length)
+		if err != nil {
+			t.Fatalf("GetRange(%d, %d): %v", tt.offset, tt.length, err)
+		}
+		if string(data) != tt.want {
+			t.Errorf("GetRange(%d, %d) = %q, want %q", tt.offset, tt.length, data, tt.want)
+		}
+	}
+
+	if _, err := l.GetRange(ctx, "blocks/snap-1/missing", 0, 4); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetRange of a missing object = %v, want ErrNotFound", err)
+	}
+}
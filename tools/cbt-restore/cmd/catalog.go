@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/metadata"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/storage"
+)
+
+// loadCatalog reads the global catalog written by cbt-backup. If it is
+// missing or cannot be read, the catalog is built in memory from the
+// snapshot manifests instead.
+func loadCatalog(ctx context.Context, s3Client *storage.Client) (*metadata.Catalog, error) {
+	catalog := metadata.NewCatalog()
+	err := s3Client.DownloadJSON(ctx, metadata.CatalogPath, catalog)
+	if err == nil {
+		return catalog, nil
+	}
+
+	fmt.Printf("Warning: catalog unavailable, scanning manifests (%v)\n", err)
+	objects, err := s3Client.ListObjects(ctx, "metadata/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	var manifests []metadata.SnapshotManifest
+	for _, obj := range objects {
+		if !strings.HasSuffix(obj, "/manifest.json") {
+			continue
+		}
+		var manifest metadata.SnapshotManifest
+		if err := s3Client.DownloadJSON(ctx, obj, &manifest); err != nil {
+			fmt.Printf("Warning: Failed to load %s: %v\n", obj, err)
+			continue
+		}
+		manifests = append(manifests, manifest)
+	}
+
+	return metadata.BuildCatalog(manifests), nil
+}
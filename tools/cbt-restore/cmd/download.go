@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/blocks"
+)
+
+// defaultRestoreConcurrency is the default number of download workers
+const defaultRestoreConcurrency = 4
+
+// writeResult counts what the restore wrote to the device
+type writeResult struct {
+	BytesWritten  int64
+	BlocksWritten int
+}
+
+// restoreOptions tunes restoreExtents
+type restoreOptions struct {
+	Workers int    // Extents downloaded and written at the same time
+	Done    []bool // Extents written by an earlier attempt; nil when starting afresh
+	Journal *journaler
+}
+
+// restoreExtents downloads the extents of a flattened chain with up to
+// opts.Workers at a time and writes their pieces to the device with
+// positional writes. The pieces of a flattened chain never overlap and each
+// already holds the newest snapshot's data for its range, so the order in
+// which workers finish cannot change the result. The first error cancels the
+// remaining work and is returned along with what was written so far. With a
+// journaler, progress is recorded periodically and once more on failure.
+func restoreExtents(ctx context.Context, reader *pieceReader, writer *blocks.Writer, extents []sourceExtent, opts restoreOptions) (writeResult, error) {
+	workers := opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	parent := ctx
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		errOnce  sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	progress := newWriteProgress(extents, opts.Done, opts.Journal)
+
+	jobs := make(chan int)
+	go func() {
+		defer close(jobs)
+		for i := range extents {
+			if opts.Done != nil && opts.Done[i] {
+				continue
+			}
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+				n, err := restoreExtent(ctx, reader, writer, extents[i])
+				if err != nil {
+					fail(err)
+					continue
+				}
+				progress.done(ctx, i, n)
+			}
+		}()
+	}
+	wg.Wait()
+
+	result := progress.result()
+	if firstErr != nil {
+		progress.save(parent)
+		return result, firstErr
+	}
+	return result, ctx.Err()
+}
+
+// restoreExtent downloads one extent and writes its pieces, returning the
+// number of bytes written
+func restoreExtent(ctx context.Context, reader *pieceReader, writer *blocks.Writer, extent sourceExtent) (int64, error) {
+	data, err := reader.read(ctx, extent)
+	if err != nil {
+		return 0, err
+	}
+
+	var written int64
+	for i, piece := range extent.Pieces {
+		bd := &blocks.BlockData{
+			Offset: piece.Offset,
+			Size:   int64(len(data[i])),
+			Data:   data[i],
+		}
+		if err := writer.WriteBlock(bd); err != nil {
+			return written, fmt.Errorf("failed to write block at offset %d: %w", piece.Offset, err)
+		}
+		written += bd.Size
+	}
+	return written, nil
+}
+
+// writeProgress reports how far the restore has got in offset order. Extents
+// complete out of order; progress only counts the pieces of the extents
+// before the first one that is still in flight, so the reported count never
+// goes back.
+type writeProgress struct {
+	mu       sync.Mutex
+	extents  []sourceExtent
+	finished []bool
+	next     int // number of leading extents that have completed
+	leading  int // pieces of the leading completed extents
+	reported int // leading as of the last progress line
+	total    int // pieces across all extents
+	journal  *journaler
+
+	// Totals including extents completed ahead of next
+	bytesWritten  int64
+	blocksWritten int
+}
+
+func newWriteProgress(extents []sourceExtent, done []bool, journal *journaler) *writeProgress {
+	total := 0
+	for _, e := range extents {
+		total += len(e.Pieces)
+	}
+	finished := make([]bool, len(extents))
+	copy(finished, done)
+	return &writeProgress{
+		extents:  extents,
+		finished: finished,
+		total:    total,
+		journal:  journal,
+	}
+}
+
+// done marks extent i as written, prints progress every 100 pieces and
+// updates the journal when an entry is due
+func (p *writeProgress) done(ctx context.Context, i int, written int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.finished[i] = true
+	p.bytesWritten += written
+	p.blocksWritten += len(p.extents[i].Pieces)
+
+	for p.next < len(p.extents) && p.finished[p.next] {
+		p.leading += len(p.extents[p.next].Pieces)
+		p.next++
+	}
+	if p.leading/100 > p.reported/100 || (p.leading == p.total && p.reported < p.total) {
+		p.reported = p.leading
+		fmt.Printf("  Progress: %d/%d blocks written (%.2f MB)\n",
+			p.reported, p.total,
+			float64(p.bytesWritten)/(1024*1024))
+	}
+
+	if p.journal != nil && p.journal.due() {
+		p.saveLocked(ctx)
+	}
+}
+
+// save updates the journal, if the restore keeps one
+func (p *writeProgress) save(ctx context.Context) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.journal != nil {
+		p.saveLocked(ctx)
+	}
+}
+
+// saveLocked updates the journal. A failed update does not fail the
+// restore; it only means a resumed restore writes more again.
+func (p *writeProgress) saveLocked(ctx context.Context) {
+	if err := p.journal.save(ctx, p.finished); err != nil {
+		fmt.Printf("  Warning: %v\n", err)
+	}
+}
+
+// result returns the totals of everything written, including extents that
+// completed ahead of the progress mark
+func (p *writeProgress) result() writeResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return writeResult{BytesWritten: p.bytesWritten, BlocksWritten: p.blocksWritten}
+}
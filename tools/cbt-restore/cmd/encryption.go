@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/blocks"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/encryption"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/metadata"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/storage"
+)
+
+// loadKeyring reads the master key from --encryption-key-file and unwraps the
+// repository keys it protects. It returns nil when no key file is given.
+func loadKeyring(ctx context.Context, s3Client *storage.Client) (*encryption.Keyring, error) {
+	if encryptionKeyFile == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(encryptionKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read master key: %w", err)
+	}
+	masterKey, err := encryption.ParseMasterKey(data)
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := encryption.NewKeyring(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	objects, err := s3Client.ListObjects(ctx, encryption.KeysPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list keys: %w", err)
+	}
+	for _, obj := range objects {
+		var wrapped encryption.WrappedKey
+		if err := s3Client.DownloadPlainJSON(ctx, obj, &wrapped); err != nil {
+			return nil, fmt.Errorf("failed to load key %s: %w", obj, err)
+		}
+		if _, err := keyring.AddWrapped(wrapped); err != nil {
+			return nil, err
+		}
+	}
+
+	if keyring.Len() == 0 {
+		return nil, fmt.Errorf("no repository key is wrapped by master key %s", keyring.MasterKeyID())
+	}
+	return keyring, nil
+}
+
+// decryptBlock returns the plaintext of a block stored by an encrypted backup.
+// Data of unencrypted backups is returned unchanged.
+func decryptBlock(keyring *encryption.Keyring, manifest *metadata.SnapshotManifest, block blocks.BlockMetadata, data []byte) ([]byte, error) {
+	if manifest.KeyID == "" {
+		return data, nil
+	}
+	if keyring == nil {
+		return nil, fmt.Errorf("snapshot %s is encrypted: %w", manifest.Name, encryption.ErrEncrypted)
+	}
+	return keyring.Decrypt(manifest.KeyID, data, metadata.BlockAssociatedData(manifest, block))
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/blocks"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/compression"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/encryption"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/metadata"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/pack"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/storage"
+)
+
+const (
+	// checksumAbort stops the restore at the first block that fails verification
+	checksumAbort = "abort"
+	// checksumRetry downloads a failing block again, up to --checksum-retries times
+	checksumRetry = "retry"
+)
+
+// loadBlockLists downloads the block list of every snapshot in the chain, in
+// chain order
+func loadBlockLists(ctx context.Context, s3Client *storage.Client, chain []string) ([][]blocks.BlockMetadata, error) {
+	layers := make([][]blocks.BlockMetadata, len(chain))
+	for i, snap := range chain {
+		blocksPath := fmt.Sprintf("metadata/%s/blocks.json", snap)
+		var blockList metadata.BlockList
+		if err := s3Client.DownloadJSON(ctx, blocksPath, &blockList); err != nil {
+			return nil, fmt.Errorf("failed to download block list for %s: %w", snap, err)
+		}
+		layers[i] = blockList.Blocks
+	}
+	return layers, nil
+}
+
+// replayBytes returns how many bytes replaying every block list in turn would
+// write
+func replayBytes(layers [][]blocks.BlockMetadata) int64 {
+	var total int64
+	for _, entries := range layers {
+		for _, e := range entries {
+			total += e.Size
+		}
+	}
+	return total
+}
+
+// flattenedBytes returns how many bytes a flattened restore writes
+func flattenedBytes(pieces []blocks.Piece) int64 {
+	var total int64
+	for _, p := range pieces {
+		total += p.Size
+	}
+	return total
+}
+
+// sourceExtent is a block list entry together with the pieces of it that a
+// flattened restore writes. A later snapshot can split an entry into several
+// pieces; grouping them lets the entry be downloaded only once.
+type sourceExtent struct {
+	Layer  int
+	Block  blocks.BlockMetadata
+	Pieces []blocks.Piece
+}
+
+// groupPieces groups pieces by the entry they were cut from, ordered by the
+// offset of each entry's first piece
+func groupPieces(pieces []blocks.Piece) []sourceExtent {
+	type key struct {
+		layer  int
+		offset int64
+	}
+	index := make(map[key]int)
+	var extents []sourceExtent
+	for _, p := range pieces {
+		k := key{p.Layer, p.Block.Offset}
+		i, ok := index[k]
+		if !ok {
+			i = len(extents)
+			index[k] = i
+			extents = append(extents, sourceExtent{Layer: p.Layer, Block: p.Block})
+		}
+		extents[i].Pieces = append(extents[i].Pieces, p)
+	}
+	return extents
+}
+
+// pieceReader downloads and decodes the data of a flattened chain. Each
+// snapshot gets its own pack fetcher. read is safe for concurrent use.
+type pieceReader struct {
+	client    *storage.Client
+	keyring   *encryption.Keyring
+	manifests []*metadata.SnapshotManifest
+	fetchers  []*pack.Fetcher
+
+	// verifyPolicy enables checksum verification when set to checksumAbort
+	// or checksumRetry
+	verifyPolicy string
+	retries      int
+
+	mu               sync.Mutex // guards the counters below
+	BytesDownloaded  int64
+	BlocksDownloaded int
+	ChecksumVerified int
+	ChecksumFailed   int
+	ChecksumMissing  int
+}
+
+// newPieceReader prepares to read extents whose entries come from layers,
+// the block lists of the snapshots described by manifests
+func newPieceReader(client *storage.Client, keyring *encryption.Keyring, manifests []*metadata.SnapshotManifest, layers [][]blocks.BlockMetadata, extents []sourceExtent) *pieceReader {
+	needed := make([][]blocks.BlockMetadata, len(layers))
+	for _, e := range extents {
+		needed[e.Layer] = append(needed[e.Layer], e.Block)
+	}
+
+	// Plan each fetcher around the blocks the restore actually reads
+	fetchers := make([]*pack.Fetcher, len(layers))
+	for i := range layers {
+		fetchers[i] = pack.NewFetcher(client, needed[i], pack.PackSizes(layers[i]))
+	}
+
+	return &pieceReader{
+		client:    client,
+		keyring:   keyring,
+		manifests: manifests,
+		fetchers:  fetchers,
+	}
+}
+
+// read returns the plaintext bytes of each piece of an extent
+func (r *pieceReader) read(ctx context.Context, extent sourceExtent) ([][]byte, error) {
+	data, err := r.decode(ctx, extent.Layer, extent.Block)
+	r.fetchers[extent.Layer].Done(extent.Block)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([][]byte, len(extent.Pieces))
+	for i, piece := range extent.Pieces {
+		start := piece.Offset - piece.Block.Offset
+		if start < 0 || start+piece.Size > int64(len(data)) {
+			return nil, fmt.Errorf("block at offset %d from %s holds %d bytes, expected %d",
+				piece.Block.Offset, r.manifests[piece.Layer].Name, len(data), piece.Block.Size)
+		}
+		out[i] = data[start : start+piece.Size]
+	}
+	return out, nil
+}
+
+// count applies fn to the counters under the lock
+func (r *pieceReader) count(fn func(r *pieceReader)) {
+	r.mu.Lock()
+	fn(r)
+	r.mu.Unlock()
+}
+
+// decode downloads a block list entry and returns its plaintext. With
+// verification enabled the data is checked against the recorded checksum.
+// Stored bytes that fail to decrypt or decompress count as failures too,
+// and on a failure the download is retried if the policy allows.
+func (r *pieceReader) decode(ctx context.Context, layer int, block blocks.BlockMetadata) ([]byte, error) {
+	manifest := r.manifests[layer]
+
+	attempts := 1
+	if r.verifyPolicy == checksumRetry {
+		attempts += r.retries
+	}
+
+	for attempt := 1; ; attempt++ {
+		stored, err := downloadBlock(ctx, r.client, r.fetchers[layer], manifest, block)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download block at offset %d from %s: %w", block.Offset, manifest.Name, err)
+		}
+		r.count(func(r *pieceReader) {
+			r.BytesDownloaded += int64(len(stored))
+			r.BlocksDownloaded++
+		})
+
+		data, err := r.open(manifest, block, stored)
+		if r.verifyPolicy == "" || errors.Is(err, encryption.ErrEncrypted) {
+			return data, err
+		}
+		if err == nil {
+			if block.Checksum == "" {
+				r.count(func(r *pieceReader) { r.ChecksumMissing++ })
+				return data, nil
+			}
+			if blocks.VerifyChecksum(data, block.Checksum) {
+				r.count(func(r *pieceReader) { r.ChecksumVerified++ })
+				return data, nil
+			}
+			err = fmt.Errorf("checksum mismatch for block at offset %d from %s", block.Offset, manifest.Name)
+		}
+
+		r.count(func(r *pieceReader) { r.ChecksumFailed++ })
+		if attempt >= attempts {
+			return nil, fmt.Errorf("%w (after %d attempt(s))", err, attempt)
+		}
+		fmt.Printf("  Warning: %v, retrying (%d/%d)\n", err, attempt, r.retries)
+		r.fetchers[layer].Invalidate(block)
+	}
+}
+
+// open decrypts and decompresses the stored bytes of a block
+func (r *pieceReader) open(manifest *metadata.SnapshotManifest, block blocks.BlockMetadata, stored []byte) ([]byte, error) {
+	data, err := decryptBlock(r.keyring, manifest, block, stored)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt block at offset %d from %s: %w", block.Offset, manifest.Name, err)
+	}
+
+	data, err = compression.Decompress(block.Compression, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress block at offset %d from %s: %w", block.Offset, manifest.Name, err)
+	}
+	return data, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/blocks"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/metadata"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/storage"
+)
+
+// defaultJournalInterval is how often the restore records its progress
+const defaultJournalInterval = 30 * time.Second
+
+// journalPath returns the object key of the journal of a restore of
+// snapshotName to device. Restores of one snapshot to different devices
+// keep separate journals. It only exists while the restore is unfinished.
+func journalPath(snapshotName, device string) string {
+	if abs, err := filepath.Abs(device); err == nil {
+		device = abs
+	}
+	sum := sha256.Sum256([]byte(device))
+	return fmt.Sprintf("metadata/%s/restore-journal-%s.json", snapshotName, hex.EncodeToString(sum[:8]))
+}
+
+// journaler periodically syncs the device and records which extents have
+// been written, so an interrupted restore can be resumed with --resume. It
+// is only used under the write progress lock.
+type journaler struct {
+	client   *storage.Client
+	writer   *blocks.Writer
+	state    metadata.RestoreJournal
+	interval time.Duration
+	saved    time.Time
+}
+
+// newJournaler prepares a journal for restoring the flattened chain to the
+// device
+func newJournaler(client *storage.Client, writer *blocks.Writer, chain []string, extents []sourceExtent, interval time.Duration) *journaler {
+	return &journaler{
+		client: client,
+		writer: writer,
+		state: metadata.RestoreJournal{
+			Snapshot: snapshotName,
+			Device:   devicePath,
+			Chain:    chain,
+			Extents:  len(extents),
+		},
+		interval: interval,
+	}
+}
+
+// due reports whether the interval has passed since the last journal entry
+func (j *journaler) due() bool {
+	return j.interval > 0 && time.Since(j.saved) >= j.interval
+}
+
+// save records the extents marked finished. The set is taken before the
+// device is synced, so every extent the journal lists is on stable storage.
+func (j *journaler) save(ctx context.Context, finished []bool) error {
+	completed := completedRanges(finished)
+
+	if err := j.writer.Sync(); err != nil {
+		return err
+	}
+
+	j.state.Completed = completed
+	j.state.Updated = time.Now()
+	if err := j.client.UploadJSON(ctx, journalPath(j.state.Snapshot, j.state.Device), j.state); err != nil {
+		return fmt.Errorf("failed to upload restore journal: %w", err)
+	}
+	j.saved = time.Now()
+	return nil
+}
+
+// loadJournal reads the journal of an interrupted restore of the same chain
+// to the same device and returns which extents it already wrote. It returns
+// nil if there is no journal.
+func loadJournal(ctx context.Context, s3Client *storage.Client, chain []string, extents []sourceExtent) ([]bool, error) {
+	path := journalPath(snapshotName, devicePath)
+	exists, err := s3Client.ObjectExists(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check restore journal: %w", err)
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	var journal metadata.RestoreJournal
+	if err := s3Client.DownloadJSON(ctx, path, &journal); err != nil {
+		return nil, fmt.Errorf("failed to download restore journal: %w", err)
+	}
+
+	// Extent indices are only meaningful for the same flattened chain
+	if journal.Device != devicePath {
+		return nil, fmt.Errorf("restore journal is for device %s, not %s", journal.Device, devicePath)
+	}
+	if !slices.Equal(journal.Chain, chain) || journal.Extents != len(extents) {
+		return nil, fmt.Errorf("restore journal was written for a different snapshot chain; restore without --resume")
+	}
+
+	done := make([]bool, len(extents))
+	for _, r := range journal.Completed {
+		if r[0] < 0 || r[1] > len(done) || r[0] > r[1] {
+			return nil, fmt.Errorf("restore journal holds invalid range [%d, %d)", r[0], r[1])
+		}
+		for i := r[0]; i < r[1]; i++ {
+			done[i] = true
+		}
+	}
+	return done, nil
+}
+
+// completedRanges compacts a set of finished indices into ranges
+// [start, end)
+func completedRanges(finished []bool) [][2]int {
+	var ranges [][2]int
+	for i := 0; i < len(finished); i++ {
+		if !finished[i] {
+			continue
+		}
+		start := i
+		for i < len(finished) && finished[i] {
+			i++
+		}
+		ranges = append(ranges, [2]int{start, i})
+	}
+	return ranges
+}
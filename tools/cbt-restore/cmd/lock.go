@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/lock"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+var lockWait time.Duration
+
+// addLockFlags registers the flags of commands that lock the repository
+func addLockFlags(cmd *cobra.Command) {
+	cmd.Flags().DurationVar(&lockWait, "lock-wait", 0, "How long to wait for a conflicting repository lock to be released")
+}
+
+// lockRepository takes a shared lock on the repository, so prune, gc and
+// consolidate do not delete backups while they are being restored. The
+// returned context is canceled if the lock is lost.
+func lockRepository(ctx context.Context, s3Client *storage.Client, operation string) (*lock.Lock, context.Context, error) {
+	lk, lockCtx, err := lock.Acquire(ctx, s3Client, lock.Options{
+		Operation: operation,
+		Wait:      lockWait,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to lock repository: %w", err)
+	}
+	fmt.Println("Acquired shared repository lock")
+	return lk, lockCtx, nil
+}
+
+// unlockRepository releases a lock taken by lockRepository. A lock that
+// cannot be removed turns stale and is ignored once its heartbeat expires.
+func unlockRepository(lk *lock.Lock) {
+	if err := lk.Release(); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+}
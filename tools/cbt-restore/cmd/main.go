@@ -2,14 +2,17 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
 	"fmt"
 	"os"
+	"sort"
 	"time"
 
 	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/blocks"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/encryption"
 	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/metadata"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/pack"
 	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/s3"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/storage"
 	"github.com/spf13/cobra"
 )
 
@@ -22,6 +25,16 @@ var (
 	s3Bucket     string
 	s3UseSSL     bool
 	verify       bool
+
+	encryptionKeyFile string
+	onChecksumFailure string
+	checksumRetries   int
+
+	restoreConcurrency int
+	resumeRestore      bool
+	journalInterval    time.Duration
+
+	localPath string
 )
 
 func main() {
@@ -48,7 +61,13 @@ incremental, all base snapshots are applied first in order.`,
 	restoreCmd.Flags().StringVarP(&snapshotName, "snapshot", "s", "", "Target snapshot name to restore (required)")
 	restoreCmd.Flags().StringVarP(&devicePath, "device", "d", "/dev/xvda", "Target block device path")
 	restoreCmd.Flags().BoolVar(&verify, "verify", true, "Verify block checksums during restore")
-	addS3Flags(restoreCmd)
+	restoreCmd.Flags().StringVar(&onChecksumFailure, "on-checksum-failure", checksumAbort, "What to do when a block fails verification: abort or retry")
+	restoreCmd.Flags().IntVar(&checksumRetries, "checksum-retries", 3, "Downloads to retry per block with --on-checksum-failure=retry")
+	restoreCmd.Flags().IntVar(&restoreConcurrency, "concurrency", defaultRestoreConcurrency, "Number of extents downloaded and written in parallel")
+	restoreCmd.Flags().BoolVar(&resumeRestore, "resume", false, "Skip extents that an interrupted restore to the same device already wrote")
+	restoreCmd.Flags().DurationVar(&journalInterval, "journal-interval", defaultJournalInterval, "How often the device is synced and progress journaled so the restore can be resumed (0 disables)")
+	addStorageFlags(restoreCmd)
+	addLockFlags(restoreCmd)
 	restoreCmd.MarkFlagRequired("snapshot")
 
 	planCmd := &cobra.Command{
@@ -60,7 +79,7 @@ including all snapshots to apply and total data to download.`,
 	}
 
 	planCmd.Flags().StringVarP(&snapshotName, "snapshot", "s", "", "Target snapshot name (required)")
-	addS3Flags(planCmd)
+	addStorageFlags(planCmd)
 	planCmd.MarkFlagRequired("snapshot")
 
 	listCmd := &cobra.Command{
@@ -68,7 +87,7 @@ including all snapshots to apply and total data to download.`,
 		Short: "List available backups from S3",
 		RunE:  runList,
 	}
-	addS3Flags(listCmd)
+	addStorageFlags(listCmd)
 
 	rootCmd.AddCommand(restoreCmd, planCmd, listCmd)
 
@@ -78,15 +97,23 @@ including all snapshots to apply and total data to download.`,
 	}
 }
 
-func addS3Flags(cmd *cobra.Command) {
+// addStorageFlags registers the repository storage flags
+func addStorageFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&localPath, "local-path", "", "Read the repository from this directory instead of S3")
 	cmd.Flags().StringVarP(&s3Endpoint, "s3-endpoint", "e", "minio.cbt-demo.svc.cluster.local:9000", "S3 endpoint")
 	cmd.Flags().StringVarP(&s3AccessKey, "s3-access-key", "a", "minioadmin", "S3 access key")
 	cmd.Flags().StringVarP(&s3SecretKey, "s3-secret-key", "k", "minioadmin123", "S3 secret key")
 	cmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "B", "snapshots", "S3 bucket name")
 	cmd.Flags().BoolVar(&s3UseSSL, "s3-use-ssl", false, "Use SSL for S3")
+	cmd.Flags().StringVar(&encryptionKeyFile, "encryption-key-file", "", "File holding the master key for encrypted backups")
 }
 
-func newS3Client() (*s3.Client, error) {
+// newBackend opens the repository storage: the directory given by
+// --local-path, or else the S3 bucket
+func newBackend() (storage.Backend, error) {
+	if localPath != "" {
+		return storage.NewLocal(localPath)
+	}
 	return s3.NewClient(s3.Config{
 		Endpoint:  s3Endpoint,
 		AccessKey: s3AccessKey,
@@ -96,20 +123,60 @@ func newS3Client() (*s3.Client, error) {
 	})
 }
 
+// repositoryLocation describes where the repository is stored
+func repositoryLocation() string {
+	if localPath != "" {
+		return "directory " + localPath
+	}
+	return "bucket " + s3Bucket
+}
+
+// newStorageClient opens the repository and, when --encryption-key-file is
+// set, loads the repository keys so encrypted metadata can be read
+func newStorageClient(ctx context.Context) (*storage.Client, *encryption.Keyring, error) {
+	backend, err := newBackend()
+	if err != nil {
+		return nil, nil, err
+	}
+	s3Client := storage.NewClient(backend)
+
+	keyring, err := loadKeyring(ctx, s3Client)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load encryption keys: %w", err)
+	}
+	s3Client.SetKeyring(keyring)
+	return s3Client, keyring, nil
+}
+
 // buildSnapshotChain resolves the full chain of snapshots needed to restore
 // the target snapshot. Returns snapshots in apply order (base first).
-func buildSnapshotChain(ctx context.Context, s3Client *s3.Client, target string) ([]string, map[string]*metadata.SnapshotManifest, error) {
+func buildSnapshotChain(ctx context.Context, s3Client *storage.Client, target string) ([]string, map[string]*metadata.SnapshotManifest, error) {
+	// The catalog resolves the chain without walking manifests one by one
+	catalog := metadata.NewCatalog()
+	if err := s3Client.DownloadJSON(ctx, metadata.CatalogPath, catalog); err == nil {
+		if chain, err := catalog.ResolveChain(target); err == nil {
+			manifests := make(map[string]*metadata.SnapshotManifest, len(chain))
+			for _, snap := range chain {
+				manifest, err := downloadManifest(ctx, s3Client, snap)
+				if err != nil {
+					return nil, nil, err
+				}
+				manifests[snap] = manifest
+			}
+			return chain, manifests, nil
+		}
+	}
+
 	chain := []string{target}
 	manifests := make(map[string]*metadata.SnapshotManifest)
 
 	current := target
 	for {
-		manifestPath := fmt.Sprintf("metadata/%s/manifest.json", current)
-		var manifest metadata.SnapshotManifest
-		if err := s3Client.DownloadJSON(ctx, manifestPath, &manifest); err != nil {
-			return nil, nil, fmt.Errorf("failed to download manifest for %s: %w", current, err)
+		manifest, err := downloadManifest(ctx, s3Client, current)
+		if err != nil {
+			return nil, nil, err
 		}
-		manifests[current] = &manifest
+		manifests[current] = manifest
 
 		if !manifest.IsIncremental || manifest.BaseSnapshotName == "" {
 			break
@@ -123,6 +190,20 @@ func buildSnapshotChain(ctx context.Context, s3Client *s3.Client, target string)
 	return chain, manifests, nil
 }
 
+// downloadManifest fetches the manifest of a snapshot to restore and rejects
+// backups that were never committed or hold no block data
+func downloadManifest(ctx context.Context, s3Client *storage.Client, snap string) (*metadata.SnapshotManifest, error) {
+	manifestPath := fmt.Sprintf("metadata/%s/manifest.json", snap)
+	var manifest metadata.SnapshotManifest
+	if err := s3Client.DownloadJSON(ctx, manifestPath, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to download manifest for %s: %w", snap, err)
+	}
+	if !manifest.Restorable() {
+		return nil, fmt.Errorf("backup %s cannot be restored (state %s)", snap, manifest.State)
+	}
+	return &manifest, nil
+}
+
 func runPlan(cmd *cobra.Command, args []string) error {
 	ctx := context.Background()
 
@@ -130,9 +211,9 @@ func runPlan(cmd *cobra.Command, args []string) error {
 	fmt.Println("CBT Restore Plan")
 	fmt.Println("========================================")
 
-	s3Client, err := newS3Client()
+	s3Client, _, err := newStorageClient(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to create S3 client: %w", err)
+		return fmt.Errorf("failed to open repository: %w", err)
 	}
 
 	chain, manifests, err := buildSnapshotChain(ctx, s3Client, snapshotName)
@@ -158,14 +239,25 @@ func runPlan(cmd *cobra.Command, args []string) error {
 		fmt.Printf("    Timestamp:  %s\n", manifest.Timestamp.Format(time.RFC3339))
 		fmt.Printf("    Blocks:     %d\n", manifest.TotalBlocks)
 		fmt.Printf("    Size:       %d bytes (%.2f MB)\n", manifest.TotalSize, float64(manifest.TotalSize)/(1024*1024))
+		if manifest.CompressedSize > 0 {
+			fmt.Printf("    Stored:     %d bytes (%s)\n", manifest.CompressedSize, manifest.Compression)
+		}
 		if manifest.BaseSnapshotName != "" {
 			fmt.Printf("    Base:       %s\n", manifest.BaseSnapshotName)
 		}
+		if manifest.KeyID != "" {
+			fmt.Printf("    Encrypted:  %s (key %s)\n", manifest.Cipher, manifest.KeyID)
+		}
 		fmt.Println()
 
 		totalBlocks += manifest.TotalBlocks
 		totalSize += manifest.TotalSize
 
+		if manifest.BlockLayout == metadata.LayoutContentAddressed {
+			fmt.Printf("    Block objects are content-addressed (shared under %s)\n\n", metadata.ContentAddressedPrefix)
+			continue
+		}
+
 		// Check if block data exists in S3
 		blockPrefix := fmt.Sprintf("blocks/%s/", snap)
 		blockObjects, err := s3Client.ListObjects(ctx, blockPrefix)
@@ -174,16 +266,35 @@ func runPlan(cmd *cobra.Command, args []string) error {
 		} else if len(blockObjects) == 0 {
 			fmt.Printf("    WARNING: No block data found in S3 (metadata-only backup)\n\n")
 		} else {
-			fmt.Printf("    Block objects in S3: %d\n\n", len(blockObjects))
+			objectKind := "Block"
+			if manifest.BlockLayout == metadata.LayoutPacked {
+				objectKind = "Pack"
+			}
+			fmt.Printf("    %s objects in S3: %d\n\n", objectKind, len(blockObjects))
 		}
 	}
 
+	// Only the newest version of each byte range is restored
+	layers, err := loadBlockLists(ctx, s3Client, chain)
+	if err != nil {
+		return err
+	}
+	pieces := blocks.MergeBlockLists(layers)
+	replay := replayBytes(layers)
+	flattened := flattenedBytes(pieces)
+
 	fmt.Println("========================================")
 	fmt.Println("Restore Summary")
 	fmt.Println("========================================")
 	fmt.Printf("Total Snapshots:  %d\n", len(chain))
 	fmt.Printf("Total Blocks:     %d\n", totalBlocks)
-	fmt.Printf("Total Download:   %d bytes (%.2f MB)\n", totalSize, float64(totalSize)/(1024*1024))
+	fmt.Printf("Total Size:       %d bytes (%.2f MB)\n", totalSize, float64(totalSize)/(1024*1024))
+	fmt.Printf("Extents to Write: %d\n", len(pieces))
+	fmt.Printf("Data to Write:    %d bytes (%.2f MB)\n", flattened, float64(flattened)/(1024*1024))
+	if replay > 0 {
+		fmt.Printf("Saved vs Replay:  %d bytes (%.2f MB, %.1f%%)\n", replay-flattened,
+			float64(replay-flattened)/(1024*1024), 100*float64(replay-flattened)/float64(replay))
+	}
 	if len(manifests) > 0 {
 		base := manifests[chain[0]]
 		fmt.Printf("Volume Size:      %d bytes (%.2f MB)\n", base.VolumeSize, float64(base.VolumeSize)/(1024*1024))
@@ -197,6 +308,13 @@ func runRestore(cmd *cobra.Command, args []string) error {
 	ctx := context.Background()
 	startTime := time.Now()
 
+	if onChecksumFailure != checksumAbort && onChecksumFailure != checksumRetry {
+		return fmt.Errorf("invalid --on-checksum-failure %q (must be %s or %s)", onChecksumFailure, checksumAbort, checksumRetry)
+	}
+	if restoreConcurrency < 1 {
+		return fmt.Errorf("--concurrency must be at least 1")
+	}
+
 	fmt.Println("========================================")
 	fmt.Println("CBT Restore Tool")
 	fmt.Println("========================================")
@@ -205,16 +323,23 @@ func runRestore(cmd *cobra.Command, args []string) error {
 	fmt.Printf("Verify:          %v\n", verify)
 	fmt.Println("========================================")
 
-	// Connect to S3
-	fmt.Println("\n[1/4] Connecting to S3 storage...")
-	s3Client, err := newS3Client()
+	// Connect to the repository
+	fmt.Println("\n[1/5] Connecting to repository storage...")
+	s3Client, keyring, err := newStorageClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open repository: %w", err)
+	}
+	fmt.Printf("Connected to repository (%s)\n", repositoryLocation())
+
+	repoLock, lockCtx, err := lockRepository(ctx, s3Client, "restore")
 	if err != nil {
-		return fmt.Errorf("failed to create S3 client: %w", err)
+		return err
 	}
-	fmt.Printf("Connected to S3 (bucket: %s)\n", s3Bucket)
+	defer unlockRepository(repoLock)
+	ctx = lockCtx
 
 	// Build snapshot chain
-	fmt.Println("\n[2/4] Resolving snapshot chain...")
+	fmt.Println("\n[2/5] Resolving snapshot chain...")
 	chain, manifests, err := buildSnapshotChain(ctx, s3Client, snapshotName)
 	if err != nil {
 		return err
@@ -228,89 +353,101 @@ func runRestore(cmd *cobra.Command, args []string) error {
 		fmt.Printf("  [%d] %s (%s, %d blocks)\n", i+1, snap, snapType, manifests[snap].TotalBlocks)
 	}
 
+	// Work out which snapshot holds the newest version of every byte range
+	fmt.Println("\n[3/5] Flattening snapshot chain...")
+	layers, err := loadBlockLists(ctx, s3Client, chain)
+	if err != nil {
+		return err
+	}
+	chainManifests := make([]*metadata.SnapshotManifest, len(chain))
+	for i, snap := range chain {
+		chainManifests[i] = manifests[snap]
+	}
+	pieces := blocks.MergeBlockLists(layers)
+	replay := replayBytes(layers)
+	flattened := flattenedBytes(pieces)
+	fmt.Printf("Extents to write: %d (%.2f MB; replaying the chain would write %.2f MB)\n",
+		len(pieces), float64(flattened)/(1024*1024), float64(replay)/(1024*1024))
+
 	// Open block device for writing
-	fmt.Printf("\n[3/4] Opening device %s for writing...\n", devicePath)
+	fmt.Printf("\n[4/5] Opening device %s for writing...\n", devicePath)
 	writer, err := blocks.NewWriter(devicePath, blocks.DefaultBlockSize)
 	if err != nil {
 		return fmt.Errorf("failed to open device: %w", err)
 	}
 	defer writer.Close()
 
-	// Apply each snapshot in chain order
-	fmt.Println("\n[4/4] Applying snapshots...")
+	// Write each extent once, from the snapshot that last changed it
+	fmt.Println("\n[5/5] Writing blocks...")
 
 	stats := metadata.RestoreStats{
-		StartTime: startTime,
+		StartTime:       startTime,
+		BytesSuperseded: replay - flattened,
 	}
-
-	for i, snap := range chain {
-		manifest := manifests[snap]
-		snapType := "full"
-		if manifest.IsIncremental {
-			snapType = "incremental"
+	extents := groupPieces(pieces)
+	opts := restoreOptions{Workers: restoreConcurrency}
+	if resumeRestore {
+		opts.Done, err = loadJournal(ctx, s3Client, chain, extents)
+		if err != nil {
+			return err
 		}
-		fmt.Printf("\n--- Applying snapshot %d/%d: %s (%s) ---\n", i+1, len(chain), snap, snapType)
-
-		// Download block list
-		blocksPath := fmt.Sprintf("metadata/%s/blocks.json", snap)
-		var blockList metadata.BlockList
-		if err := s3Client.DownloadJSON(ctx, blocksPath, &blockList); err != nil {
-			return fmt.Errorf("failed to download block list for %s: %w", snap, err)
+		if opts.Done == nil {
+			fmt.Println("  No restore journal found; writing every extent")
 		}
+	}
 
-		if len(blockList.Blocks) == 0 {
-			fmt.Printf("  No blocks to apply for %s\n", snap)
-			stats.SnapshotsApplied++
-			continue
+	// Only the extents still to write are planned for download
+	pending := make([]sourceExtent, 0, len(extents))
+	for i, e := range extents {
+		if opts.Done == nil || !opts.Done[i] {
+			pending = append(pending, e)
 		}
+	}
+	if skipped := len(extents) - len(pending); skipped > 0 {
+		fmt.Printf("  Resuming: %d of %d extents already written\n", skipped, len(extents))
+	}
 
-		fmt.Printf("  Blocks to restore: %d\n", len(blockList.Blocks))
-
-		// Download and write each block
-		for j, blockMeta := range blockList.Blocks {
-			blockPath := fmt.Sprintf("blocks/%s/block-%d-%d", snap, blockMeta.Offset, blockMeta.Size)
-
-			// Download block data from S3
-			blockData, err := s3Client.DownloadObject(ctx, blockPath)
-			if err != nil {
-				return fmt.Errorf("failed to download block at offset %d from %s: %w", blockMeta.Offset, snap, err)
-			}
-
-			stats.BytesDownloaded += int64(len(blockData))
-			stats.BlocksDownloaded++
+	reader := newPieceReader(s3Client, keyring, chainManifests, layers, pending)
+	if verify {
+		reader.verifyPolicy = onChecksumFailure
+		reader.retries = checksumRetries
+	}
 
-			// Verify checksum if requested
-			if verify {
-				hash := sha256.Sum256(blockData)
-				checksum := fmt.Sprintf("%x", hash)
-				// Store checksum for stats (actual verification happens if backup stored checksums)
-				_ = checksum
-				stats.ChecksumVerified++
-			}
+	if journalInterval > 0 {
+		opts.Journal = newJournaler(s3Client, writer, chain, extents, journalInterval)
+	}
 
-			// Write block to device
-			bd := &blocks.BlockData{
-				Offset: blockMeta.Offset,
-				Size:   int64(len(blockData)),
-				Data:   blockData,
-			}
-			if err := writer.WriteBlock(bd); err != nil {
-				return fmt.Errorf("failed to write block at offset %d: %w", blockMeta.Offset, err)
-			}
+	fmt.Printf("  Writing %d extents with %d workers\n", len(pending), restoreConcurrency)
+	written, err := restoreExtents(ctx, reader, writer, extents, opts)
+	stats.BytesWritten = written.BytesWritten
+	stats.BlocksWritten = written.BlocksWritten
+	if err != nil {
+		stats.ChecksumVerified = reader.ChecksumVerified
+		stats.ChecksumFailed = reader.ChecksumFailed
+		saveRestoreStats(ctx, s3Client, stats, err)
+		if opts.Journal != nil {
+			fmt.Println("Restore interrupted; continue it with --resume")
+		}
+		return err
+	}
 
-			stats.BytesWritten += int64(len(blockData))
-			stats.BlocksWritten++
+	// Everything is written; the journal is only dropped once it is synced
+	if err := writer.Sync(); err != nil {
+		return err
+	}
+	if err := s3Client.DeleteObject(ctx, journalPath(snapshotName, devicePath)); err != nil {
+		fmt.Printf("Warning: Failed to delete restore journal: %v\n", err)
+	}
 
-			// Progress every 100 blocks or on last block
-			if (j+1)%100 == 0 || j == len(blockList.Blocks)-1 {
-				fmt.Printf("  Progress: %d/%d blocks written (%.2f MB)\n",
-					j+1, len(blockList.Blocks),
-					float64(stats.BytesWritten)/(1024*1024))
-			}
+	stats.BytesDownloaded = reader.BytesDownloaded
+	stats.BlocksDownloaded = reader.BlocksDownloaded
+	stats.ChecksumVerified = reader.ChecksumVerified
+	stats.ChecksumFailed = reader.ChecksumFailed
+	stats.SnapshotsApplied = len(chain)
+	for i, f := range reader.fetchers {
+		if f.PacksDownloaded > 0 || f.RangedGets > 0 {
+			fmt.Printf("  Packs of %s: %d downloaded whole, %d ranged GETs\n", chain[i], f.PacksDownloaded, f.RangedGets)
 		}
-
-		stats.SnapshotsApplied++
-		fmt.Printf("  Snapshot %s applied successfully\n", snap)
 	}
 
 	// Final stats
@@ -324,10 +461,7 @@ func runRestore(cmd *cobra.Command, args []string) error {
 	}
 
 	// Save restore stats to S3
-	restoreStatsPath := fmt.Sprintf("metadata/%s/restore-stats.json", snapshotName)
-	if err := s3Client.UploadJSON(ctx, restoreStatsPath, stats); err != nil {
-		fmt.Printf("Warning: Failed to save restore stats: %v\n", err)
-	}
+	saveRestoreStats(ctx, s3Client, stats, nil)
 
 	fmt.Println("\n========================================")
 	fmt.Println("Restore Summary")
@@ -338,10 +472,15 @@ func runRestore(cmd *cobra.Command, args []string) error {
 	fmt.Printf("Blocks Written:     %d\n", stats.BlocksWritten)
 	fmt.Printf("Data Downloaded:    %d bytes (%.2f MB)\n", stats.BytesDownloaded, float64(stats.BytesDownloaded)/(1024*1024))
 	fmt.Printf("Data Written:       %d bytes (%.2f MB)\n", stats.BytesWritten, float64(stats.BytesWritten)/(1024*1024))
+	fmt.Printf("Superseded Data:    %d bytes (%.2f MB not written)\n", stats.BytesSuperseded, float64(stats.BytesSuperseded)/(1024*1024))
 	fmt.Printf("Duration:           %s\n", stats.Duration)
 	fmt.Printf("Throughput:         %.2f MB/s\n", stats.RestoreThroughput)
 	if verify {
 		fmt.Printf("Checksums Verified: %d\n", stats.ChecksumVerified)
+		fmt.Printf("Checksum Failures:  %d\n", stats.ChecksumFailed)
+		if reader.ChecksumMissing > 0 {
+			fmt.Printf("Not Verifiable:     %d blocks (backup recorded no checksum)\n", reader.ChecksumMissing)
+		}
 	}
 	fmt.Println("========================================")
 	fmt.Println("Restore completed successfully!")
@@ -349,6 +488,31 @@ func runRestore(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// saveRestoreStats uploads the restore statistics next to the target
+// snapshot's metadata, recording the error that ended a failed restore
+func saveRestoreStats(ctx context.Context, s3Client *storage.Client, stats metadata.RestoreStats, restoreErr error) {
+	if restoreErr != nil {
+		stats.EndTime = time.Now()
+		stats.Duration = stats.EndTime.Sub(stats.StartTime)
+		stats.Errors = append(stats.Errors, restoreErr.Error())
+	}
+
+	restoreStatsPath := fmt.Sprintf("metadata/%s/restore-stats.json", snapshotName)
+	if err := s3Client.UploadJSON(ctx, restoreStatsPath, stats); err != nil {
+		fmt.Printf("Warning: Failed to save restore stats: %v\n", err)
+	}
+}
+
+// downloadBlock fetches the stored data of a block. Entries that record the
+// byte range of their data (packed blocks, and blocks a consolidated backup
+// copied from packs) are read through the fetcher.
+func downloadBlock(ctx context.Context, s3Client *storage.Client, fetcher *pack.Fetcher, manifest *metadata.SnapshotManifest, block blocks.BlockMetadata) ([]byte, error) {
+	if block.Object != "" && block.StoredSize > 0 {
+		return fetcher.Read(ctx, block)
+	}
+	return s3Client.DownloadObject(ctx, metadata.BlockObjectPath(manifest, block))
+}
+
 func runList(cmd *cobra.Command, args []string) error {
 	ctx := context.Background()
 
@@ -356,49 +520,45 @@ func runList(cmd *cobra.Command, args []string) error {
 	fmt.Println("Available Backups")
 	fmt.Println("========================================")
 
-	s3Client, err := newS3Client()
+	s3Client, _, err := newStorageClient(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to create S3 client: %w", err)
+		return fmt.Errorf("failed to open repository: %w", err)
 	}
 
-	objects, err := s3Client.ListObjects(ctx, "metadata/")
+	catalog, err := loadCatalog(ctx, s3Client)
 	if err != nil {
-		return fmt.Errorf("failed to list objects: %w", err)
+		return err
 	}
 
-	if len(objects) == 0 {
+	if len(catalog.Snapshots) == 0 {
 		fmt.Println("No backups found.")
 		return nil
 	}
 
-	manifests := make(map[string]metadata.SnapshotManifest)
-	for _, obj := range objects {
-		if len(obj) > 14 && obj[len(obj)-14:] == "/manifest.json" {
-			var manifest metadata.SnapshotManifest
-			if err := s3Client.DownloadJSON(ctx, obj, &manifest); err != nil {
-				fmt.Printf("Warning: Failed to load %s: %v\n", obj, err)
-				continue
-			}
-			manifests[manifest.Name] = manifest
-		}
+	fmt.Printf("\nFound %d backup(s):\n\n", len(catalog.Snapshots))
+	pvcs := make([]string, 0, len(catalog.Chains))
+	for pvc := range catalog.Chains {
+		pvcs = append(pvcs, pvc)
 	}
-
-	fmt.Printf("\nFound %d backup(s):\n\n", len(manifests))
-	for _, manifest := range manifests {
-		snapType := "Full"
-		if manifest.IsIncremental {
-			snapType = "Incremental"
-		}
-		fmt.Printf("Snapshot: %s (%s)\n", manifest.Name, snapType)
-		fmt.Printf("  PVC:           %s\n", manifest.PVCName)
-		fmt.Printf("  Timestamp:     %s\n", manifest.Timestamp.Format(time.RFC3339))
-		if manifest.BaseSnapshotName != "" {
-			fmt.Printf("  Base Snapshot: %s\n", manifest.BaseSnapshotName)
+	sort.Strings(pvcs)
+
+	for _, pvc := range pvcs {
+		for _, name := range catalog.Chains[pvc] {
+			entry, _ := catalog.Find(name)
+			snapType := "Full"
+			if entry.IsIncremental {
+				snapType = "Incremental"
+			}
+			fmt.Printf("Snapshot: %s (%s)\n", entry.Name, snapType)
+			fmt.Printf("  PVC:           %s\n", entry.PVCName)
+			fmt.Printf("  Timestamp:     %s\n", entry.Timestamp.Format(time.RFC3339))
+			if entry.BaseSnapshot != "" {
+				fmt.Printf("  Base Snapshot: %s\n", entry.BaseSnapshot)
+			}
+			fmt.Printf("  Total Blocks:  %d\n", entry.BlockCount)
+			fmt.Printf("  Total Size:    %d bytes\n", entry.TotalSize)
+			fmt.Println()
 		}
-		fmt.Printf("  Volume Size:   %d bytes\n", manifest.VolumeSize)
-		fmt.Printf("  Total Blocks:  %d\n", manifest.TotalBlocks)
-		fmt.Printf("  Total Size:    %d bytes\n", manifest.TotalSize)
-		fmt.Println()
 	}
 
 	fmt.Println("========================================")
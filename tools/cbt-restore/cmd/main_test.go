@@ -1,11 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/blocks"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/compression"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/encryption"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/metadata"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/storage"
+	"github.com/klauspost/compress/zstd"
 )
 
 func TestBlockWriteAndVerify(t *testing.T) {
@@ -123,3 +135,282 @@ func TestWriteMultipleBlocks(t *testing.T) {
 		}
 	}
 }
+
+func TestDecompressBlock(t *testing.T) {
+	raw := bytes.Repeat([]byte("compressible block data "), 512)
+
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("failed to create zstd encoder: %v", err)
+	}
+	zstdData := enc.EncodeAll(raw, nil)
+
+	// raw as stored by earlier releases: its length as a 4-byte little-endian
+	// integer followed by an LZ4 block
+	lz4Data, err := hex.DecodeString("00300000ff09636f6d707265737369626c6520626c6f636b2064617461201800" +
+		strings.Repeat("ff", 48) + "00506461746120")
+	if err != nil {
+		t.Fatalf("failed to decode lz4 fixture: %v", err)
+	}
+
+	for codec, stored := range map[string][]byte{
+		"":               raw,
+		compression.Zstd: zstdData,
+		compression.LZ4:  lz4Data,
+	} {
+		got, err := compression.Decompress(codec, stored)
+		if err != nil {
+			t.Fatalf("codec %q: decompress failed: %v", codec, err)
+		}
+		if !bytes.Equal(got, raw) {
+			t.Errorf("codec %q: data mismatch after decompress", codec)
+		}
+	}
+
+	if _, err := compression.Decompress(compression.LZ4, lz4Data[:len(lz4Data)-4]); err == nil {
+		t.Error("expected error for a truncated lz4 block")
+	}
+	if _, err := compression.Decompress("gzip", raw); err == nil {
+		t.Error("expected error for unsupported codec")
+	}
+}
+
+func TestDecryptBlock(t *testing.T) {
+	keyring, err := encryption.NewKeyring(bytes.Repeat([]byte{0x42}, encryption.KeySize))
+	if err != nil {
+		t.Fatalf("failed to create keyring: %v", err)
+	}
+	if _, err := keyring.GenerateKey(); err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	raw := []byte("secret block data")
+	manifest := &metadata.SnapshotManifest{Name: "snap-1", Cipher: encryption.Algorithm, KeyID: keyring.ActiveKeyID()}
+	block := blocks.BlockMetadata{Offset: 4096, Size: int64(len(raw))}
+	sealed, err := keyring.Encrypt(raw, metadata.BlockAssociatedData(manifest, block))
+	if err != nil {
+		t.Fatalf("failed to encrypt: %v", err)
+	}
+
+	got, err := decryptBlock(keyring, manifest, block, sealed)
+	if err != nil {
+		t.Fatalf("decrypt failed: %v", err)
+	}
+	if !bytes.Equal(got, raw) {
+		t.Errorf("got %q, want %q", got, raw)
+	}
+
+	moved := blocks.BlockMetadata{Offset: 8192, Size: block.Size}
+	if _, err := decryptBlock(keyring, manifest, moved, sealed); err == nil {
+		t.Error("expected error for a block passed off as another extent")
+	}
+
+	other := &metadata.SnapshotManifest{Name: "snap-2", Cipher: encryption.Algorithm, KeyID: keyring.ActiveKeyID()}
+	if _, err := decryptBlock(keyring, other, block, sealed); err == nil {
+		t.Error("expected error for a block swapped in from another snapshot")
+	}
+	copied := block
+	copied.SealedBy = manifest.Name
+	if got, err := decryptBlock(keyring, other, copied, sealed); err != nil || !bytes.Equal(got, raw) {
+		t.Errorf("block copied from %s: %q, %v", manifest.Name, got, err)
+	}
+
+	sealed[len(sealed)-1] ^= 0xff
+	if _, err := decryptBlock(keyring, manifest, block, sealed); err == nil {
+		t.Error("expected error for tampered block")
+	}
+
+	if _, err := decryptBlock(nil, manifest, block, sealed); !errors.Is(err, encryption.ErrEncrypted) {
+		t.Errorf("expected ErrEncrypted without a keyring, got %v", err)
+	}
+
+	plain, err := decryptBlock(nil, &metadata.SnapshotManifest{Name: "snap-0"}, block, raw)
+	if err != nil || !bytes.Equal(plain, raw) {
+		t.Errorf("unencrypted block changed: %q, %v", plain, err)
+	}
+}
+
+func TestCatalogResolveChain(t *testing.T) {
+	base := time.Date(2025, 1, 15, 10, 0, 0, 0, time.UTC)
+	catalog := metadata.BuildCatalog([]metadata.SnapshotManifest{
+		{Name: "snap-3", PVCName: "data", Timestamp: base.Add(2 * time.Hour), IsIncremental: true, BaseSnapshotName: "snap-2"},
+		{Name: "snap-1", PVCName: "data", Timestamp: base},
+		{Name: "snap-2", PVCName: "data", Timestamp: base.Add(time.Hour), IsIncremental: true, BaseSnapshotName: "snap-1"},
+		{Name: "other-1", PVCName: "other", Timestamp: base},
+	})
+
+	if got := catalog.Chains["data"]; strings.Join(got, ",") != "snap-1,snap-2,snap-3" {
+		t.Errorf("chain for data: got %v", got)
+	}
+
+	chain, err := catalog.ResolveChain("snap-3")
+	if err != nil {
+		t.Fatalf("resolve failed: %v", err)
+	}
+	if strings.Join(chain, ",") != "snap-1,snap-2,snap-3" {
+		t.Errorf("got chain %v", chain)
+	}
+
+	catalog.Remove("snap-1")
+	if _, err := catalog.ResolveChain("snap-3"); err == nil {
+		t.Error("expected error for chain with a missing base")
+	}
+}
+
+func TestMergeBlockLists(t *testing.T) {
+	layers := [][]blocks.BlockMetadata{
+		{{Offset: 0, Size: 4096}, {Offset: 8192, Size: 8192}},
+		{{Offset: 10240, Size: 2048}},
+		{{Offset: 0, Size: 4096}},
+	}
+
+	pieces := blocks.MergeBlockLists(layers)
+
+	type want struct {
+		layer        int
+		offset, size int64
+		whole        bool
+	}
+	expected := []want{
+		{2, 0, 4096, true},
+		{0, 8192, 2048, false},
+		{1, 10240, 2048, true},
+		{0, 12288, 4096, false},
+	}
+	if len(pieces) != len(expected) {
+		t.Fatalf("got %d pieces, want %d: %+v", len(pieces), len(expected), pieces)
+	}
+	for i, w := range expected {
+		p := pieces[i]
+		if p.Layer != w.layer || p.Offset != w.offset || p.Size != w.size || p.Whole() != w.whole {
+			t.Errorf("piece %d: got layer %d offset %d size %d whole %v, want %+v", i, p.Layer, p.Offset, p.Size, p.Whole(), w)
+		}
+	}
+
+	if saved := replayBytes(layers) - flattenedBytes(pieces); saved != 6144 {
+		t.Errorf("saved %d bytes, want 6144", saved)
+	}
+}
+
+func TestGroupPieces(t *testing.T) {
+	layers := [][]blocks.BlockMetadata{
+		{{Offset: 0, Size: 16384}},
+		{{Offset: 4096, Size: 4096}},
+	}
+
+	extents := groupPieces(blocks.MergeBlockLists(layers))
+	if len(extents) != 2 {
+		t.Fatalf("got %d extents, want 2: %+v", len(extents), extents)
+	}
+
+	// The base entry is split around the incremental one but downloaded once
+	base := extents[0]
+	if base.Layer != 0 || len(base.Pieces) != 2 {
+		t.Fatalf("first extent: got layer %d with %d pieces, want layer 0 with 2", base.Layer, len(base.Pieces))
+	}
+	if base.Pieces[0].Offset != 0 || base.Pieces[1].Offset != 8192 {
+		t.Errorf("base pieces at %d and %d, want 0 and 8192", base.Pieces[0].Offset, base.Pieces[1].Offset)
+	}
+	if extents[1].Layer != 1 || len(extents[1].Pieces) != 1 {
+		t.Errorf("second extent: got layer %d with %d pieces, want layer 1 with 1", extents[1].Layer, len(extents[1].Pieces))
+	}
+}
+
+func TestCompletedRanges(t *testing.T) {
+	finished := []bool{true, true, false, true, false, false, true, true, true}
+
+	ranges := completedRanges(finished)
+	expected := [][2]int{{0, 2}, {3, 4}, {6, 9}}
+	if len(ranges) != len(expected) {
+		t.Fatalf("got ranges %v, want %v", ranges, expected)
+	}
+	for i := range expected {
+		if ranges[i] != expected[i] {
+			t.Errorf("range %d: got %v, want %v", i, ranges[i], expected[i])
+		}
+	}
+
+	if got := completedRanges(make([]bool, 4)); len(got) != 0 {
+		t.Errorf("got ranges %v for no finished extents, want none", got)
+	}
+}
+
+func TestBackupStates(t *testing.T) {
+	tests := []struct {
+		state      string
+		committed  bool
+		restorable bool
+	}{
+		{"", true, true},
+		{metadata.StateCompleted, true, true},
+		{metadata.StateMetadataOnly, true, false},
+		{metadata.StateInProgress, false, false},
+		{metadata.StateFailed, false, false},
+	}
+	for _, tt := range tests {
+		m := metadata.SnapshotManifest{State: tt.state}
+		if m.Committed() != tt.committed || m.Restorable() != tt.restorable {
+			t.Errorf("state %q: got committed %v restorable %v, want %v %v",
+				tt.state, m.Committed(), m.Restorable(), tt.committed, tt.restorable)
+		}
+	}
+
+	catalog := metadata.BuildCatalog([]metadata.SnapshotManifest{
+		{Name: "snap-1", PVCName: "data", State: metadata.StateCompleted},
+		{Name: "snap-2", PVCName: "data", State: metadata.StateInProgress},
+		{Name: "snap-3", PVCName: "data", State: metadata.StateFailed},
+	})
+	if len(catalog.Snapshots) != 1 || catalog.Snapshots[0].Name != "snap-1" {
+		t.Errorf("catalog should only hold committed backups, got %+v", catalog.Snapshots)
+	}
+}
+
+func TestJournalIsKeyedByDevice(t *testing.T) {
+	if journalPath("snap-1", "/dev/xvdb") != journalPath("snap-1", "/dev/xvdb") {
+		t.Error("journal path of the same device is not stable")
+	}
+	if journalPath("snap-1", "/dev/xvdb") == journalPath("snap-1", "/dev/xvdc") {
+		t.Error("restores to different devices share a journal")
+	}
+
+	backend, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocal: %v", err)
+	}
+	client := storage.NewClient(backend)
+	ctx := context.Background()
+
+	savedSnapshot, savedDevice := snapshotName, devicePath
+	defer func() { snapshotName, devicePath = savedSnapshot, savedDevice }()
+	snapshotName = "snap-1"
+
+	chain := []string{"snap-1"}
+	extents := make([]sourceExtent, 4)
+	journal := metadata.RestoreJournal{
+		Snapshot:  "snap-1",
+		Device:    "/dev/xvdb",
+		Chain:     chain,
+		Extents:   len(extents),
+		Completed: [][2]int{{0, 2}},
+	}
+	if err := client.UploadJSON(ctx, journalPath("snap-1", "/dev/xvdb"), journal); err != nil {
+		t.Fatalf("failed to write journal: %v", err)
+	}
+
+	// A restore of the same snapshot to another device starts from scratch
+	// instead of failing on, or overwriting, the other restore's journal
+	devicePath = "/dev/xvdc"
+	done, err := loadJournal(ctx, client, chain, extents)
+	if err != nil || done != nil {
+		t.Fatalf("loadJournal for another device = %v, %v; want no journal", done, err)
+	}
+
+	devicePath = "/dev/xvdb"
+	done, err = loadJournal(ctx, client, chain, extents)
+	if err != nil {
+		t.Fatalf("loadJournal: %v", err)
+	}
+	if !slices.Equal(done, []bool{true, true, false, false}) {
+		t.Errorf("loadJournal = %v, want the first two extents done", done)
+	}
+}
@@ -3,7 +3,9 @@ module github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore
 go 1.25.0
 
 require (
+	github.com/klauspost/compress v1.17.11
 	github.com/minio/minio-go/v7 v7.0.82
+	github.com/pierrec/lz4/v4 v4.1.22
 	github.com/spf13/cobra v1.8.1
 )
 
@@ -14,7 +16,6 @@ require (
 	github.com/goccy/go-json v0.10.3 // indirect
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
-	github.com/klauspost/compress v1.17.11 // indirect
 	github.com/klauspost/cpuid/v2 v2.2.8 // indirect
 	github.com/minio/md5-simd v1.1.2 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
@@ -3,7 +3,6 @@ package blocks
 import (
 	"crypto/sha256"
 	"fmt"
-	"io"
 	"os"
 )
 
@@ -14,8 +13,14 @@ const (
 
 // BlockMetadata describes a block's location
 type BlockMetadata struct {
-	Offset int64 `json:"offset"`
-	Size   int64 `json:"size"`
+	Offset       int64  `json:"offset"`
+	Size         int64  `json:"size"`
+	Checksum     string `json:"checksum,omitempty"`     // SHA-256 of the block data
+	Object       string `json:"object,omitempty"`       // Object holding the data, when not implied by the layout
+	ObjectOffset int64  `json:"objectOffset,omitempty"` // Byte offset of the data within Object
+	StoredSize   int64  `json:"storedSize,omitempty"`   // Bytes stored for this block
+	Compression  string `json:"compression,omitempty"`  // Codec of the stored data; empty when stored raw
+	SealedBy     string `json:"sealedBy,omitempty"`     // Snapshot that encrypted the data, when copied from another
 }
 
 // BlockData represents a block of data
@@ -60,14 +65,19 @@ func (w *Writer) Close() error {
 	return nil
 }
 
-// WriteBlock writes a block at the given offset
-func (w *Writer) WriteBlock(block *BlockData) error {
-	_, err := w.device.Seek(block.Offset, io.SeekStart)
-	if err != nil {
-		return fmt.Errorf("failed to seek to offset %d: %w", block.Offset, err)
+// Sync flushes the blocks written so far to the device
+func (w *Writer) Sync() error {
+	if err := w.device.Sync(); err != nil {
+		return fmt.Errorf("failed to sync device: %w", err)
 	}
+	return nil
+}
 
-	n, err := w.device.Write(block.Data)
+// WriteBlock writes a block at the given offset. It does not move the
+// device's file offset, so it is safe for concurrent use with blocks that do
+// not overlap.
+func (w *Writer) WriteBlock(block *BlockData) error {
+	n, err := w.device.WriteAt(block.Data, block.Offset)
 	if err != nil {
 		return fmt.Errorf("failed to write block at offset %d: %w", block.Offset, err)
 	}
@@ -0,0 +1,74 @@
+package compression
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Supported block codecs
+const (
+	None = "none"
+	Zstd = "zstd"
+	LZ4  = "lz4"
+)
+
+var (
+	zstdOnce    sync.Once
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// initZstd creates the shared zstd decoder. DecodeAll is safe for concurrent
+// use.
+func initZstd() error {
+	zstdOnce.Do(func() {
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	return zstdErr
+}
+
+// Decompress decodes data that was stored with codec. An empty codec means
+// the data was stored raw.
+func Decompress(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case "", None:
+		return data, nil
+	case Zstd:
+		if err := initZstd(); err != nil {
+			return nil, fmt.Errorf("failed to initialize zstd: %w", err)
+		}
+		out, err := zstdDecoder.DecodeAll(data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("zstd decompression failed: %w", err)
+		}
+		return out, nil
+	case LZ4:
+		out, err := decodeLZ4(data)
+		if err != nil {
+			return nil, fmt.Errorf("lz4 decompression failed: %w", err)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unsupported compression %q", codec)
+}
+
+// decodeLZ4 decodes an LZ4 block preceded by its uncompressed length as a
+// 4-byte little-endian integer
+func decodeLZ4(data []byte) ([]byte, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("block of %d bytes has no length header", len(data))
+	}
+	out := make([]byte, binary.LittleEndian.Uint32(data))
+	n, err := lz4.UncompressBlock(data[4:], out)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(out) {
+		return nil, fmt.Errorf("block decoded to %d bytes, expected %d", n, len(out))
+	}
+	return out, nil
+}
@@ -0,0 +1,328 @@
+package lock
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	mathrand "math/rand/v2"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/storage"
+)
+
+const (
+	// Prefix holds one object per lock held on the repository
+	Prefix = "locks/"
+
+	// RefreshInterval is how often a held lock records a heartbeat
+	RefreshInterval = 2 * time.Minute
+	// StaleTimeout is how long a lock may go without a heartbeat before other
+	// processes consider its holder dead and ignore it
+	StaleTimeout = 10 * time.Minute
+
+	// retryInterval is how long Acquire waits between attempts
+	retryInterval = 10 * time.Second
+)
+
+var (
+	// ErrLocked is returned when a conflicting lock is held
+	ErrLocked = errors.New("repository is locked")
+	// ErrLost is the cause of a lock's context being canceled when the lock
+	// could not be refreshed in time or was removed by someone else
+	ErrLost = errors.New("repository lock lost")
+)
+
+// Info is the content of a lock object. Locks are stored in plaintext, so
+// every process can see them whatever encryption key it holds.
+type Info struct {
+	ID        string    `json:"id"`
+	Exclusive bool      `json:"exclusive"`
+	Operation string    `json:"operation"` // Command holding the lock, e.g. "backup" or "prune"
+	Hostname  string    `json:"hostname"`
+	PID       int       `json:"pid"`
+	Created   time.Time `json:"created"`
+	Heartbeat time.Time `json:"heartbeat"` // Last time the holder refreshed the lock
+
+	// Unreadable is why the lock object could not be read, e.g. because an
+	// older release wrote it encrypted. Only ID is known then, and Created
+	// and Heartbeat are the object's modification time.
+	Unreadable string `json:"-"`
+}
+
+// Stale reports whether the lock's holder has stopped refreshing it
+func (i *Info) Stale(now time.Time) bool {
+	return now.Sub(i.Heartbeat) > StaleTimeout
+}
+
+// Kind returns "exclusive" or "shared"
+func (i *Info) Kind() string {
+	if i.Exclusive {
+		return "exclusive"
+	}
+	return "shared"
+}
+
+func (i *Info) String() string {
+	if i.Unreadable != "" {
+		return fmt.Sprintf("unreadable lock %s, last modified %s: %s",
+			i.ID, i.Heartbeat.Format(time.RFC3339), i.Unreadable)
+	}
+	return fmt.Sprintf("%s lock %s held by %s on %s (pid %d) since %s, last heartbeat %s",
+		i.Kind(), i.ID, i.Operation, i.Hostname, i.PID,
+		i.Created.Format(time.RFC3339), i.Heartbeat.Format(time.RFC3339))
+}
+
+// Path returns the object key of the lock with the given ID
+func Path(id string) string {
+	return Prefix + id + ".json"
+}
+
+// Options describes the lock to acquire
+type Options struct {
+	Exclusive bool
+	Operation string
+	// Wait is how long to keep retrying while a conflicting lock is held; 0
+	// fails at once
+	Wait time.Duration
+}
+
+// Lock is a lock held on the repository. A background goroutine refreshes
+// its heartbeat until Release is called.
+type Lock struct {
+	client *storage.Client
+	info   Info
+	cancel context.CancelCauseFunc
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// Acquire takes a lock on the repository. Any number of shared locks may be
+// held at the same time; an exclusive lock excludes every other lock. Stale
+// locks are ignored.
+//
+// The lock is written first and the other locks are checked afterwards, so
+// of two processes racing for conflicting locks at least one backs off. The
+// returned context is canceled with ErrLost as its cause if the lock cannot
+// be kept.
+func Acquire(ctx context.Context, client *storage.Client, opts Options) (*Lock, context.Context, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, nil, err
+	}
+	hostname, _ := os.Hostname()
+	now := time.Now()
+
+	l := &Lock{
+		client: client,
+		info: Info{
+			ID:        id,
+			Exclusive: opts.Exclusive,
+			Operation: opts.Operation,
+			Hostname:  hostname,
+			PID:       os.Getpid(),
+			Created:   now,
+			Heartbeat: now,
+		},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	deadline := now.Add(opts.Wait)
+	for {
+		// Look before writing so waiting does not churn lock objects
+		conflict, err := l.conflicting(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		if conflict == nil {
+			l.info.Heartbeat = time.Now()
+			if err := client.UploadPlainJSON(ctx, Path(id), l.info); err != nil {
+				return nil, nil, fmt.Errorf("failed to write lock: %w", err)
+			}
+			conflict, err = l.conflicting(ctx)
+			if err == nil && conflict == nil {
+				break
+			}
+			if delErr := client.DeleteObject(ctx, Path(id)); delErr != nil {
+				fmt.Printf("Warning: failed to remove lock %s: %v\n", id, delErr)
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		if !time.Now().Before(deadline) {
+			return nil, nil, fmt.Errorf("%w: %s", ErrLocked, conflict)
+		}
+		fmt.Printf("  Waiting for %s\n", conflict)
+
+		// Jitter keeps two processes that collided from retrying in lockstep
+		delay := retryInterval/2 + mathrand.N(retryInterval)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+
+	lockCtx, cancel := context.WithCancelCause(ctx)
+	l.cancel = cancel
+	go l.refresh(ctx)
+	return l, lockCtx, nil
+}
+
+// Release stops refreshing the lock and removes it
+func (l *Lock) Release() error {
+	close(l.stop)
+	<-l.done
+	l.cancel(nil)
+
+	// The caller's context may already be canceled; the lock should go
+	// regardless
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := l.client.DeleteObject(ctx, Path(l.info.ID)); err != nil {
+		return fmt.Errorf("failed to release lock %s: %w", l.info.ID, err)
+	}
+	return nil
+}
+
+// refresh records a heartbeat every RefreshInterval. If the lock was removed,
+// or refreshing keeps failing until other processes would consider it
+// stale, the lock's context is canceled.
+func (l *Lock) refresh(ctx context.Context) {
+	defer close(l.done)
+
+	ticker := time.NewTicker(RefreshInterval)
+	defer ticker.Stop()
+
+	last := l.info.Heartbeat
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+
+		err := l.heartbeat(ctx)
+		if errors.Is(err, errRemoved) {
+			l.lose(err)
+			return
+		}
+		if err == nil {
+			last = l.info.Heartbeat
+			continue
+		}
+
+		fmt.Printf("Warning: failed to refresh lock %s: %v\n", l.info.ID, err)
+		if time.Since(last)+RefreshInterval > StaleTimeout {
+			l.lose(fmt.Errorf("lock %s was not refreshed since %s", l.info.ID, last.Format(time.RFC3339)))
+			return
+		}
+	}
+}
+
+// errRemoved is returned by heartbeat when the lock object is gone
+var errRemoved = errors.New("lock was removed")
+
+// heartbeat records a heartbeat. The write is conditional on the lock object
+// being unchanged since it was read, so a lock removed in between, e.g. by
+// unlock, is not written back.
+func (l *Lock) heartbeat(ctx context.Context) error {
+	var current Info
+	etag, err := l.client.DownloadPlainJSONWithETag(ctx, Path(l.info.ID), &current)
+	if errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("%w: %s", errRemoved, l.info.ID)
+	}
+	if err != nil {
+		return err
+	}
+
+	l.info.Heartbeat = time.Now()
+	err = l.client.UploadPlainJSONIfMatch(ctx, Path(l.info.ID), l.info, etag)
+	if errors.Is(err, storage.ErrPreconditionFailed) {
+		return fmt.Errorf("%w: %s", errRemoved, l.info.ID)
+	}
+	return err
+}
+
+func (l *Lock) lose(err error) {
+	err = fmt.Errorf("%w: %v", ErrLost, err)
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	l.cancel(err)
+}
+
+// conflicting returns a live lock held by another process that conflicts
+// with l, or nil if there is none. A live lock that cannot be read may be of
+// either kind and conflicts with every lock; it goes away once stale or with
+// unlock --id.
+func (l *Lock) conflicting(ctx context.Context) (*Info, error) {
+	locks, err := List(ctx, l.client)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for i := range locks {
+		other := &locks[i]
+		if other.ID == l.info.ID || other.Stale(now) {
+			continue
+		}
+		if l.info.Exclusive || other.Exclusive || other.Unreadable != "" {
+			return other, nil
+		}
+	}
+	return nil, nil
+}
+
+// List returns every lock in the repository, stale or not. Locks removed
+// while they are being listed are left out; locks that cannot be read are
+// returned with Unreadable set, so they can still be removed.
+func List(ctx context.Context, client *storage.Client) ([]Info, error) {
+	objects, err := client.ListObjectInfo(ctx, Prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list locks: %w", err)
+	}
+
+	var locks []Info
+	for _, obj := range objects {
+		id := strings.TrimSuffix(path.Base(obj.Key), ".json")
+
+		var info Info
+		if err := client.DownloadPlainJSON(ctx, obj.Key, &info); err != nil {
+			exists, existsErr := client.ObjectExists(ctx, obj.Key)
+			if existsErr == nil && !exists {
+				continue
+			}
+			info = Info{
+				ID:         id,
+				Created:    obj.LastModified,
+				Heartbeat:  obj.LastModified,
+				Unreadable: err.Error(),
+			}
+		}
+		if info.ID == "" {
+			info.ID = id
+		}
+		locks = append(locks, info)
+	}
+	return locks, nil
+}
+
+// Remove deletes the lock with the given ID, whoever holds it
+func Remove(ctx context.Context, client *storage.Client, id string) error {
+	return client.DeleteObject(ctx, Path(id))
+}
+
+func newID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate lock ID: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
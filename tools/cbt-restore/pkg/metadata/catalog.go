@@ -0,0 +1,126 @@
+package metadata
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// CatalogPath is the object key of the global backup catalog
+	CatalogPath = "metadata/catalog.json"
+	// CatalogVersion is the catalog format written by this version
+	CatalogVersion = "v1"
+)
+
+// NewCatalog returns an empty catalog
+func NewCatalog() *Catalog {
+	return &Catalog{
+		Version: CatalogVersion,
+		Chains:  make(map[string][]string),
+	}
+}
+
+// BuildCatalog creates a catalog describing the given manifests. Backups
+// that were never committed are left out.
+func BuildCatalog(manifests []SnapshotManifest) *Catalog {
+	c := NewCatalog()
+	for i := range manifests {
+		if !manifests[i].Committed() {
+			continue
+		}
+		c.Upsert(&manifests[i])
+	}
+	return c
+}
+
+// CatalogEntryFromManifest summarizes a snapshot manifest for the catalog
+func CatalogEntryFromManifest(m *SnapshotManifest) CatalogEntry {
+	return CatalogEntry{
+		Name:          m.Name,
+		PVCName:       m.PVCName,
+		Timestamp:     m.Timestamp,
+		IsIncremental: m.IsIncremental,
+		BaseSnapshot:  m.BaseSnapshotName,
+		TotalSize:     m.TotalSize,
+		BlockCount:    m.TotalBlocks,
+	}
+}
+
+// Upsert adds the snapshot described by m, replacing any entry with the same
+// name, and refreshes the per-PVC chains
+func (c *Catalog) Upsert(m *SnapshotManifest) {
+	entry := CatalogEntryFromManifest(m)
+	for i := range c.Snapshots {
+		if c.Snapshots[i].Name == entry.Name {
+			c.Snapshots[i] = entry
+			c.reindex()
+			return
+		}
+	}
+	c.Snapshots = append(c.Snapshots, entry)
+	c.reindex()
+}
+
+// Remove deletes a snapshot from the catalog and reports whether it was present
+func (c *Catalog) Remove(name string) bool {
+	for i := range c.Snapshots {
+		if c.Snapshots[i].Name == name {
+			c.Snapshots = append(c.Snapshots[:i], c.Snapshots[i+1:]...)
+			c.reindex()
+			return true
+		}
+	}
+	return false
+}
+
+// Find returns the catalog entry of a snapshot
+func (c *Catalog) Find(name string) (CatalogEntry, bool) {
+	for _, e := range c.Snapshots {
+		if e.Name == name {
+			return e, true
+		}
+	}
+	return CatalogEntry{}, false
+}
+
+// ResolveChain returns the snapshots needed to restore target in apply order
+// (base first)
+func (c *Catalog) ResolveChain(target string) ([]string, error) {
+	var chain []string
+	seen := make(map[string]bool)
+
+	for current := target; current != ""; {
+		if seen[current] {
+			return nil, fmt.Errorf("snapshot chain of %s contains a cycle at %s", target, current)
+		}
+		seen[current] = true
+
+		entry, ok := c.Find(current)
+		if !ok {
+			return nil, fmt.Errorf("snapshot %s is not in the catalog", current)
+		}
+		chain = append([]string{current}, chain...)
+
+		if !entry.IsIncremental {
+			break
+		}
+		current = entry.BaseSnapshot
+	}
+
+	return chain, nil
+}
+
+// reindex orders snapshots by timestamp and rebuilds the PVC -> snapshots
+// chains from them
+func (c *Catalog) reindex() {
+	sort.SliceStable(c.Snapshots, func(i, j int) bool {
+		return c.Snapshots[i].Timestamp.Before(c.Snapshots[j].Timestamp)
+	})
+
+	c.Chains = make(map[string][]string)
+	for _, e := range c.Snapshots {
+		c.Chains[e.PVCName] = append(c.Chains[e.PVCName], e.Name)
+	}
+	c.Updated = time.Now().UTC()
+}
@@ -23,7 +23,41 @@ type SnapshotManifest struct {
 	StorageClass      string    `json:"storageClass"`
 	VolumeMode        string    `json:"volumeMode"`
 	CSIDriver         string    `json:"csiDriver"`
+	BlockMetadataType string    `json:"blockMetadataType,omitempty"`   // "FIXED_LENGTH" or "VARIABLE_LENGTH", as reported by CBT
+	VolumeCapacity    int64     `json:"volumeCapacityBytes,omitempty"` // Volume capacity reported by CBT
 	SnapshotClassName string    `json:"snapshotClassName"`
+	DataSource        string    `json:"dataSource,omitempty"`
+	BlockLayout       string    `json:"blockLayout,omitempty"` // LayoutPerSnapshot (default), LayoutContentAddressed or LayoutPacked
+	Compression       string    `json:"compression,omitempty"` // Block codec requested for the backup ("none", "zstd", "lz4")
+	Cipher            string    `json:"cipher,omitempty"`      // Algorithm encrypting block data and metadata; empty when unencrypted
+	KeyID             string    `json:"keyId,omitempty"`       // Repository key that encrypted the block data and metadata
+	ConsolidatedFrom  []string  `json:"consolidatedFrom,omitempty"`
+	State             string    `json:"state,omitempty"` // Commit state of the backup; empty for backups written before states were recorded
+}
+
+// Backup states recorded in SnapshotManifest.State. A manifest is written
+// InProgress before any block data and rewritten with its final state only
+// after the block list and chain are in place.
+const (
+	StateInProgress   = "InProgress"
+	StateCompleted    = "Completed"
+	StateFailed       = "Failed"
+	StateMetadataOnly = "MetadataOnly" // Committed without block data, e.g. when CBT was unavailable and no device was given
+)
+
+// Committed reports whether the backup finished writing its metadata
+func (m *SnapshotManifest) Committed() bool {
+	switch m.State {
+	case "", StateCompleted, StateMetadataOnly:
+		return true
+	}
+	return false
+}
+
+// Restorable reports whether the backup holds the block data it describes,
+// so that it can be restored or serve as the base of an incremental
+func (m *SnapshotManifest) Restorable() bool {
+	return m.State == "" || m.State == StateCompleted
 }
 
 // BlockList contains the list of blocks in a snapshot
@@ -39,6 +73,25 @@ type SnapshotChain struct {
 	Dependencies     []string `json:"dependencies"`
 }
 
+// Catalog is the global catalog of all snapshots
+type Catalog struct {
+	Version   string              `json:"version"`
+	Updated   time.Time           `json:"updated"`
+	Snapshots []CatalogEntry      `json:"snapshots"`
+	Chains    map[string][]string `json:"chains"`
+}
+
+// CatalogEntry represents a snapshot in the catalog
+type CatalogEntry struct {
+	Name          string    `json:"name"`
+	PVCName       string    `json:"pvcName"`
+	Timestamp     time.Time `json:"timestamp"`
+	IsIncremental bool      `json:"isIncremental"`
+	BaseSnapshot  string    `json:"baseSnapshot,omitempty"`
+	TotalSize     int64     `json:"totalSize"`
+	BlockCount    int       `json:"blockCount"`
+}
+
 // RestoreManifest describes what's needed for a restore
 type RestoreManifest struct {
 	TargetPVC       string    `json:"targetPVC"`
@@ -48,6 +101,17 @@ type RestoreManifest struct {
 	BlockCount      int       `json:"blockCount"`
 }
 
+// RestoreJournal records how far a restore has got, so that an interrupted
+// restore can be resumed without writing the same extents again
+type RestoreJournal struct {
+	Snapshot  string    `json:"snapshot"`
+	Device    string    `json:"device"`
+	Chain     []string  `json:"chain"`     // Snapshots the restore flattened, base first
+	Extents   int       `json:"extents"`   // Extents in the flattened chain
+	Completed [][2]int  `json:"completed"` // Ranges [start, end) of extents written and synced to the device
+	Updated   time.Time `json:"updated"`
+}
+
 // RestoreStats holds statistics about a restore operation
 type RestoreStats struct {
 	StartTime         time.Time     `json:"startTime"`
@@ -58,6 +122,7 @@ type RestoreStats struct {
 	BlocksDownloaded  int           `json:"blocksDownloaded"`
 	BlocksWritten     int           `json:"blocksWritten"`
 	SnapshotsApplied  int           `json:"snapshotsApplied"`
+	BytesSuperseded   int64         `json:"bytesSuperseded"`
 	AverageBlockSize  int64         `json:"averageBlockSize"`
 	RestoreThroughput float64       `json:"restoreThroughput"`
 	ChecksumVerified  int           `json:"checksumVerified"`
@@ -0,0 +1,148 @@
+package pack
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/blocks"
+	"github.com/kaovilai/k8s-cbt-s3mover-demo/tools/cbt-restore/pkg/storage"
+)
+
+// wholePackThreshold is the fraction of a pack that must be needed before the
+// fetcher downloads the whole object instead of issuing ranged GETs
+const wholePackThreshold = 0.5
+
+// Fetcher reads block data out of pack objects. Packs that the restore needs
+// most of are downloaded once and served from memory until their last needed
+// block has been read; for the rest each block is fetched with a ranged GET.
+// A Fetcher is safe for concurrent use.
+type Fetcher struct {
+	client *storage.Client
+
+	mu         sync.Mutex
+	wholePacks map[string]int // blocks still to be read from each pack downloaded whole
+	cached     map[string]*cachedPack
+
+	PacksDownloaded int
+	RangedGets      int
+}
+
+// cachedPack is a whole pack that is being or has been downloaded
+type cachedPack struct {
+	ready chan struct{} // closed once data or err is set
+	data  []byte
+	err   error
+}
+
+// NewFetcher plans how to read the given pack entries. packSizes maps each
+// pack object to its total size; entries not stored in a pack are ignored.
+func NewFetcher(client *storage.Client, entries []blocks.BlockMetadata, packSizes map[string]int64) *Fetcher {
+	needed := make(map[string]int64)
+	count := make(map[string]int)
+	for _, e := range entries {
+		if e.Object != "" {
+			needed[e.Object] += e.StoredSize
+			count[e.Object]++
+		}
+	}
+
+	wholePacks := make(map[string]int)
+	for obj, n := range needed {
+		if size := packSizes[obj]; size > 0 && float64(n) >= wholePackThreshold*float64(size) {
+			wholePacks[obj] = count[obj]
+		}
+	}
+
+	return &Fetcher{
+		client:     client,
+		wholePacks: wholePacks,
+		cached:     make(map[string]*cachedPack),
+	}
+}
+
+// PackSizes derives the size of every pack referenced by a snapshot's block
+// list. A snapshot's entries cover its packs completely, so the end of the
+// last block in a pack is the pack's size.
+func PackSizes(entries []blocks.BlockMetadata) map[string]int64 {
+	sizes := make(map[string]int64)
+	for _, e := range entries {
+		if e.Object == "" {
+			continue
+		}
+		if end := e.ObjectOffset + e.StoredSize; end > sizes[e.Object] {
+			sizes[e.Object] = end
+		}
+	}
+	return sizes
+}
+
+// Invalidate drops the cached copy of the pack holding block so the next Read
+// downloads it again, e.g. after a block read from it failed verification
+func (f *Fetcher) Invalidate(block blocks.BlockMetadata) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.cached, block.Object)
+}
+
+// Done records that block will not be read again. A pack downloaded whole is
+// released once all of its needed blocks are done.
+func (f *Fetcher) Done(block blocks.BlockMetadata) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.wholePacks[block.Object]; !ok {
+		return
+	}
+	f.wholePacks[block.Object]--
+	if f.wholePacks[block.Object] <= 0 {
+		delete(f.cached, block.Object)
+	}
+}
+
+// Read returns the stored bytes of a block held in a pack
+func (f *Fetcher) Read(ctx context.Context, block blocks.BlockMetadata) ([]byte, error) {
+	f.mu.Lock()
+	if _, ok := f.wholePacks[block.Object]; !ok {
+		f.RangedGets++
+		f.mu.Unlock()
+		return f.client.DownloadRange(ctx, block.Object, block.ObjectOffset, block.StoredSize)
+	}
+
+	// The first reader of a pack downloads it; concurrent readers wait
+	p, ok := f.cached[block.Object]
+	if !ok {
+		p = &cachedPack{ready: make(chan struct{})}
+		f.cached[block.Object] = p
+	}
+	f.mu.Unlock()
+
+	if !ok {
+		p.data, p.err = f.client.DownloadObject(ctx, block.Object)
+		f.mu.Lock()
+		if p.err != nil {
+			if f.cached[block.Object] == p {
+				delete(f.cached, block.Object)
+			}
+		} else {
+			f.PacksDownloaded++
+		}
+		f.mu.Unlock()
+		close(p.ready)
+	}
+
+	select {
+	case <-p.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	end := block.ObjectOffset + block.StoredSize
+	if block.ObjectOffset < 0 || end > int64(len(p.data)) {
+		return nil, fmt.Errorf("block at offset %d lies outside pack %s (%d bytes)", block.Offset, block.Object, len(p.data))
+	}
+	return p.data[block.ObjectOffset:end], nil
+}
@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when the requested object does not exist
+	ErrNotFound = errors.New("object not found")
+	// ErrPreconditionFailed is returned when a conditional write finds the
+	// object changed since it was read
+	ErrPreconditionFailed = errors.New("object was modified concurrently")
+)
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// Backend stores the objects of a backup repository under slash-separated
+// keys such as metadata/<snapshot>/manifest.json. Implementations must be
+// safe for concurrent use. Get, GetRange and Stat wrap ErrNotFound when the
+// object does not exist; Delete of a missing object succeeds.
+type Backend interface {
+	// Put creates or replaces an object
+	Put(ctx context.Context, key string, data []byte) error
+	// Get reads a whole object
+	Get(ctx context.Context, key string) ([]byte, error)
+	// GetRange reads length bytes of an object starting at offset
+	GetRange(ctx context.Context, key string, offset, length int64) ([]byte, error)
+	// List returns every object whose key starts with prefix, in key order
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	// Stat returns an object's size and modification time
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	// Delete removes an object
+	Delete(ctx context.Context, key string) error
+}
+
+// ConditionalBackend is a Backend that can replace an object only if nobody
+// else changed it since it was read, for read-modify-write updates of shared
+// objects like the catalog
+type ConditionalBackend interface {
+	Backend
+	// GetWithETag reads a whole object along with a tag identifying its
+	// current version
+	GetWithETag(ctx context.Context, key string) ([]byte, string, error)
+	// PutIfMatch writes the object only if its tag is still etag, or, when
+	// etag is empty, only if it does not exist yet. It wraps
+	// ErrPreconditionFailed otherwise.
+	PutIfMatch(ctx context.Context, key string, data []byte, etag string) error
+}
+
+// Copier is a Backend that copies objects without transferring their data
+// through the client
+type Copier interface {
+	Copy(ctx context.Context, srcKey, dstKey string) error
+}
+
+// Initializer is a Backend that has to be prepared before the first write,
+// e.g. by creating its bucket
+type Initializer interface {
+	Init(ctx context.Context) error
+}